@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	usersBucket    = "users"
+	sessionsBucket = "sessions"
+	tokensBucket   = "tokens"
+)
+
+const sessionCookie = "booksing_session"
+
+// minPasswordLength is the shortest password local users can set
+const minPasswordLength = 8
+
+var (
+	errInvalidCredentials = errors.New("invalid username or password")
+	errUserExists         = errors.New("user already exists")
+	errReservedName       = fmt.Errorf("%q is the name of anonymous requests", anonymousUser)
+	errWeakPassword       = fmt.Errorf("password has to be at least %d characters", minPasswordLength)
+)
+
+// localUser is an account that logs in with a password, users from trusted providers do not have one
+type localUser struct {
+	Name         string    `json:"name"`
+	PasswordHash []byte    `json:"passwordHash"`
+	Created      time.Time `json:"created"`
+}
+
+// session is a login from a browser, it is stored under the hash of the cookie value
+type session struct {
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// apiToken lets scripts and e-readers authenticate as a user, it is stored under the hash of the token
+type apiToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+	// Token is only set in the response that creates the token
+	Token string `json:"token,omitempty"`
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type passwordChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// hashToken is used as key for secrets so a copy of the database does not contain usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (app *booksingApp) addUser(name, password string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errInvalidCredentials
+	}
+	// a local user named like anonymous requests would share their downloads and shelves
+	if name == anonymousUser {
+		return errReservedName
+	}
+	var existing localUser
+	if err := app.store.get(usersBucket, name, &existing); err == nil {
+		return fmt.Errorf("%w: %s", errUserExists, name)
+	}
+	return app.setPassword(name, password)
+}
+
+// setPassword creates the user if it does not exist yet
+func (app *booksingApp) setPassword(name, password string) error {
+	if len(password) < minPasswordLength {
+		return errWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u := localUser{
+		Name:    name,
+		Created: time.Now().In(app.timezone),
+	}
+	var existing localUser
+	if err := app.store.get(usersBucket, name, &existing); err == nil {
+		u.Created = existing.Created
+	}
+	u.PasswordHash = hash
+	err = app.store.put(usersBucket, name, u)
+	// after the put, so a request with the old password can not be cached again
+	app.basicAuth.forget(name)
+	return err
+}
+
+// checkPassword returns errInvalidCredentials for unknown users and wrong passwords alike
+func (app *booksingApp) checkPassword(name, password string) error {
+	var u localUser
+	err := app.store.get(usersBucket, name, &u)
+	if errors.Is(err, ErrNotFound) {
+		return errInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+	if bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)) != nil {
+		return errInvalidCredentials
+	}
+	return nil
+}
+
+// isLocalUser reports whether name is a local user, users from trusted providers are not
+func (app *booksingApp) isLocalUser(name string) bool {
+	var u localUser
+	return app.store.get(usersBucket, name, &u) == nil
+}
+
+// deleteUser removes a local user with all sessions, tokens, devices and the assigned role
+func (app *booksingApp) deleteUser(name string) error {
+	var u localUser
+	err := app.store.get(usersBucket, name, &u)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, bucket := range []string{sessionsBucket, tokensBucket} {
+		keys, err := app.keysOfUser(bucket, name)
+		errs = append(errs, err)
+		for _, k := range keys {
+			errs = append(errs, app.store.delete(bucket, k))
+		}
+	}
+	errs = append(errs, app.deleteKoboDevices(name))
+	errs = append(errs, app.store.delete(devicesBucket, name))
+	errs = append(errs, app.deleteUserShelves(name))
+	errs = append(errs, app.store.delete(rolesBucket, name))
+	errs = append(errs, app.store.delete(usersBucket, name))
+	app.basicAuth.forget(name)
+	return errors.Join(errs...)
+}
+
+// keysOfUser returns the keys of all sessions or tokens of a user
+func (app *booksingApp) keysOfUser(bucket, name string) ([]string, error) {
+	var keys []string
+	err := app.store.each(bucket, func(key string, val []byte) error {
+		var v struct {
+			User string `json:"user"`
+		}
+		if json.Unmarshal(val, &v) == nil && v.User == name {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (app *booksingApp) newSession(user string) (string, session, error) {
+	token := randToken(32)
+	now := time.Now().In(app.timezone)
+	s := session{
+		User:    user,
+		Created: now,
+		Expires: now.Add(app.cfg.SessionDuration),
+	}
+	return token, s, app.store.put(sessionsBucket, hashToken(token), s)
+}
+
+// sessionUser returns the user of a session cookie, expired sessions are removed
+func (app *booksingApp) sessionUser(token string) (string, bool) {
+	var s session
+	err := app.store.get(sessionsBucket, hashToken(token), &s)
+	if err != nil {
+		return "", false
+	}
+	if time.Now().After(s.Expires) {
+		_ = app.store.delete(sessionsBucket, hashToken(token))
+		return "", false
+	}
+	return s.User, true
+}
+
+func (app *booksingApp) tokenUser(token string) (string, bool) {
+	var t apiToken
+	err := app.store.get(tokensBucket, hashToken(token), &t)
+	if err != nil {
+		return "", false
+	}
+	return t.User, true
+}
+
+// login starts a session for a local user
+func (app *booksingApp) login(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	err = app.verifyPassword(r, c.Username, c.Password)
+	if errors.Is(err, errTooManyAttempts) {
+		slog.Warn("login refused after too many failures", "user", c.Username, "ips", getIPFromRequest(r))
+		wait := app.logins.wait(loginKeys(r, c.Username))
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())+1))
+		renderError(w, "TOO_MANY_ATTEMPTS", http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, errInvalidCredentials) {
+		slog.Warn("failed login", "user", c.Username, "ips", getIPFromRequest(r))
+		renderError(w, "INVALID_CREDENTIALS", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("unable to check password", "err", err)
+		renderError(w, "LOGIN_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	token, s, err := app.newSession(c.Username)
+	if err != nil {
+		slog.Error("unable to create session", "err", err)
+		renderError(w, "LOGIN_FAILED", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	slog.Info("audit: login", "user", c.Username, "ips", getIPFromRequest(r))
+	app.me(w, r.WithContext(withUser(r.Context(), c.Username)))
+}
+
+// logout ends the session of the cookie
+func (app *booksingApp) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		err = app.store.delete(sessionsBucket, hashToken(c.Value))
+		if err != nil {
+			slog.Warn("unable to remove session", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// me returns the current user
+func (app *booksingApp) me(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	writeJSON(w, map[string]interface{}{
+		"name":  user,
+		"role":  app.roleOf(user),
+		"admin": app.isAdmin(user),
+	})
+}
+
+// changePassword lets local users change their own password
+func (app *booksingApp) changePassword(w http.ResponseWriter, r *http.Request) {
+	var c passwordChange
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	user := getUserFromRequest(r)
+	err = app.checkPassword(user, c.Old)
+	if errors.Is(err, errInvalidCredentials) {
+		renderError(w, "INVALID_CREDENTIALS", http.StatusForbidden)
+		return
+	}
+	if err == nil {
+		err = app.setPassword(user, c.New)
+	}
+	if errors.Is(err, errWeakPassword) {
+		renderError(w, "WEAK_PASSWORD", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("unable to change password", "err", err)
+		renderError(w, "UPDATE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: password changed", "user", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listTokens returns the api tokens of the current user, without the tokens themselves
+func (app *booksingApp) listTokens(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	all, err := listAll[apiToken](app.store, tokensBucket)
+	if err != nil {
+		slog.Error("failed to list tokens", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	tokens := []apiToken{}
+	for _, t := range all {
+		if t.User == user {
+			tokens = append(tokens, t)
+		}
+	}
+	writeJSON(w, tokens)
+}
+
+// addToken creates an api token for the current user, the token is only returned once
+func (app *booksingApp) addToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Name) == "" {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	user := getUserFromRequest(r)
+	token := "bks_" + randToken(20)
+	t := apiToken{
+		ID:      randToken(6),
+		Name:    strings.TrimSpace(req.Name),
+		User:    user,
+		Created: time.Now().In(app.timezone),
+	}
+	err = app.store.put(tokensBucket, hashToken(token), t)
+	if err != nil {
+		slog.Error("failed to save token", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: api token created", "user", user, "id", t.ID, "name", t.Name)
+	t.Token = token
+	writeJSON(w, t)
+}
+
+// deleteToken revokes one of the api tokens of the current user
+func (app *booksingApp) deleteToken(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	id := r.PathValue("id")
+	key := ""
+	err := app.store.each(tokensBucket, func(k string, val []byte) error {
+		var t apiToken
+		if json.Unmarshal(val, &t) == nil && t.ID == id && t.User == user {
+			key = k
+		}
+		return nil
+	})
+	if err == nil && key == "" {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = app.store.delete(tokensBucket, key)
+	}
+	if err != nil {
+		slog.Error("failed to delete token", "err", err)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: api token revoked", "user", user, "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listUsers returns all local users
+func (app *booksingApp) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := listAll[localUser](app.store, usersBucket)
+	if err != nil {
+		slog.Error("failed to list users", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	type userInfo struct {
+		Name    string    `json:"name"`
+		Created time.Time `json:"created"`
+	}
+	infos := []userInfo{}
+	for _, u := range users {
+		infos = append(infos, userInfo{u.Name, u.Created})
+	}
+	writeJSON(w, infos)
+}
+
+// addUserAPI creates a local user
+func (app *booksingApp) addUserAPI(w http.ResponseWriter, r *http.Request) {
+	var c credentials
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	err = app.addUser(c.Username, c.Password)
+	switch {
+	case errors.Is(err, errUserExists):
+		renderError(w, "USER_EXISTS", http.StatusConflict)
+		return
+	case errors.Is(err, errWeakPassword):
+		renderError(w, "WEAK_PASSWORD", http.StatusBadRequest)
+		return
+	case errors.Is(err, errInvalidCredentials), errors.Is(err, errReservedName):
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("failed to add user", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: user added", "user", getUserFromRequest(r), "name", c.Username)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// deleteUserAPI removes a local user with all sessions and tokens
+func (app *booksingApp) deleteUserAPI(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := app.deleteUser(name)
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to delete user", "err", err)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: user deleted", "user", getUserFromRequest(r), "name", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SessionDuration = time.Hour
+	if err := app.addUser("reader", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", app.login)
+	mux.HandleFunc("POST /api/tokens", app.addToken)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(getUserFromRequest(r)))
+	})
+	handler := app.authenticate(mux)
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(path string, set func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if set != nil {
+			set(req)
+		}
+		return do(req)
+	}
+
+	if rec := get("/api/search", nil); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected anonymous api requests to be refused, got %d", rec.Code)
+	}
+	if rec := get("/", nil); rec.Code != http.StatusOK || rec.Body.String() != anonymousUser {
+		t.Errorf("expected the frontend to be public, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	tailscale := func(r *http.Request) {
+		r.Header.Set("Tailscale-User-Login", "someone@example.com")
+	}
+	if rec := get("/api/search", tailscale); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected headers of providers that are not configured to be ignored, got %d", rec.Code)
+	}
+	app.cfg.AuthProviders = []string{providerTailscale}
+	if rec := get("/api/search", tailscale); rec.Body.String() != "someone@example.com" {
+		t.Errorf("expected the configured provider to be trusted, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := get("/opds", func(r *http.Request) { r.SetBasicAuth("reader", "wrong password") }); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", rec.Code)
+	}
+	if rec := get("/opds", func(r *http.Request) { r.SetBasicAuth("reader", "correct horse") }); rec.Body.String() != "reader" {
+		t.Errorf("expected basic auth to work, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec := do(httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"reader","password":"correct horse"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	session := func(r *http.Request) { r.AddCookie(cookies[0]) }
+	if rec := get("/api/search", session); rec.Body.String() != "reader" {
+		t.Errorf("expected the session to identify the user, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/tokens", strings.NewReader(`{"name":"koreader"}`))
+	session(req)
+	rec = do(req)
+	var token apiToken
+	if err := json.NewDecoder(rec.Body).Decode(&token); err != nil || token.Token == "" {
+		t.Fatalf("expected a token, got %d (%v)", rec.Code, err)
+	}
+	if rec := get("/api/search", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token.Token) }); rec.Body.String() != "reader" {
+		t.Errorf("expected the token to identify the user, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/opds", func(r *http.Request) { r.SetBasicAuth("reader", token.Token) }); rec.Body.String() != "reader" {
+		t.Errorf("expected the token to work as basic auth password, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if err := app.deleteUser("reader"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("/api/search", session); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected sessions of deleted users to be removed, got %d", rec.Code)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SessionDuration = time.Hour
+	if err := app.addUser("reader", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.addUser(anonymousUser, "correct horse"); !errors.Is(err, errReservedName) {
+		t.Errorf("expected the anonymous user to be reserved, got %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/login", app.login)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(getUserFromRequest(r)))
+	})
+	handler := app.authenticate(mux)
+	// every request comes from a new connection, so the port changes
+	port := 40000
+	remote := func(host string) string {
+		port++
+		return fmt.Sprintf("%s:%d", host, port)
+	}
+	loginFrom := func(host, password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"reader","password":"`+password+`"}`))
+		req.RemoteAddr = remote(host)
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(password string) *httptest.ResponseRecorder {
+		return loginFrom("192.0.2.1", password)
+	}
+	basic := func(password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/opds", nil)
+		req.RemoteAddr = remote("192.0.2.1")
+		req.SetBasicAuth("reader", password)
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// a checked basic auth password is cached, until the password changes
+	if rec := basic("correct horse"); rec.Body.String() != "reader" {
+		t.Fatalf("expected basic auth to work, got %d", rec.Code)
+	}
+	if !app.basicAuth.check("reader", "correct horse") {
+		t.Error("expected the password to be cached")
+	}
+	if err := app.setPassword("reader", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := basic("correct horse"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old password to be refused, got %d", rec.Code)
+	}
+
+	for range loginFreeAttempts - 1 {
+		if rec := login("wrong password"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a wrong password to be refused, got %d", rec.Code)
+		}
+	}
+	// the failures of basic auth and the login form add up, after that even the right password waits
+	rec := login("battery staple")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("expected the login to be refused during the backoff, got %d", rec.Code)
+	}
+	if rec := basic("battery staple"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected basic auth to be refused during the backoff, got %d", rec.Code)
+	}
+	// a client that never failed is not locked out by the failures of another client
+	if rec := loginFrom("198.51.100.7", "battery staple"); rec.Code != http.StatusOK {
+		t.Errorf("expected another client to log in, got %d", rec.Code)
+	}
+	for range loginFreeAttempts {
+		loginFrom("203.0.113.9", "wrong password")
+	}
+	if rec := loginFrom("198.51.100.7", "wrong password"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the first failure of a client to be checked, got %d", rec.Code)
+	}
+	if rec := loginFrom("198.51.100.7", "battery staple"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a client that failed to wait for the user backoff, got %d", rec.Code)
+	}
+
+	app.logins.mu.Lock()
+	for _, f := range app.logins.failures {
+		f.last = f.last.Add(-time.Minute)
+	}
+	app.logins.mu.Unlock()
+	if rec := login("battery staple"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the login to work after the backoff, got %d", rec.Code)
+	}
+	if rec := login("wrong password"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a success to reset the backoff, got %d", rec.Code)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for count, want := range map[int]time.Duration{
+		0:                       0,
+		loginFreeAttempts - 1:   0,
+		loginFreeAttempts:       time.Second,
+		loginFreeAttempts + 3:   8 * time.Second,
+		loginFreeAttempts + 100: loginMaxBackoff,
+	} {
+		if got := backoffDelay(count); got != want {
+			t.Errorf("backoffDelay(%d): expected %v, got %v", count, want, got)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.DefaultRole = roleReader
+	app.cfg.Admins = []string{"root"}
+	app.cfg.Librarians = []string{"librarian@example.com"}
+	app.cfg.AuthProviders = []string{providerTailscale}
+
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("GET /api/search", ok)
+	mux.HandleFunc("POST /api/add", app.requireRole(roleUploader, ok))
+	mux.HandleFunc("DELETE /api/book", app.requireRole(roleLibrarian, ok))
+	mux.HandleFunc("PUT /api/users/{name}/role", app.requireRole(roleAdmin, app.setRoleAPI))
+	handler := app.authenticate(mux)
+
+	do := func(user, method, path, body string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Tailscale-User-Login", user)
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, c := range []struct {
+		user, method, path string
+		want               int
+	}{
+		{"family@example.com", http.MethodGet, "/api/search", http.StatusOK},
+		{"family@example.com", http.MethodPost, "/api/add", http.StatusForbidden},
+		{"family@example.com", http.MethodDelete, "/api/book", http.StatusForbidden},
+		{"librarian@example.com", http.MethodPost, "/api/add", http.StatusOK},
+		{"librarian@example.com", http.MethodDelete, "/api/book", http.StatusOK},
+		{"librarian@example.com", http.MethodPut, "/api/users/family@example.com/role", http.StatusForbidden},
+	} {
+		if code := do(c.user, c.method, c.path, ""); code != c.want {
+			t.Errorf("%s %s %s: expected %d, got %d", c.user, c.method, c.path, c.want, code)
+		}
+	}
+
+	if code := do("root", http.MethodPut, "/api/users/family@example.com/role", `{"role":"wizard"}`); code != http.StatusBadRequest {
+		t.Errorf("expected unknown roles to be refused, got %d", code)
+	}
+	if code := do("root", http.MethodPut, "/api/users/family@example.com/role", `{"role":"uploader"}`); code != http.StatusOK {
+		t.Fatalf("expected admin to assign roles, got %d", code)
+	}
+	if code := do("family@example.com", http.MethodPost, "/api/add", ""); code != http.StatusOK {
+		t.Errorf("expected uploader to upload, got %d", code)
+	}
+	if code := do("family@example.com", http.MethodDelete, "/api/book", ""); code != http.StatusForbidden {
+		t.Errorf("expected uploader not to delete, got %d", code)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type authorSummary struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type mergeAuthorsRequest struct {
+	Canonical string   `json:"canonical"`
+	Variants  []string `json:"variants"`
+}
+
+type mergeFailure struct {
+	Hash  string `json:"hash"`
+	Title string `json:"title"`
+	Error string `json:"error"`
+}
+
+type mergeAuthorsResult struct {
+	Canonical string         `json:"canonical"`
+	Merged    int            `json:"merged"`
+	Failed    []mergeFailure `json:"failed"`
+}
+
+// listAuthors returns all authors with the number of books per author, the q parameter filters on name
+func (app *booksingApp) listAuthors(w http.ResponseWriter, r *http.Request) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Facets: []string{"Author"},
+	})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	authors := []authorSummary{}
+	for name, count := range res.Facets["Author"] {
+		if q != "" && !strings.Contains(strings.ToLower(name), q) {
+			continue
+		}
+		authors = append(authors, authorSummary{Name: name, Count: count})
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		return authors[i].Name < authors[j].Name
+	})
+
+	writeJSON(w, authors)
+}
+
+// mergeAuthors rewrites all books of the variants to the canonical author
+func (app *booksingApp) mergeAuthors(w http.ResponseWriter, r *http.Request) {
+	var req mergeAuthorsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Canonical) == "" || len(req.Variants) == 0 {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	// a rebuild running meanwhile would overwrite the change
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	res, err := app.mergeAuthorVariants(Fix(req.Canonical, true, true), req.Variants)
+	if err != nil {
+		slog.Error("failed to merge authors", "err", err)
+		renderError(w, "MERGE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("merged authors", "user", getUserFromRequest(r), "canonical", res.Canonical,
+		"variants", req.Variants, "merged", res.Merged, "failed", len(res.Failed))
+
+	writeJSON(w, res)
+}
+
+func (app *booksingApp) mergeAuthorVariants(canonical string, variants []string) (*mergeAuthorsResult, error) {
+	res := &mergeAuthorsResult{
+		Canonical: canonical,
+		Failed:    []mergeFailure{},
+	}
+
+	for _, variant := range variants {
+		if variant == canonical {
+			continue
+		}
+		books, err := app.allBooks(SearchFilter{Author: variant})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range books {
+			err := app.renameAuthor(b, canonical)
+			if err != nil {
+				slog.Warn("unable to merge author", "err", err, "hash", b.Hash, "variant", variant)
+				res.Failed = append(res.Failed, mergeFailure{
+					Hash:  b.Hash,
+					Title: b.Title,
+					Error: err.Error(),
+				})
+				continue
+			}
+			res.Merged++
+		}
+	}
+	return res, nil
+}
+
+// renameAuthor changes the author of a book, which also changes its hash and location on disk
+func (app *booksingApp) renameAuthor(b Book, author string) error {
+	oldHash, oldAuthor := b.Hash, b.Author
+	b.Author = author
+	b.updateHash()
+
+	if b.Hash != oldHash {
+		exists, err := app.searchDB.HasHash(b.Hash)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s", ErrDuplicate, b.Hash)
+		}
+	}
+
+	err := app.moveBook(&b)
+	if err != nil {
+		return err
+	}
+	// moveBack puts the files where the index still expects them when a later step fails
+	moveBack := func(step string) {
+		back := b
+		back.Author = oldAuthor
+		if err := app.moveBook(&back); err != nil {
+			slog.Error("unable to move book back after failed "+step, "err", err, "hash", oldHash, "path", b.Path)
+		}
+	}
+
+	err = app.searchDB.AddBooks([]Book{b})
+	if err != nil {
+		moveBack("index update")
+		return err
+	}
+	if b.Hash != oldHash {
+		err = app.searchDB.DeleteBook(oldHash)
+		if err != nil {
+			if err := app.searchDB.DeleteBook(b.Hash); err != nil {
+				slog.Error("unable to remove renamed book after failed delete", "err", err, "hash", b.Hash)
+			}
+			moveBack("delete")
+			return err
+		}
+		app.removeKepub(oldHash)
+		return app.rehashShelves(oldHash, b.Hash)
+	}
+	return nil
+}
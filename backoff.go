@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// basicAuthCacheTTL is how long a password that was checked over basic auth is accepted without running
+// bcrypt again, e-readers send the password with every request
+const basicAuthCacheTTL = 5 * time.Minute
+
+const (
+	// loginFreeAttempts is the number of failed logins before the backoff starts
+	loginFreeAttempts = 5
+	loginMaxBackoff   = 15 * time.Minute
+)
+
+var errTooManyAttempts = errors.New("too many failed logins, try again later")
+
+// basicAuthCache holds the hashes of credentials that were checked recently, the zero value is ready to use
+type basicAuthCache struct {
+	mu      sync.Mutex
+	entries map[string]basicAuthEntry
+}
+
+type basicAuthEntry struct {
+	user    string
+	expires time.Time
+}
+
+func basicAuthKey(name, password string) string {
+	return hashToken(name + "\x00" + password)
+}
+
+func (c *basicAuthCache) check(name, password string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[basicAuthKey(name, password)]
+	return ok && time.Now().Before(e.expires)
+}
+
+func (c *basicAuthCache) add(name, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]basicAuthEntry{}
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[basicAuthKey(name, password)] = basicAuthEntry{user: name, expires: now.Add(basicAuthCacheTTL)}
+}
+
+// forget removes every cached password of a user, so a changed password or removed user is checked again
+func (c *basicAuthCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if e.user == name {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// loginBackoff counts failed logins per client and per user, the zero value is ready to use
+type loginBackoff struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+// backoffDelay doubles with every failure after the free attempts, up to loginMaxBackoff
+func backoffDelay(count int) time.Duration {
+	if count < loginFreeAttempts {
+		return 0
+	}
+	return min(time.Second<<min(count-loginFreeAttempts, 10), loginMaxBackoff)
+}
+
+// wait returns how long logins of a client for a user are refused. The failures of the user only count for
+// clients that failed themselves, otherwise anyone could lock out a user by guessing wrong on purpose.
+func (b *loginBackoff) wait(client, user string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.failures[client]
+	if !ok {
+		return 0
+	}
+	wait := time.Until(c.last.Add(backoffDelay(c.count)))
+	if u, ok := b.failures[user]; ok {
+		wait = max(wait, time.Until(u.last.Add(backoffDelay(u.count))))
+	}
+	return wait
+}
+
+func (b *loginBackoff) fail(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures == nil {
+		b.failures = map[string]*loginFailures{}
+	}
+	now := time.Now()
+	// clients that stopped failing are forgotten, so the map does not grow with every address
+	for k, f := range b.failures {
+		if now.Sub(f.last) > 2*loginMaxBackoff {
+			delete(b.failures, k)
+		}
+	}
+	for _, k := range keys {
+		f, ok := b.failures[k]
+		if !ok {
+			f = &loginFailures{}
+			b.failures[k] = f
+		}
+		f.count++
+		f.last = now
+	}
+}
+
+func (b *loginBackoff) reset(keys ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, k := range keys {
+		delete(b.failures, k)
+	}
+}
+
+// loginKeys are the client and user keys a login is counted under. The client is the address of the connection
+// without the port, which changes with every connection, forwarded headers are not used because they can be spoofed.
+func loginKeys(r *http.Request, name string) (string, string) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host, "user:" + name
+}
+
+// verifyPassword checks the password of a local user with a backoff for clients and users that failed too often,
+// errTooManyAttempts is returned without checking the password while the backoff lasts
+func (app *booksingApp) verifyPassword(r *http.Request, name, password string) error {
+	client, user := loginKeys(r, name)
+	if app.logins.wait(client, user) > 0 {
+		return errTooManyAttempts
+	}
+	err := app.checkPassword(name, password)
+	if errors.Is(err, errInvalidCredentials) {
+		app.logins.fail(client, user)
+	}
+	if err == nil {
+		app.logins.reset(client, user)
+	}
+	return err
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+// bleveDB is an embedded, on-disk searchDB that does not need any external service
+type bleveDB struct {
+	// mu is only taken for writing to swap the index after a rebuild
+	mu    sync.RWMutex
+	index bleve.Index
+	path  string
+}
+
+const bleveIndexName = "booksing.bleve"
+
+// NewBleveSearch opens the local index in dir, creating it if it does not exist yet
+func NewBleveSearch(dir string) (*bleveDB, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create database dir: %w", err)
+	}
+
+	indexPath := filepath.Join(dir, bleveIndexName)
+	slog.Info("Opening local search index", "path", indexPath)
+	index, err := bleve.Open(indexPath)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		slog.Info("Creating local search index", "path", indexPath)
+		index, err = bleve.New(indexPath, bookMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bleveDB{
+		index: index,
+		path:  indexPath,
+	}, nil
+}
+
+func bookMapping() mapping.IndexMapping {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = standard.Name
+
+	kw := bleve.NewTextFieldMapping()
+	kw.Analyzer = keyword.Name
+	kw.IncludeInAll = false
+
+	date := bleve.NewDateTimeFieldMapping()
+	date.IncludeInAll = false
+
+	num := bleve.NewNumericFieldMapping()
+	num.IncludeInAll = false
+
+	book := bleve.NewDocumentStaticMapping()
+	book.AddFieldMappingsAt("Title", text)
+	book.AddFieldMappingsAt("Description", text)
+	book.AddFieldMappingsAt("Hash", kw)
+	// text fields that are used for facets or sorting get an extra exact field next to the analyzed one
+	for _, f := range append([]string{"Title"}, facetFields...) {
+		exact := bleve.NewTextFieldMapping()
+		exact.Analyzer = keyword.Name
+		exact.IncludeInAll = false
+		exact.Name = bleveExactField(f)
+		if f == "Language" {
+			book.AddFieldMappingsAt(f, exact)
+		} else {
+			book.AddFieldMappingsAt(f, text, exact)
+		}
+	}
+	book.AddFieldMappingsAt("ISBN", kw)
+	book.AddFieldMappingsAt("Added", date)
+	book.AddFieldMappingsAt("PublishDate", date)
+	book.AddFieldMappingsAt("SeriesIndex", num)
+	book.AddFieldMappingsAt("Size", num)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = book
+	m.DefaultAnalyzer = standard.Name
+	return m
+}
+
+// the full book is stored next to the index so results can be returned without storing every field
+func bleveBookKey(hash string) []byte {
+	return []byte("book/" + hash)
+}
+
+func (db *bleveDB) GetBookCount() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	c, err := db.index.DocCount()
+	if err != nil {
+		return 0
+	}
+	return int(c)
+}
+
+func (db *bleveDB) HasHash(h string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	val, err := db.index.GetInternal(bleveBookKey(h))
+	if err != nil {
+		return false, err
+	}
+	return val != nil, nil
+}
+
+func (db *bleveDB) GetBook(h string) (*Book, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getBook(h)
+}
+
+func (db *bleveDB) getBook(h string) (*Book, error) {
+	val, err := db.index.GetInternal(bleveBookKey(h))
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		return nil, ErrNotFound
+	}
+	var b Book
+	err = json.Unmarshal(val, &b)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (db *bleveDB) AddBooks(books []Book) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	batch := db.index.NewBatch()
+	for _, b := range books {
+		js, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		err = batch.Index(b.Hash, b)
+		if err != nil {
+			return err
+		}
+		batch.SetInternal(bleveBookKey(b.Hash), js)
+	}
+	return db.index.Batch(batch)
+}
+
+func (db *bleveDB) DeleteBook(hash string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	batch := db.index.NewBatch()
+	batch.Delete(hash)
+	batch.DeleteInternal(bleveBookKey(hash))
+	return db.index.Batch(batch)
+}
+
+// Rebuild fills a new index next to the current one and moves it in place when it is complete
+func (db *bleveDB) Rebuild(fill func(add func([]Book) error) error) error {
+	tmpPath := db.path + ".rebuild"
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		return err
+	}
+	index, err := bleve.New(tmpPath, bookMapping())
+	if err != nil {
+		return err
+	}
+	staging := &bleveDB{
+		index: index,
+		path:  tmpPath,
+	}
+	err = fill(staging.AddBooks)
+	// the index has to be closed before it can be moved
+	err = errors.Join(err, index.Close())
+	if err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	oldPath := db.path + ".old"
+	// db.index is only replaced by an index that opened, after a failure it is the closed old index
+	// which returns errors instead of leaving a nil index behind
+	err = db.index.Close()
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(oldPath)
+	if err == nil {
+		err = os.Rename(db.path, oldPath)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+		if err != nil {
+			os.Rename(oldPath, db.path)
+		}
+	}
+	if err == nil {
+		index, openErr := bleve.Open(db.path)
+		if openErr == nil {
+			db.index = index
+			return os.RemoveAll(oldPath)
+		}
+		// put the old index back
+		err = openErr
+		os.RemoveAll(db.path)
+		os.Rename(oldPath, db.path)
+	}
+	if index, openErr := bleve.Open(db.path); openErr == nil {
+		db.index = index
+	} else {
+		err = errors.Join(err, openErr)
+	}
+	return err
+}
+
+func bleveExactField(field string) string {
+	return field + "Exact"
+}
+
+func (db *bleveDB) GetBooks(q SearchQuery) (*SearchResult, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	req := bleve.NewSearchRequestOptions(bleveQuery(q), int(q.Limit), int(q.Offset), false)
+	for _, f := range q.Facets {
+		if !slices.Contains(facetFields, f) {
+			return nil, fmt.Errorf("%s can not be used as facet", f)
+		}
+		req.AddFacet(f, bleve.NewFacetRequest(bleveExactField(f), maxFacetValues))
+	}
+	if len(q.Sort) > 0 {
+		var order []string
+		for _, s := range q.Sort {
+			field := s.Field
+			switch field {
+			case "Title", "Author", "Series":
+				field = bleveExactField(field)
+			}
+			if s.Descending {
+				field = "-" + field
+			}
+			order = append(order, field)
+		}
+		req.SortBy(append(order, "_id"))
+	}
+
+	resp, err := db.index.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	books := []Book{}
+	for _, hit := range resp.Hits {
+		book, err := db.getBook(hit.ID)
+		if err != nil {
+			slog.Warn("Failed to load book", "err", err, "hash", hit.ID)
+			continue
+		}
+		books = append(books, *book)
+	}
+
+	result := &SearchResult{
+		Items: books,
+		Total: int64(resp.Total),
+	}
+	if len(resp.Facets) > 0 {
+		result.Facets = make(map[string]map[string]int64)
+		for name, facet := range resp.Facets {
+			result.Facets[name] = make(map[string]int64)
+			if facet.Terms == nil {
+				continue
+			}
+			for _, t := range facet.Terms.Terms() {
+				if t.Term != "" {
+					result.Facets[name][t.Term] = int64(t.Count)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// bleveQuery combines the free text query with the exact filters
+func bleveQuery(q SearchQuery) query.Query {
+	conjuncts := []query.Query{fuzzyQuery(q.Query)}
+	for field, val := range map[string]string{
+		"Language":  q.Filter.Language,
+		"Author":    q.Filter.Author,
+		"Series":    q.Filter.Series,
+		"Publisher": q.Filter.Publisher,
+	} {
+		if val != "" {
+			t := bleve.NewTermQuery(val)
+			t.SetField(bleveExactField(field))
+			conjuncts = append(conjuncts, t)
+		}
+	}
+	if q.Filter.ISBN != "" {
+		t := bleve.NewTermQuery(q.Filter.ISBN)
+		t.SetField("ISBN")
+		conjuncts = append(conjuncts, t)
+	}
+	if !q.Filter.PublishedAfter.IsZero() || !q.Filter.PublishedBefore.IsZero() {
+		inclusive := true
+		d := bleve.NewDateRangeInclusiveQuery(q.Filter.PublishedAfter, q.Filter.PublishedBefore, &inclusive, &inclusive)
+		d.SetField("PublishDate")
+		conjuncts = append(conjuncts, d)
+	}
+	if len(conjuncts) == 1 {
+		return conjuncts[0]
+	}
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+// fuzzyQuery mimics the meili defaults: every word has to match, the last word may be a prefix
+// and longer words allow for typos
+func fuzzyQuery(q string) query.Query {
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(q)) {
+		if !contains(stopWords, w) {
+			words = append(words, w)
+		}
+	}
+	if len(words) == 0 {
+		return bleve.NewMatchAllQuery()
+	}
+
+	var conjuncts []query.Query
+	for i, w := range words {
+		match := bleve.NewMatchQuery(w)
+		match.SetFuzziness(typoTolerance(w))
+		disjuncts := []query.Query{match}
+		if i == len(words)-1 {
+			disjuncts = append(disjuncts, bleve.NewPrefixQuery(w))
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(disjuncts...))
+	}
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+// typoTolerance returns the same number of allowed typos as meili does by default
+func typoTolerance(word string) int {
+	switch l := len([]rune(word)); {
+	case l >= 9:
+		return 2
+	case l >= 5:
+		return 1
+	}
+	return 0
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"time"
@@ -14,7 +16,6 @@ import (
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 
-	"github.com/gnur/booksing/epub"
 	"github.com/kennygrant/sanitize"
 )
 
@@ -26,6 +27,7 @@ type StorageLocation string
 
 var ErrFileAlreadyExists = errors.New("Target file already exists")
 var ErrCoverWriteFailed = errors.New("Failed to write cover")
+var ErrUnknownFormat = errors.New("Unknown book format")
 
 const (
 	FileStorage StorageLocation = "FILE"
@@ -48,75 +50,148 @@ type Book struct {
 	Series      string
 	PublishDate time.Time
 	SeriesIndex float64
+	// Format is the name of the bookFormat of the file, empty for books that were imported as epub
+	Format string `json:",omitempty"`
+	// Files holds every format of the book, Path, Size and Format describe the first one that was imported
+	Files []BookFile `json:",omitempty"`
+	// Variant tells apart books with the same author and title that were both kept after a duplicate import
+	Variant string `json:",omitempty"`
 }
 
-type FileLocation struct {
-	Path string
+// BookFile is a single file of a book, a book has at most one file per format
+type BookFile struct {
+	Format   string
+	Path     string
+	Size     int64
+	Checksum string
 }
 
-// NewBookFromFile creates a book object from a file
-func NewBookFromFile(bookpath string, baseDir string) (bk *Book, err error) {
-	epub, cover, err := epub.ParseFile(bookpath)
-	if err != nil {
-		fmt.Println(cover)
-		return nil, err
+// files returns all files of the book, books indexed before Files existed only have their primary file
+func (b *Book) files() []BookFile {
+	if len(b.Files) > 0 {
+		return b.Files
 	}
+	return []BookFile{{Format: formatByName(b.Format).Name, Path: b.Path, Size: b.Size}}
+}
 
-	book := Book{
-		Title:       epub.Title,
-		Author:      epub.Author,
-		Language:    epub.Language,
-		Description: epub.Description,
-		HasCover:    epub.HasCover,
-		Publisher:   epub.Publisher,
-		ISBN:        epub.ISBN,
-		Series:      epub.Series,
-		PublishDate: epub.PublishDate,
-		SeriesIndex: epub.SeriesIndex,
+// file returns the file with the given format, the primary file is returned when format is empty
+func (b *Book) file(format string) (BookFile, bool) {
+	if format == "" {
+		format = formatByName(b.Format).Name
 	}
+	for _, f := range b.files() {
+		if strings.EqualFold(f.Format, format) {
+			return f, true
+		}
+	}
+	return BookFile{}, false
+}
 
-	f, err := os.Open(bookpath)
-	if err != nil {
-		return nil, err
+// updateHash sets the hash that matches the author, title and variant of the book
+func (b *Book) updateHash() {
+	b.Hash = HashBook(b.Author, b.Title)
+	if b.Variant != "" {
+		b.Hash += "-" + b.Variant
+	}
+}
+
+// setPath moves the primary file of the book to p, the matching entry in Files is updated as well
+func (b *Book) setPath(p string) {
+	for i := range b.Files {
+		if b.Files[i].Path == b.Path {
+			b.Files[i].Path = p
+		}
 	}
+	b.Path = p
+}
 
-	fp := bookpath
+type FileLocation struct {
+	Path string
+}
 
-	fi, err := f.Stat()
+// ParseBookFile creates a book object from a file without moving it, the parser is picked based on the format of the file
+func ParseBookFile(bookpath string) (*Book, []byte, error) {
+	format := formatForFile(bookpath)
+	if format == nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownFormat, filepath.Ext(bookpath))
+	}
+	book, cover, err := format.Parse(bookpath)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	cover = toJPEG(cover)
+	book.HasCover = len(cover) > 0
+	book.Path = bookpath
+	if format.Name != formatEPUB {
+		book.Format = format.Name
+	}
+
+	fi, err := os.Stat(bookpath)
+	if err != nil {
+		return nil, nil, err
 	}
 	book.Added = fi.ModTime()
 	book.Size = fi.Size()
 
+	checksum, err := fileChecksum(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	book.Files = []BookFile{{
+		Format:   format.Name,
+		Path:     bookpath,
+		Size:     book.Size,
+		Checksum: checksum,
+	}}
+
 	book.Title = Fix(book.Title, true, false)
 	book.Author = Fix(book.Author, true, true)
 	book.Language = FixLang(book.Language)
 	book.Description = sanitize.HTML(book.Description)
 
-	book.Hash = HashBook(book.Author, book.Title)
+	book.updateHash()
+
+	return book, cover, nil
+}
 
-	newBookPath := path.Join(baseDir, GetBookPath(book.Title, book.Author)+".epub")
+// StoreBookFile moves the book to newBookPath and writes the cover next to it
+func StoreBookFile(book *Book, cover []byte, newBookPath string) error {
 	if _, err := os.Stat(newBookPath); err == nil {
-		return &book, ErrFileAlreadyExists
+		return ErrFileAlreadyExists
 	}
-	baseDir = filepath.Dir(newBookPath)
-	err = os.MkdirAll(baseDir, 0755)
-	if err == nil {
-		_ = os.Rename(bookpath, newBookPath)
-		fp = newBookPath
+	err := os.MkdirAll(filepath.Dir(newBookPath), 0755)
+	if err != nil {
+		return err
 	}
-	book.Path = fp
+	err = os.Rename(book.Path, newBookPath)
+	if err != nil {
+		return err
+	}
+	book.setPath(newBookPath)
 	if book.HasCover {
-		book.CoverPath = strings.Replace(fp, ".epub", ".jpg", 1)
+		book.CoverPath = coverPath(newBookPath)
 		err = os.WriteFile(book.CoverPath, cover, 0644)
 		if err != nil {
-			return &book, ErrCoverWriteFailed
+			return ErrCoverWriteFailed
 		}
 	}
 
-	return &book, nil
+	return nil
+}
+
+// fileChecksum returns the hex encoded sha256 of a file
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func GetBookPath(title, author string) string {
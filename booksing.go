@@ -2,52 +2,49 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	zglob "github.com/mattn/go-zglob"
 	"golang.org/x/sync/semaphore"
 )
 
-const (
-	stateUnlocked uint32 = iota
-	stateLocked
-)
-
-var (
-	locker = stateUnlocked
-)
+// importLock makes sure only one import runs at a time, a full scan is skipped while another import runs
+var importLock sync.Mutex
 
+// refreshLoop runs a full scan of the import dir at startup and every ScanInterval
 func (app *booksingApp) refreshLoop() {
 	app.refresh()
-	for {
-		select {
-		case <-time.After(time.Minute):
-		case <-app.refreshChan:
-			app.refresh()
-		}
+	var scan <-chan time.Time
+	if app.cfg.ScanInterval > 0 {
+		ticker := time.NewTicker(app.cfg.ScanInterval)
+		defer ticker.Stop()
+		scan = ticker.C
+	}
+	for range scan {
+		app.refresh()
 	}
 }
 
+// refresh imports every book in the import dir
 func (app *booksingApp) refresh() {
-	if !atomic.CompareAndSwapUint32(&locker, stateUnlocked, stateLocked) {
+	if !importLock.TryLock() {
 		slog.Warn("not refreshing because it is already running")
 		return
 	}
+	defer importLock.Unlock()
 	slog.Info("Scanning import dir")
-	defer atomic.StoreUint32(&locker, stateUnlocked)
-	defer func() {
-		app.state = "idle"
-	}()
 
-	app.state = "indexing"
-	matches, err := zglob.Glob(filepath.Join(app.importDir, "/**/*.epub"))
+	matches, err := app.importCandidates()
 	if err != nil {
 		slog.Error("glob of all books failed", "err", err)
 		return
@@ -57,16 +54,33 @@ func (app *booksingApp) refresh() {
 		slog.Info("no new books found")
 		return
 	}
-	var books []Book
+	app.importFiles(newImportJob(importSourceScan, "", matches))
+}
+
+// importFiles imports the files of the job, the caller has to hold the importLock
+func (app *booksingApp) importFiles(job *importJob) {
+	job.start()
+	app.saveImportJob(job, true)
+	defer func() {
+		job.finish()
+		app.saveImportJob(job, true)
+		err := app.pruneImportJobs()
+		if err != nil {
+			slog.Warn("unable to remove old import jobs", "err", err)
+		}
+	}()
+
+	matches := job.paths()
 	counter := 0
 
 	slog.Info("located books on filesystem, processing per batchsize", "total", len(matches), "bookdir", app.importDir)
 
 	ctx := context.TODO()
 	toProcess := len(matches)
-	bookQ := make(chan *Book)
+	bookQ := make(chan *parsedBook)
 	sem := semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0)))
 
+	// parsing is done in parallel, storing is done one book at a time so formats of the same book can be combined
 	for _, filename := range matches {
 		slog.Debug("parsing book", "f", filename)
 
@@ -76,77 +90,326 @@ func (app *booksingApp) refresh() {
 			}
 			defer sem.Release(1)
 
-			book, err := NewBookFromFile(f, app.bookDir)
-			if err != nil {
-				slog.Error("failed to parse book", "err", err, "file", f)
-				app.moveBookToFailed(f)
-			}
-
-			bookQ <- book
+			bookQ <- app.parseImport(f)
 		}(filename)
 
 	}
+
+	// pending holds the books of the current batch, they are not in the index yet. The files that end up in
+	// those books stay parsed until the batch is indexed.
+	pending := map[string]*Book{}
+	var order []string
+	var batch []*parsedBook
 	processed := 0
-	for book := range bookQ {
+	for p := range bookQ {
 		processed++
-		if book == nil {
-			if processed == toProcess {
-				close(bookQ)
+		if p.err != nil {
+			job.update(p.path, importFailed, "", p.err)
+		} else {
+			if upd, ok := job.overrides[p.path]; ok {
+				upd.apply(p.book)
 			}
-			continue
-		}
-		if !app.keepBook(book) {
-			app.moveBookToFailed(book.Path)
-			if processed == toProcess {
-				close(bookQ)
+			job.update(p.path, importParsed, p.book.Hash, nil)
+			book, status, err := app.importBook(p.book, p.cover, pending)
+			if book != nil {
+				pending[book.Hash] = book
+				order = append(order, book.Hash)
+				counter++
+			}
+			if _, ok := pending[p.book.Hash]; ok && status == importIndexed {
+				batch = append(batch, p)
+			} else {
+				job.update(p.path, status, p.book.Hash, err)
 			}
-			continue
 		}
-		books = append(books, *book)
-		counter++
-		if len(books) == 50 || processed == toProcess {
-			err = app.searchDB.AddBooks(books)
-			if err != nil {
-				slog.Error("bulk insert into meili failed", "err", err)
+		app.saveImportJob(job, false)
+		if len(order) == 50 || processed == toProcess {
+			books := make([]Book, 0, len(order))
+			for _, h := range order {
+				books = append(books, *pending[h])
 			}
-			books = []Book{}
+			status := importIndexed
+			var err error
+			if len(books) > 0 {
+				err = app.searchDB.AddBooks(books)
+				if err != nil {
+					// the files are in the bookdir already, fsck -repair unindexed adds them later
+					slog.Error("bulk insert into search index failed", "err", err)
+					status, err = importFailed, fmt.Errorf("unable to index: %w", err)
+				}
+			}
+			for _, p := range batch {
+				job.update(p.path, status, p.book.Hash, err)
+			}
+			pending = map[string]*Book{}
+			order = nil
+			batch = nil
 		}
 		slog.Debug("processed book", "counter", counter, "total", toProcess)
 		if processed == toProcess {
 			close(bookQ)
 		}
+	}
+
+	slog.Info("Done with refresh")
+
+}
+
+type parsedBook struct {
+	path  string
+	book  *Book
+	cover []byte
+	err   error
+}
+
+// parseImport parses a single file from the import dir, files that can not be parsed are moved to the faildir
+func (app *booksingApp) parseImport(f string) *parsedBook {
+	book, cover, err := ParseBookFile(f)
+	if err != nil {
+		slog.Error("failed to parse book", "err", err, "file", f)
+		app.moveBookToFailed(f, failedParse, err, nil)
+		return &parsedBook{path: f, err: err}
+	}
+	return &parsedBook{path: f, book: book, cover: cover}
+}
+
+// importCandidates returns all files in the import dir that have a known book format, files that the watcher
+// is waiting on are left to the watcher because they might still be written
+func (app *booksingApp) importCandidates() ([]string, error) {
+	files, err := zglob.Glob(filepath.Join(app.importDir, "/**/*"))
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil || fi.IsDir() || app.isWatched(f) {
+			continue
+		}
+		if formatForFile(f) != nil {
+			matches = append(matches, f)
+		}
+	}
+	return matches, nil
+}
 
+// importBook moves a parsed book into the bookdir. A new format of a book that is already known is added
+// to that book, other duplicates are queued for review. nil is returned for every file that should not be
+// indexed as a new book, the status tells what happened to the file and the error why it was rejected.
+func (app *booksingApp) importBook(book *Book, cover []byte, pending map[string]*Book) (*Book, string, error) {
+	if reason, err := app.rejectBook(book); reason != "" {
+		app.moveBookToFailed(book.Path, reason, err, book)
+		return nil, importRejected, err
 	}
-	if len(books) > 0 {
-		slog.Error("This should absolutely not happen")
-		err = app.searchDB.AddBooks(books)
+
+	// books in the same batch are not in the index yet
+	if existing, ok := pending[book.Hash]; ok {
+		status, err := app.addOrQueueFormat(existing, book, cover, false)
 		if err != nil {
-			slog.Info("bulk insert into meili failed", "err", err)
+			app.moveBookToFailed(book.Path, failedStore, err, book)
+			return nil, importFailed, err
 		}
+		return nil, status, nil
 	}
 
-	slog.Info("Done with refresh")
+	reason, existingHash, err := app.findDuplicate(book)
+	if err != nil {
+		slog.Warn("unable to check for duplicates", "err", err, "file", book.Path)
+	}
+	if reason == duplicateHash {
+		existing, err := app.searchDB.GetBook(existingHash)
+		if err == nil {
+			// a format that can not be added is queued as a duplicate below
+			if status, err := app.addOrQueueFormat(existing, book, cover, true); err == nil {
+				return nil, status, nil
+			}
+		}
+	}
+	if reason != "" {
+		app.queueDuplicate(book, cover, reason, existingHash, "")
+		return nil, importDuplicate, nil
+	}
 
+	target := path.Join(app.bookDir, GetBookPath(book.Title, book.Author)+bookExt(book))
+	err = StoreBookFile(book, cover, target)
+	if errors.Is(err, ErrFileAlreadyExists) {
+		app.queueDuplicate(book, cover, duplicatePath, "", target)
+		return nil, importDuplicate, nil
+	}
+	if err != nil {
+		slog.Error("failed to store book", "err", err, "file", book.Path)
+		app.moveBookToFailed(book.Path, failedStore, err, book)
+		return nil, importFailed, err
+	}
+	return book, importIndexed, nil
 }
 
-func (app *booksingApp) moveBookToFailed(bookpath string) {
-	err := os.MkdirAll(app.cfg.FailDir, 0755)
-	if err != nil {
-		slog.Error("unable to create fail dir", "err", err)
-		return
+// addOrQueueFormat adds the file of book as a new format to existing, and stores existing in the index if
+// index is set. If existing already has that format the book is queued as a duplicate. It returns the
+// import status of the book, or an error when the book was not handled and is still at its path.
+func (app *booksingApp) addOrQueueFormat(existing, book *Book, cover []byte, index bool) (string, error) {
+	err := app.addFormat(existing, book, cover, false)
+	switch {
+	case errors.Is(err, errFormatExists):
+		app.queueDuplicate(book, cover, duplicateHash, existing.Hash, "")
+		return importDuplicate, nil
+	case errors.Is(err, ErrFileAlreadyExists):
+		app.queueDuplicate(book, cover, duplicatePath, existing.Hash, "")
+		return importDuplicate, nil
+	case err != nil:
+		slog.Error("unable to add format to book", "err", err, "file", book.Path, "hash", existing.Hash)
+		return "", err
+	}
+
+	slog.Info("added format to book", "hash", existing.Hash, "format", formatByName(book.Format).Name)
+	if index {
+		err = app.searchDB.AddBooks([]Book{*existing})
+		if err != nil {
+			slog.Error("unable to index new format", "err", err, "hash", existing.Hash)
+		}
+	}
+	return importIndexed, nil
+}
+
+var errFormatExists = errors.New("book already has a file in this format")
+
+// addFormat moves the primary file of book next to the files of existing and adds it to existing.Files.
+// With replace set an existing file in the same format is removed, otherwise errFormatExists is returned.
+// When a step fails the files are put back where they were.
+func (app *booksingApp) addFormat(existing, book *Book, cover []byte, replace bool) error {
+	format := formatByName(book.Format).Name
+	files := existing.files()
+	newFile, _ := book.file(format)
+	target := strings.TrimSuffix(existing.Path, filepath.Ext(existing.Path)) + fileExt(newFile)
+
+	old, replacing := existing.file(format)
+	if replacing && !replace {
+		return errFormatExists
 	}
-	globPath := strings.Replace(bookpath, ".epub", ".*", 1)
-	files, err := zglob.Glob(globPath)
+	if _, err := os.Stat(target); err == nil && (!replacing || target != old.Path) {
+		return fmt.Errorf("%w: %s", ErrFileAlreadyExists, target)
+	}
+
+	// the new file is staged next to the book first, the old file is only removed once that worked
+	staged := target
+	if replacing {
+		staged = target + ".new"
+	}
+	err := moveFile(book.Path, staged)
 	if err != nil {
-		return
+		return err
+	}
+	primary := false
+	if replacing {
+		trashed, err := app.trashOrRemove(old.Path)
+		if err == nil {
+			err = os.Rename(staged, target)
+			if err != nil && trashed != "" {
+				err = errors.Join(err, moveFile(trashed, old.Path))
+			}
+		}
+		if err != nil {
+			if err := moveFile(staged, book.Path); err != nil {
+				slog.Error("unable to move new format back", "err", err, "file", book.Path, "staged", staged)
+			}
+			return err
+		}
+		files = slices.DeleteFunc(slices.Clone(files), func(f BookFile) bool {
+			return f.Path == old.Path
+		})
+		// the replaced file was the primary file, so the new file takes its place
+		primary = old.Path == existing.Path
+	}
+	newFile.Path = target
+	existing.Files = append(files, newFile)
+
+	if primary {
+		existing.Path = target
+		existing.Size = newFile.Size
+		existing.Format = book.Format
+	}
+	if !existing.HasCover && len(cover) > 0 {
+		existing.CoverPath = coverPath(existing.Path)
+		err = os.WriteFile(existing.CoverPath, cover, 0644)
+		existing.HasCover = err == nil
+		if err != nil {
+			existing.CoverPath = ""
+		}
+	}
+	return nil
+}
+
+// allBooks pages through all books matching the filter, only use this when the searchDB can not answer the question itself
+func (app *booksingApp) allBooks(filter SearchFilter) ([]Book, error) {
+	var books []Book
+	var offset int64
+	for {
+		res, err := app.searchDB.GetBooks(SearchQuery{
+			Limit:  100,
+			Offset: offset,
+			Filter: filter,
+		})
+		if err != nil {
+			return nil, err
+		}
+		books = append(books, res.Items...)
+		offset += int64(len(res.Items))
+		if len(res.Items) == 0 || offset >= res.Total {
+			return books, nil
+		}
+	}
+}
+
+// moveBook moves all files and the cover of a book to the location that matches its current title and author
+func (app *booksingApp) moveBook(b *Book) error {
+	stem := path.Join(app.bookDir, GetBookPath(b.Title, b.Author))
+	if b.Variant != "" {
+		stem += "-" + b.Variant
+	}
+	newPath := stem + bookExt(b)
+	if newPath == path.Clean(b.Path) {
+		return nil
 	}
 
+	files := slices.Clone(b.files())
 	for _, f := range files {
-		filename := path.Base(f)
-		newBookPath := path.Join(app.cfg.FailDir, filename)
-		err = os.Rename(bookpath, newBookPath)
+		if _, err := os.Stat(stem + fileExt(f)); err == nil {
+			return ErrFileAlreadyExists
+		}
+	}
+	err := os.MkdirAll(filepath.Dir(newPath), 0755)
+	if err != nil {
+		return err
+	}
+	// files that were moved already are put back when a later file can not be moved
+	var moved [][2]string
+	for i, f := range files {
+		target := stem + fileExt(f)
+		err = moveFile(f.Path, target)
+		if err != nil {
+			for _, m := range slices.Backward(moved) {
+				if err := moveFile(m[1], m[0]); err != nil {
+					slog.Error("unable to move file back", "err", err, "file", m[0], "moved", m[1])
+				}
+			}
+			return err
+		}
+		moved = append(moved, [2]string{f.Path, target})
+		files[i].Path = target
+	}
+	if len(b.Files) > 0 {
+		b.Files = files
+	}
+	b.Path = newPath
+
+	if b.HasCover && b.CoverPath != "" {
+		newCoverPath := coverPath(newPath)
+		err = moveFile(b.CoverPath, newCoverPath)
 		if err != nil {
-			slog.Error("unable to move book to faildir", "err", err, "faildir", app.cfg.FailDir, "bookpath", bookpath)
+			slog.Warn("unable to move cover", "err", err, "cover", b.CoverPath)
+		} else {
+			b.CoverPath = newCoverPath
 		}
 	}
+	return nil
 }
@@ -0,0 +1,118 @@
+package cbz
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CBZ represents a comic book archive, metadata is read from ComicInfo.xml when present
+type CBZ struct {
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	Publisher   string    `json:"publisher"`
+	Language    string    `json:"language"`
+	Series      string    `json:"series"`
+	SeriesIndex float64   `json:"series_index"`
+	Description string    `json:"description"`
+	PublishDate time.Time `json:"publish_date"`
+}
+
+type comicInfo struct {
+	Title       string `xml:"Title"`
+	Series      string `xml:"Series"`
+	Number      string `xml:"Number"`
+	Writer      string `xml:"Writer"`
+	Publisher   string `xml:"Publisher"`
+	Summary     string `xml:"Summary"`
+	LanguageISO string `xml:"LanguageISO"`
+	Year        int    `xml:"Year"`
+	Month       int    `xml:"Month"`
+	Day         int    `xml:"Day"`
+}
+
+// ParseFile takes a filepath and returns a CBZ and the raw cover image if possible,
+// the cover is the first image in the archive
+func ParseFile(bookpath string) (bk *CBZ, cover []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bk = nil
+			err = fmt.Errorf("Unknown error parsing book. Skipping. Error: %s", r)
+		}
+	}()
+
+	zr, err := zip.OpenReader(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+
+	book := new(CBZ)
+	book.Title = strings.TrimSuffix(filepath.Base(bookpath), filepath.Ext(bookpath))
+
+	var images []*zip.File
+	for _, f := range zr.File {
+		if strings.EqualFold(path.Base(f.Name), "ComicInfo.xml") {
+			err = readComicInfo(f, book)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		switch strings.ToLower(path.Ext(f.Name)) {
+		case ".jpg", ".jpeg", ".png", ".gif":
+			images = append(images, f)
+		}
+	}
+
+	if len(images) > 0 {
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].Name < images[j].Name
+		})
+		rc, err := images[0].Open()
+		if err == nil {
+			cover, _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	}
+
+	return book, cover, nil
+}
+
+func readComicInfo(f *zip.File, book *CBZ) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var info comicInfo
+	err = xml.NewDecoder(rc).Decode(&info)
+	if err != nil {
+		return fmt.Errorf("unable to parse ComicInfo.xml: %w", err)
+	}
+
+	if info.Title != "" {
+		book.Title = info.Title
+	} else if info.Series != "" {
+		book.Title = strings.TrimSpace(info.Series + " " + info.Number)
+	}
+	book.Author = info.Writer
+	book.Publisher = info.Publisher
+	book.Language = info.LanguageISO
+	book.Description = info.Summary
+	book.Series = info.Series
+	book.SeriesIndex, _ = strconv.ParseFloat(info.Number, 64)
+	if info.Year > 0 {
+		month, day := max(info.Month, 1), max(info.Day, 1)
+		book.PublishDate = time.Date(info.Year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const comicInfoXML = `<?xml version="1.0"?>
+<ComicInfo>
+  <Series>Watchmen</Series>
+  <Number>1.5</Number>
+  <Writer>Alan Moore</Writer>
+  <Publisher>DC Comics</Publisher>
+  <Summary>Who watches the watchmen?</Summary>
+  <LanguageISO>en</LanguageISO>
+  <Year>1986</Year>
+  <Month>9</Month>
+</ComicInfo>`
+
+// buildCBZ writes the given files to a zip in order
+func buildCBZ(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseFile(t *testing.T) {
+	for name, tc := range map[string]struct {
+		content []byte
+		want    CBZ
+		cover   string
+	}{
+		"comic info": {
+			buildCBZ(t, "002.jpg", "page two", "001.jpg", "page one", "ComicInfo.xml", comicInfoXML),
+			CBZ{
+				Title:       "Watchmen 1.5",
+				Author:      "Alan Moore",
+				Publisher:   "DC Comics",
+				Language:    "en",
+				Series:      "Watchmen",
+				SeriesIndex: 1.5,
+				Description: "Who watches the watchmen?",
+				PublishDate: time.Date(1986, 9, 1, 0, 0, 0, 0, time.UTC),
+			},
+			"page one",
+		},
+		"nested comic info": {
+			buildCBZ(t, "watchmen/ComicInfo.xml", `<ComicInfo><Title>Chapter I</Title><Series>Watchmen</Series></ComicInfo>`, "watchmen/a.png", "png"),
+			CBZ{Title: "Chapter I", Series: "Watchmen"},
+			"png",
+		},
+		"no metadata": {
+			buildCBZ(t, "notes.txt", "hello"),
+			CBZ{Title: "comic"},
+			"",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			book, cover, err := ParseFile(writeFile(t, "comic.cbz", tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *book != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, *book)
+			}
+			if string(cover) != tc.cover {
+				t.Errorf("expected cover %q, got %q", tc.cover, cover)
+			}
+		})
+	}
+}
+
+func TestParseFileInvalid(t *testing.T) {
+	data := buildCBZ(t, "001.jpg", "page one", "ComicInfo.xml", comicInfoXML)
+	for name, content := range map[string][]byte{
+		"empty":              {},
+		"not a zip":          []byte("%PDF-1.4"),
+		"truncated archive":  data[:len(data)-10],
+		"invalid comic info": buildCBZ(t, "ComicInfo.xml", "<ComicInfo><Title>"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if book, _, err := ParseFile(writeFile(t, "comic.cbz", content)); err == nil {
+				t.Errorf("expected an error, got %+v", book)
+			}
+		})
+	}
+}
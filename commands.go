@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// runCommand runs a single maintenance command instead of starting the server
+func (app *booksingApp) runCommand(cmd string, args []string) error {
+	switch cmd {
+	case "delete":
+		if len(args) == 0 {
+			return errors.New("usage: booksing delete <hash>...")
+		}
+		var errs []error
+		for _, hash := range args {
+			err := app.deleteBook(hash, cliUser())
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", hash, err))
+				continue
+			}
+			fmt.Println("deleted", hash)
+		}
+		return errors.Join(errs...)
+
+	case "fsck":
+		fl := flag.NewFlagSet("fsck", flag.ContinueOnError)
+		repair := fl.String("repair", "", "comma separated categories to repair: "+strings.Join(fsckCategories, ", ")+" or all")
+		err := fl.Parse(args)
+		if err != nil {
+			return err
+		}
+		var categories []string
+		if *repair != "" {
+			categories = strings.Split(*repair, ",")
+		}
+		return app.runFsck(categories)
+
+	case "rebuild":
+		return app.runRebuild()
+
+	case "useradd", "passwd":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: booksing %s <name>, the password is read from stdin", cmd)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if cmd == "useradd" {
+			err = app.addUser(args[0], password)
+		} else {
+			err = app.setPassword(args[0], password)
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("audit: password set", "user", cliUser(), "name", args[0])
+		return nil
+
+	case "userdel":
+		if len(args) != 1 {
+			return errors.New("usage: booksing userdel <name>")
+		}
+		err := app.deleteUser(args[0])
+		if err != nil {
+			return err
+		}
+		slog.Info("audit: user deleted", "user", cliUser(), "name", args[0])
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// readPassword reads a single line from stdin, so it can be piped in by scripts
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("unable to read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// cliUser is used as the user for audit logs of commands
+func cliUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return "cli"
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("cli:%s@%s", u.Username, host)
+}
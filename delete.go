@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// deleteBookAPI removes a book from the index and from disk
+func (app *booksingApp) deleteBookAPI(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	if hash == "" {
+		renderError(w, "MISSING_HASH", http.StatusBadRequest)
+		return
+	}
+
+	// a rebuild running meanwhile would overwrite the change
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	err := app.deleteBook(hash, getUserFromRequest(r))
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to delete book", "err", err, "hash", hash)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteBook removes every file, the cover and the index entry of a book. If a trash dir is configured
+// the files are moved there instead of being removed. The index entry goes last, so a failure leaves
+// the book in the index and the delete can be retried.
+func (app *booksingApp) deleteBook(hash, user string) error {
+	book, err := app.searchDB.GetBook(hash)
+	if err != nil {
+		return err
+	}
+
+	var toRemove []string
+	for _, f := range book.files() {
+		toRemove = append(toRemove, f.Path)
+	}
+	toRemove = append(toRemove, book.CoverPath)
+
+	// trashed files are put back when a later step fails
+	var trashed [][2]string
+	restore := func() {
+		for _, m := range slices.Backward(trashed) {
+			if err := moveFile(m[1], m[0]); err != nil {
+				slog.Error("unable to restore trashed file", "err", err, "file", m[0], "trash", m[1])
+			}
+		}
+	}
+	for _, f := range toRemove {
+		if f == "" {
+			continue
+		}
+		target, err := app.trashOrRemove(f)
+		if err != nil {
+			restore()
+			return fmt.Errorf("unable to remove %s: %w", f, err)
+		}
+		if target != "" {
+			trashed = append(trashed, [2]string{f, target})
+		}
+	}
+
+	err = app.searchDB.DeleteBook(hash)
+	if err != nil {
+		restore()
+		return err
+	}
+	app.removeKepub(hash)
+
+	slog.Info("audit: book deleted", "user", user, "hash", hash, "title", book.Title,
+		"author", book.Author, "path", book.Path, "trashdir", app.cfg.TrashDir)
+
+	return nil
+}
+
+func (app *booksingApp) removeBookFile(f string) error {
+	_, err := app.trashOrRemove(f)
+	return err
+}
+
+// trashOrRemove moves f to the trash dir or removes it when no trash dir is configured,
+// the returned path is the location in the trash
+func (app *booksingApp) trashOrRemove(f string) (string, error) {
+	if app.cfg.TrashDir == "" {
+		err := os.Remove(f)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if _, err := os.Stat(f); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	target := app.trashPath(f)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = moveFile(f, target)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// trashPath keeps the path relative to the bookdir, so books with the same file name by different authors
+// do not overwrite each other. A number is added when the file was trashed before.
+func (app *booksingApp) trashPath(f string) string {
+	rel, err := filepath.Rel(app.bookDir, f)
+	if err != nil || !filepath.IsLocal(rel) {
+		rel = filepath.Base(f)
+	}
+	target := filepath.Join(app.cfg.TrashDir, rel)
+	ext := filepath.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); err != nil {
+			return target
+		}
+		target = fmt.Sprintf("%s.%d%s", stem, i, ext)
+	}
+}
+
+// moveFile renames src to dst and falls back to copying when they are on different filesystems,
+// which is common for a trash dir on another volume
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	err = errors.Join(err, out.Close())
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const downloadsBucket = "downloads"
+
+// maxDownloadsPage is the largest limit of a page of the download history
+const maxDownloadsPage = 500
+
+// downloadEvent is a book leaving booksing, title and author are kept so the history survives deleted books
+type downloadEvent struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Hash   string    `json:"hash"`
+	Title  string    `json:"title"`
+	Author string    `json:"author"`
+	Action string    `json:"action"`
+	Format string    `json:"format"`
+	// Client is the user agent, or the kobo device that synced the book
+	Client string `json:"client,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+type bookStat struct {
+	Hash      string `json:"hash"`
+	Title     string `json:"title"`
+	Author    string `json:"author"`
+	Downloads int    `json:"downloads"`
+}
+
+type downloadStats struct {
+	Since   *time.Time     `json:"since,omitempty"`
+	Total   int            `json:"total"`
+	Users   int            `json:"users"`
+	Formats map[string]int `json:"formats"`
+	PerDay  map[string]int `json:"perDay"`
+	Top     []bookStat     `json:"top"`
+}
+
+// trackDownload stores the download and fires the webhook
+func (app *booksingApp) trackDownload(d webHookData, book *Book, client string) {
+	now := time.Now().In(app.timezone)
+	ev := downloadEvent{
+		Time:   now,
+		User:   d.User,
+		Hash:   d.Hash,
+		Title:  book.Title,
+		Author: book.Author,
+		Action: d.Action,
+		Format: d.Format,
+		Client: client,
+		To:     d.To,
+	}
+	// keys sort in the order the downloads happened
+	key := fmt.Sprintf("%020d-%s", now.UnixNano(), randToken(2))
+	err := app.store.put(downloadsBucket, key, ev)
+	if err != nil {
+		slog.Warn("unable to store download", "err", err, "hash", d.Hash)
+	}
+	if app.cfg.DownloadRetention > 0 {
+		err = app.store.deleteBefore(downloadsBucket, fmt.Sprintf("%020d", now.Add(-app.cfg.DownloadRetention).UnixNano()))
+		if err != nil {
+			slog.Warn("unable to remove old downloads", "err", err)
+		}
+	}
+
+	if app.webHookEnabled {
+		//do this async so the user does not have to wait for the webhook to finish
+		go app.fireWebHook(d)
+	}
+}
+
+// eachDownload calls fn for every download, oldest first
+func (app *booksingApp) eachDownload(fn func(ev downloadEvent)) error {
+	return app.store.each(downloadsBucket, func(_ string, val []byte) error {
+		var ev downloadEvent
+		err := json.Unmarshal(val, &ev)
+		if err != nil {
+			return err
+		}
+		fn(ev)
+		return nil
+	})
+}
+
+// queryInt returns the integer query parameter name, or def if it is missing or invalid
+func queryInt(r *http.Request, name string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// queryPage returns the limit and offset of a page, the limit is capped at maxDownloadsPage. It is false when one
+// of them is not a number or negative.
+func queryPage(r *http.Request, def int) (int, int, bool) {
+	limit, offset := def, 0
+	var err error
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, false
+		}
+	}
+	return min(limit, maxDownloadsPage), offset, true
+}
+
+// myDownloads returns the downloads of the current user, newest first. Without authentication everyone
+// is the anonymous user, so there is no history to show.
+func (app *booksingApp) myDownloads(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	limit, offset, ok := queryPage(r, 50)
+	if !ok {
+		renderError(w, "INVALID_PARAMETER", http.StatusBadRequest)
+		return
+	}
+
+	events := []downloadEvent{}
+	err := app.eachDownload(func(ev downloadEvent) {
+		if ev.User == user && user != anonymousUser {
+			events = append(events, ev)
+		}
+	})
+	if err != nil {
+		slog.Error("failed to list downloads", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	slices.Reverse(events)
+	total := len(events)
+	start := min(offset, total)
+	events = events[start : start+min(limit, total-start)]
+	writeJSON(w, map[string]interface{}{
+		"total": total,
+		"items": events,
+	})
+}
+
+// downloadStatsAPI summarizes the downloads of the last days, days=0 covers everything
+func (app *booksingApp) downloadStatsAPI(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.downloadStats(queryInt(r, "days", 30), queryInt(r, "limit", 20))
+	if err != nil {
+		slog.Error("failed to summarize downloads", "err", err)
+		renderError(w, "STATS_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+func (app *booksingApp) downloadStats(days, limit int) (*downloadStats, error) {
+	stats := &downloadStats{
+		Formats: map[string]int{},
+		PerDay:  map[string]int{},
+		Top:     []bookStat{},
+	}
+	var since time.Time
+	if days > 0 {
+		since = time.Now().In(app.timezone).AddDate(0, 0, -days)
+		stats.Since = &since
+	}
+
+	users := map[string]bool{}
+	books := map[string]*bookStat{}
+	err := app.eachDownload(func(ev downloadEvent) {
+		if ev.Time.Before(since) {
+			return
+		}
+		stats.Total++
+		users[ev.User] = true
+		stats.Formats[ev.Format]++
+		stats.PerDay[ev.Time.In(app.timezone).Format("2006-01-02")]++
+		b, ok := books[ev.Hash]
+		if !ok {
+			b = &bookStat{Hash: ev.Hash}
+			books[ev.Hash] = b
+		}
+		// the latest title wins, metadata can be edited
+		b.Title = ev.Title
+		b.Author = ev.Author
+		b.Downloads++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Users = len(users)
+	for _, b := range books {
+		stats.Top = append(stats.Top, *b)
+	}
+	slices.SortFunc(stats.Top, func(a, b bookStat) int {
+		return cmp.Or(cmp.Compare(b.Downloads, a.Downloads), cmp.Compare(a.Title, b.Title))
+	})
+	if limit > 0 && len(stats.Top) > limit {
+		stats.Top = stats.Top[:limit]
+	}
+	return stats, nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const duplicatesBucket = "duplicates"
+
+const (
+	duplicateHash = "hash"
+	duplicateISBN = "isbn"
+	duplicatePath = "path"
+)
+
+const (
+	resolveKeepExisting = "keep-existing"
+	resolveReplace      = "replace"
+	resolveKeepBoth     = "keep-both"
+)
+
+// duplicate is an imported book that collides with a book that is already in the library,
+// it is kept in the duplicate dir until an admin decides what to do with it
+type duplicate struct {
+	ID        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	Found     time.Time `json:"found"`
+	Candidate Book      `json:"candidate"`
+	// ExistingHash is the book the candidate collides with, empty if only the target file exists
+	ExistingHash string `json:"existingHash"`
+	ExistingPath string `json:"existingPath"`
+}
+
+type duplicateComparison struct {
+	SizeDifference    int64 `json:"sizeDifference"`
+	CandidateNewer    bool  `json:"candidateNewer"`
+	CandidateHasCover bool  `json:"candidateHasCover"`
+	ExistingHasCover  bool  `json:"existingHasCover"`
+}
+
+type duplicateReview struct {
+	duplicate
+	Existing       *Book               `json:"existing"`
+	CandidateCover string              `json:"candidateCover,omitempty"`
+	ExistingCover  string              `json:"existingCover,omitempty"`
+	Comparison     duplicateComparison `json:"comparison"`
+}
+
+type resolveRequest struct {
+	Action string `json:"action"`
+}
+
+// findDuplicate checks whether the book is already in the index, by hash or by ISBN
+func (app *booksingApp) findDuplicate(b *Book) (string, string, error) {
+	exists, err := app.searchDB.HasHash(b.Hash)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		return duplicateHash, b.Hash, nil
+	}
+
+	if b.ISBN == "" {
+		return "", "", nil
+	}
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Limit:  1,
+		Filter: SearchFilter{ISBN: b.ISBN},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if len(res.Items) > 0 {
+		return duplicateISBN, res.Items[0].Hash, nil
+	}
+	return "", "", nil
+}
+
+// queueDuplicate moves the book into the duplicate dir and stores it for review
+func (app *booksingApp) queueDuplicate(b *Book, cover []byte, reason, existingHash, existingPath string) {
+	dup := duplicate{
+		ID:           randToken(8),
+		Reason:       reason,
+		Found:        time.Now().In(app.timezone),
+		ExistingHash: existingHash,
+		ExistingPath: existingPath,
+	}
+
+	err := os.MkdirAll(app.cfg.DuplicateDir, 0755)
+	if err != nil {
+		slog.Error("unable to create duplicate dir", "err", err)
+		app.moveBookToFailed(b.Path, failedDuplicate, err, b)
+		return
+	}
+
+	oldPath := b.Path
+	newPath := filepath.Join(app.cfg.DuplicateDir, dup.ID+bookExt(b))
+	err = moveFile(b.Path, newPath)
+	if err != nil {
+		slog.Error("unable to move duplicate", "err", err, "file", b.Path)
+		app.moveBookToFailed(b.Path, failedDuplicate, err, b)
+		return
+	}
+	b.setPath(newPath)
+	if b.HasCover {
+		b.CoverPath = filepath.Join(app.cfg.DuplicateDir, dup.ID+".jpg")
+		err = os.WriteFile(b.CoverPath, cover, 0644)
+		if err != nil {
+			slog.Warn("unable to write duplicate cover", "err", err)
+			b.HasCover = false
+			b.CoverPath = ""
+		}
+	}
+	dup.Candidate = *b
+
+	err = app.store.put(duplicatesBucket, dup.ID, dup)
+	if err != nil {
+		// a file in the duplicate dir that is not queued would never be reviewed, back in the import dir it is
+		// found by the next scan
+		slog.Error("unable to store duplicate", "err", err, "file", b.Path)
+		if err := moveFile(newPath, oldPath); err != nil {
+			slog.Error("unable to move duplicate back", "err", err, "file", newPath)
+		}
+		b.setPath(oldPath)
+		if b.HasCover {
+			_ = os.Remove(b.CoverPath)
+		}
+		return
+	}
+	slog.Warn("duplicate book queued for review", "id", dup.ID, "reason", reason,
+		"title", b.Title, "author", b.Author, "existing", existingHash)
+}
+
+// listDuplicates returns all duplicates that are waiting for review
+func (app *booksingApp) listDuplicates(w http.ResponseWriter, r *http.Request) {
+	dups, err := listAll[duplicate](app.store, duplicatesBucket)
+	if err != nil {
+		slog.Error("failed to list duplicates", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	reviews := []duplicateReview{}
+	for _, d := range dups {
+		reviews = append(reviews, app.reviewDuplicate(d))
+	}
+	writeJSON(w, reviews)
+}
+
+func (app *booksingApp) reviewDuplicate(d duplicate) duplicateReview {
+	review := duplicateReview{
+		duplicate: d,
+	}
+	review.Comparison.CandidateHasCover = d.Candidate.HasCover
+	if d.Candidate.HasCover {
+		review.CandidateCover = fmt.Sprintf("/api/duplicates/%s/cover", d.ID)
+	}
+	review.Candidate.CoverPath = ""
+
+	if d.ExistingHash == "" {
+		return review
+	}
+	existing, err := app.searchDB.GetBook(d.ExistingHash)
+	if err != nil {
+		return review
+	}
+	existing.CoverPath = strings.TrimPrefix(existing.CoverPath, app.bookDir)
+	review.Existing = existing
+	if existing.HasCover {
+		review.ExistingCover = "/api/cover?file=" + existing.CoverPath
+	}
+	review.Comparison.SizeDifference = d.Candidate.Size - existing.Size
+	review.Comparison.CandidateNewer = d.Candidate.Added.After(existing.Added)
+	review.Comparison.ExistingHasCover = existing.HasCover
+	return review
+}
+
+// getDuplicateCover serves the cover of a duplicate, those are not in the bookdir so getCover can not be used
+func (app *booksingApp) getDuplicateCover(w http.ResponseWriter, r *http.Request) {
+	var d duplicate
+	err := app.store.get(duplicatesBucket, r.PathValue("id"), &d)
+	if err != nil || !d.Candidate.HasCover {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, d.Candidate.CoverPath)
+}
+
+// resolveDuplicateAPI applies the choice of an admin to a duplicate
+func (app *booksingApp) resolveDuplicateAPI(w http.ResponseWriter, r *http.Request) {
+	var req resolveRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	// a rebuild running meanwhile would overwrite the change
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	book, err := app.resolveDuplicate(r.PathValue("id"), req.Action, getUserFromRequest(r))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	case errors.Is(err, errUnknownAction):
+		renderError(w, "INVALID_ACTION", http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("failed to resolve duplicate", "err", err)
+		renderError(w, "RESOLVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	if book == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	book.CoverPath = strings.TrimPrefix(book.CoverPath, app.bookDir)
+	writeJSON(w, book)
+}
+
+var errUnknownAction = errors.New("unknown action")
+
+// resolveDuplicate keeps the existing book, replaces it with the candidate or keeps both.
+// It returns the candidate if it was added to the library.
+func (app *booksingApp) resolveDuplicate(id, action, user string) (*Book, error) {
+	var d duplicate
+	err := app.store.get(duplicatesBucket, id, &d)
+	if err != nil {
+		return nil, err
+	}
+	candidate := d.Candidate
+	ext := bookExt(&candidate)
+	target := path.Join(app.bookDir, GetBookPath(candidate.Title, candidate.Author)+ext)
+	// a replaced book is only removed after the candidate is stored, until then the candidate is kept next to it
+	replaced := ""
+
+	switch action {
+	case resolveKeepExisting:
+		for _, f := range []string{candidate.Path, candidate.CoverPath} {
+			if f == "" {
+				continue
+			}
+			err = app.removeBookFile(f)
+			if err != nil {
+				return nil, err
+			}
+		}
+		slog.Info("audit: duplicate discarded", "user", user, "id", id, "title", candidate.Title)
+		return nil, app.store.delete(duplicatesBucket, id)
+
+	case resolveReplace:
+		// a book with the same hash only gets the file of the candidate, its other formats are kept
+		if d.Reason == duplicateHash && d.ExistingHash != "" {
+			existing, err := app.searchDB.GetBook(d.ExistingHash)
+			if err == nil {
+				return app.replaceFormat(d, existing, user)
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return nil, err
+			}
+		}
+		replaced = target
+		target = strings.TrimSuffix(target, ext) + "-" + d.ID + ext
+
+	case resolveKeepBoth:
+		target = strings.TrimSuffix(target, ext) + "-" + d.ID + ext
+		// the variant keeps the hash apart from the existing book, also when the existing book is only added
+		// later or the book is edited
+		candidate.Variant = d.ID
+		candidate.updateHash()
+
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownAction, action)
+	}
+
+	var cover []byte
+	if candidate.HasCover {
+		cover, err = os.ReadFile(candidate.CoverPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dupCover := candidate.CoverPath
+	err = StoreBookFile(&candidate, cover, target)
+	if err != nil {
+		return nil, err
+	}
+	if replaced != "" {
+		err = app.removeReplaced(d, user)
+		if err != nil {
+			// the candidate goes back to the duplicate dir so it can be resolved again
+			if rerr := moveFile(candidate.Path, d.Candidate.Path); rerr != nil {
+				slog.Error("unable to move duplicate back", "err", rerr, "file", candidate.Path, "id", id)
+			}
+			if candidate.HasCover {
+				_ = os.Remove(candidate.CoverPath)
+			}
+			return nil, err
+		}
+		moveStoredBook(&candidate, replaced)
+	}
+	if dupCover != "" {
+		_ = os.Remove(dupCover)
+	}
+
+	err = app.searchDB.AddBooks([]Book{candidate})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("audit: duplicate added", "user", user, "id", id, "action", action,
+		"hash", candidate.Hash, "title", candidate.Title)
+
+	return &candidate, app.store.delete(duplicatesBucket, id)
+}
+
+// removeReplaced removes the book or file that the candidate of d replaces
+func (app *booksingApp) removeReplaced(d duplicate, user string) error {
+	if d.ExistingHash != "" {
+		err := app.deleteBook(d.ExistingHash, user)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	if d.ExistingPath != "" {
+		err := app.removeBookFile(d.ExistingPath)
+		if err != nil {
+			return err
+		}
+		_ = app.removeBookFile(coverPath(d.ExistingPath))
+	}
+	return nil
+}
+
+// moveStoredBook moves a stored book and its cover to p, the book keeps its current path when that fails
+func moveStoredBook(b *Book, p string) {
+	if _, err := os.Stat(p); err == nil {
+		slog.Warn("unable to move book, the target exists", "file", b.Path, "target", p)
+		return
+	}
+	err := moveFile(b.Path, p)
+	if err != nil {
+		slog.Warn("unable to move book", "err", err, "file", b.Path, "target", p)
+		return
+	}
+	b.setPath(p)
+	if b.HasCover {
+		err = moveFile(b.CoverPath, coverPath(p))
+		if err != nil {
+			slog.Warn("unable to move cover", "err", err, "file", b.CoverPath)
+			return
+		}
+		b.CoverPath = coverPath(p)
+	}
+}
+
+// replaceFormat swaps the file in the format of the candidate of d into existing
+func (app *booksingApp) replaceFormat(d duplicate, existing *Book, user string) (*Book, error) {
+	candidate := d.Candidate
+	var cover []byte
+	if candidate.HasCover && !existing.HasCover {
+		var err error
+		cover, err = os.ReadFile(candidate.CoverPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := app.addFormat(existing, &candidate, cover, true)
+	if err != nil {
+		return nil, err
+	}
+	// the new file can be older than the cached conversion of the file it replaced
+	app.removeKepub(existing.Hash)
+	if candidate.CoverPath != "" {
+		_ = os.Remove(candidate.CoverPath)
+	}
+
+	err = app.searchDB.AddBooks([]Book{*existing})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("audit: duplicate replaced format", "user", user, "id", d.ID, "hash", existing.Hash,
+		"format", formatByName(candidate.Format).Name, "title", existing.Title)
+
+	return existing, app.store.delete(duplicatesBucket, d.ID)
+}
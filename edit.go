@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gnur/booksing/epub"
+	"github.com/kennygrant/sanitize"
+)
+
+// bookUpdate holds the fields that can be edited, fields that are not set are left untouched
+type bookUpdate struct {
+	Title       *string  `json:"title"`
+	Author      *string  `json:"author"`
+	Series      *string  `json:"series"`
+	SeriesIndex *float64 `json:"seriesIndex"`
+	Language    *string  `json:"language"`
+	Description *string  `json:"description"`
+	ISBN        *string  `json:"isbn"`
+	Publisher   *string  `json:"publisher"`
+	// WriteBack also stores the metadata in the epub file of the book, it fails for books without one
+	WriteBack bool `json:"writeBack"`
+}
+
+// updateBookAPI edits the metadata of a book
+func (app *booksingApp) updateBookAPI(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	if hash == "" {
+		renderError(w, "MISSING_HASH", http.StatusBadRequest)
+		return
+	}
+
+	var upd bookUpdate
+	err := json.NewDecoder(r.Body).Decode(&upd)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	// a rebuild running meanwhile would overwrite the change
+	libraryLock.RLock()
+	defer libraryLock.RUnlock()
+	book, err := app.updateBook(hash, upd, getUserFromRequest(r))
+	switch {
+	case errors.Is(err, ErrNotFound):
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrDuplicate), errors.Is(err, ErrFileAlreadyExists):
+		renderError(w, "DUPLICATE", http.StatusConflict)
+		return
+	case errors.Is(err, errWriteBackUnsupported):
+		renderError(w, "WRITEBACK_UNSUPPORTED", http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("failed to update book", "err", err, "hash", hash)
+		renderError(w, "UPDATE_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	book.CoverPath = strings.TrimPrefix(book.CoverPath, app.bookDir)
+	writeJSON(w, book)
+}
+
+// apply sets the fields of the update on b and updates the hash to match
+func (upd bookUpdate) apply(b *Book) {
+	if upd.Title != nil {
+		b.Title = Fix(*upd.Title, true, false)
+	}
+	if upd.Author != nil {
+		b.Author = Fix(*upd.Author, true, true)
+	}
+	if upd.Series != nil {
+		b.Series = strings.TrimSpace(*upd.Series)
+	}
+	if upd.SeriesIndex != nil {
+		b.SeriesIndex = *upd.SeriesIndex
+	}
+	if upd.Language != nil {
+		b.Language = FixLang(*upd.Language)
+	}
+	if upd.Description != nil {
+		b.Description = sanitize.HTML(*upd.Description)
+	}
+	if upd.ISBN != nil {
+		b.ISBN = strings.TrimSpace(*upd.ISBN)
+	}
+	if upd.Publisher != nil {
+		b.Publisher = strings.TrimSpace(*upd.Publisher)
+	}
+	b.updateHash()
+}
+
+var errWriteBackUnsupported = errors.New("metadata can only be written back to books with an epub file")
+
+// updateBook applies the update to the book, which can change its hash and location on disk
+func (app *booksingApp) updateBook(hash string, upd bookUpdate, user string) (*Book, error) {
+	old, err := app.searchDB.GetBook(hash)
+	if err != nil {
+		return nil, err
+	}
+	b := *old
+	b.Files = slices.Clone(old.Files)
+	if _, hasEPUB := b.file(formatEPUB); upd.WriteBack && !hasEPUB {
+		return nil, errWriteBackUnsupported
+	}
+
+	upd.apply(&b)
+
+	if b.Hash != hash {
+		exists, err := app.searchDB.HasHash(b.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicate, b.Hash)
+		}
+	}
+
+	// the files are moved first, a move can fail because the new location is taken and then
+	// the epub should still match the index
+	err = app.moveBook(&b)
+	if err != nil {
+		return nil, err
+	}
+	// moveBack puts the files where the index still expects them when a later step fails
+	moveBack := func(step string) {
+		back := b
+		back.Title, back.Author = old.Title, old.Author
+		if err := app.moveBook(&back); err != nil {
+			slog.Error("unable to move book back after failed "+step, "err", err, "hash", hash, "path", b.Path)
+		}
+	}
+	if upd.WriteBack {
+		err = writeBack(&b)
+		if err != nil {
+			moveBack("write back")
+			return nil, fmt.Errorf("unable to write metadata to epub: %w", err)
+		}
+	}
+
+	err = app.searchDB.AddBooks([]Book{b})
+	if err != nil {
+		moveBack("index update")
+		return nil, err
+	}
+	if b.Hash != hash {
+		err = app.searchDB.DeleteBook(hash)
+		if err != nil {
+			if err := app.searchDB.DeleteBook(b.Hash); err != nil {
+				slog.Error("unable to remove updated book after failed delete", "err", err, "hash", b.Hash)
+			}
+			moveBack("delete")
+			return nil, err
+		}
+		app.removeKepub(hash)
+		err = app.rehashShelves(hash, b.Hash)
+		if err != nil {
+			slog.Warn("unable to update shelves", "err", err, "hash", hash, "newhash", b.Hash)
+		}
+	}
+
+	slog.Info("audit: book updated", "user", user, "hash", hash, "newhash", b.Hash,
+		"title", b.Title, "author", b.Author, "writeback", upd.WriteBack)
+
+	return &b, nil
+}
+
+// writeBack stores the metadata of the book in its epub file and updates the size and checksum of the file
+func writeBack(b *Book) error {
+	epubFile, _ := b.file(formatEPUB)
+	err := epub.WriteMetadata(epubFile.Path, &epub.Epub{
+		Title:       b.Title,
+		Author:      b.Author,
+		Publisher:   b.Publisher,
+		Language:    b.Language,
+		ISBN:        b.ISBN,
+		Series:      b.Series,
+		SeriesIndex: b.SeriesIndex,
+		Description: b.Description,
+	})
+	if err != nil {
+		return err
+	}
+	for i, f := range b.Files {
+		if f.Path != epubFile.Path {
+			continue
+		}
+		if fi, err := os.Stat(f.Path); err == nil {
+			b.Files[i].Size = fi.Size()
+		}
+		b.Files[i].Checksum, _ = fileChecksum(f.Path)
+	}
+	if epubFile.Path == b.Path {
+		if fi, err := os.Stat(b.Path); err == nil {
+			b.Size = fi.Size()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package epub
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// WriteMetadata rewrites the OPF inside the epub at bookpath with the metadata of book.
+// Empty fields are left untouched, the file is replaced atomically.
+func WriteMetadata(bookpath string, book *Epub) error {
+	zr, err := zip.OpenReader(bookpath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	rootfile, err := findRootfile(&zr.Reader)
+	if err != nil {
+		return err
+	}
+
+	var opfFile *zip.File
+	for _, f := range zr.File {
+		if f.Name == rootfile {
+			opfFile = f
+			break
+		}
+	}
+	if opfFile == nil {
+		return fmt.Errorf("rootfile %s not found", rootfile)
+	}
+
+	opf, err := readXML(opfFile)
+	if err != nil {
+		return err
+	}
+	err = updateOPF(opf, book)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(bookpath)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(bookpath), ".booksing-*.epub")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(fi.Mode())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	zw := zip.NewWriter(tmp)
+	for _, f := range zr.File {
+		if f != opfFile {
+			// copy everything else as is, this keeps the uncompressed mimetype as first entry
+			err = zw.Copy(f)
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			continue
+		}
+		header := f.FileHeader
+		w, err := zw.CreateHeader(&header)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		_, err = opf.WriteTo(w)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = zw.Close()
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), bookpath)
+}
+
+func findRootfile(zr *zip.Reader) (string, error) {
+	for _, f := range zr.File {
+		if f.Name != "META-INF/container.xml" {
+			continue
+		}
+		container, err := readXML(f)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range container.FindElements("//rootfiles/rootfile[@full-path]") {
+			return e.SelectAttrValue("full-path", ""), nil
+		}
+	}
+	return "", errors.New("Cannot parse container")
+}
+
+func readXML(f *zip.File) (*etree.Document, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	doc := etree.NewDocument()
+	_, err = doc.ReadFrom(rc)
+	return doc, err
+}
+
+func updateOPF(opf *etree.Document, book *Epub) error {
+	metadata := opf.FindElement("//metadata")
+	if metadata == nil {
+		return errors.New("OPF has no metadata")
+	}
+
+	setDC := func(tag, val string) {
+		if val == "" {
+			return
+		}
+		el := metadata.FindElement("//" + tag)
+		if el == nil {
+			el = metadata.CreateElement("dc:" + tag)
+		}
+		el.SetText(val)
+	}
+
+	setDC("title", book.Title)
+	setDC("creator", book.Author)
+	setDC("language", book.Language)
+	setDC("description", book.Description)
+	setDC("publisher", book.Publisher)
+
+	if book.ISBN != "" {
+		setISBN(metadata, book.ISBN)
+	}
+
+	if book.Series != "" {
+		setSeries(metadata, book.Series, book.SeriesIndex)
+	}
+	return nil
+}
+
+func setISBN(metadata *etree.Element, isbn string) {
+	for _, el := range metadata.FindElements("//identifier") {
+		scheme := strings.ToLower(el.SelectAttrValue("opf:scheme", el.SelectAttrValue("scheme", "")))
+		if scheme == "isbn" {
+			el.SetText(isbn)
+			return
+		}
+		if strings.HasPrefix(el.Text(), "urn:isbn:") {
+			el.SetText("urn:isbn:" + isbn)
+			return
+		}
+	}
+	el := metadata.CreateElement("dc:identifier")
+	el.CreateAttr("opf:scheme", "ISBN")
+	el.SetText(isbn)
+}
+
+func setSeries(metadata *etree.Element, series string, index float64) {
+	idx := strconv.FormatFloat(index, 'f', -1, 64)
+
+	// EPUB3 collections are updated in place when present
+	if el := metadata.FindElement("//meta[@property='belongs-to-collection']"); el != nil {
+		el.SetText(series)
+		if id := el.SelectAttrValue("id", ""); id != "" {
+			for _, ref := range metadata.FindElements("//meta[@refines='#" + id + "']") {
+				if ref.SelectAttrValue("property", "") == "group-position" {
+					ref.SetText(idx)
+				}
+			}
+		}
+	}
+
+	setMeta := func(name, content string) {
+		el := metadata.FindElement("//meta[@name='" + name + "']")
+		if el == nil {
+			el = metadata.CreateElement("meta")
+			el.CreateAttr("name", name)
+		}
+		el.CreateAttr("content", content)
+	}
+	setMeta("calibre:series", series)
+	setMeta("calibre:series_index", idx)
+}
@@ -0,0 +1,164 @@
+package epub
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const containerXML = `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`
+
+const contentOPF = `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:opf="http://www.idpf.org/2007/opf">
+    <dc:title>Frankenstein</dc:title>
+    <dc:creator>Mary Shelley</dc:creator>
+    <dc:language>en</dc:language>
+    <dc:date opf:event="publication">1818-01-01</dc:date>
+    <dc:identifier opf:scheme="URI">http://www.gutenberg.org/84</dc:identifier>
+  </metadata>
+  <manifest><item id="text" href="text.html" media-type="application/xhtml+xml"/></manifest>
+  <spine><itemref idref="text"/></spine>
+</package>`
+
+// buildEpub writes the given files to a zip in order, the mimetype is always stored first
+func buildEpub(t *testing.T, files ...string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("application/epub+zip"))
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(p, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestWriteMetadata(t *testing.T) {
+	for name, tc := range map[string]struct {
+		update Epub
+		want   Epub
+	}{
+		"all fields": {
+			Epub{
+				Title:       "Frankenstein; or, the Modern Prometheus",
+				Author:      "Mary Wollstonecraft Shelley",
+				Publisher:   "Lackington",
+				Language:    "en-GB",
+				ISBN:        "9780141439471",
+				Series:      "Penguin Classics",
+				SeriesIndex: 2.5,
+				Description: "A novel in letters",
+			},
+			Epub{
+				Title:       "Frankenstein; or, the Modern Prometheus",
+				Author:      "Mary Wollstonecraft Shelley",
+				Publisher:   "Lackington",
+				Language:    "en-GB",
+				ISBN:        "9780141439471",
+				Series:      "Penguin Classics",
+				SeriesIndex: 2.5,
+				Description: "A novel in letters",
+				PublishDate: time.Date(1818, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		"empty fields are kept": {
+			Epub{Title: "Frankenstein"},
+			Epub{
+				Title:       "Frankenstein",
+				Author:      "Mary Shelley",
+				Language:    "en",
+				PublishDate: time.Date(1818, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := buildEpub(t, "META-INF/container.xml", containerXML, "OEBPS/content.opf", contentOPF, "OEBPS/text.html", "<html/>")
+
+			err := WriteMetadata(p, &tc.update)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			book, _, err := ParseFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *book != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, *book)
+			}
+
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0640 {
+				t.Errorf("expected mode 0640 to be kept, got %v", fi.Mode().Perm())
+			}
+			zr, err := zip.OpenReader(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			if len(zr.File) != 4 || zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+				t.Errorf("expected an uncompressed mimetype as first of 4 entries, got %+v", zr.File[0].FileHeader)
+			}
+			leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(p), ".booksing-*"))
+			if len(leftovers) > 0 {
+				t.Errorf("expected no temporary files, got %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestWriteMetadataInvalid(t *testing.T) {
+	for name, files := range map[string][]string{
+		"no container":  {"OEBPS/content.opf", contentOPF},
+		"no rootfile":   {"META-INF/container.xml", containerXML},
+		"invalid opf":   {"META-INF/container.xml", containerXML, "OEBPS/content.opf", "<package><metadata>"},
+		"no metadata":   {"META-INF/container.xml", containerXML, "OEBPS/content.opf", "<package/>"},
+		"bad container": {"META-INF/container.xml", "<container>"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := buildEpub(t, files...)
+			before, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := WriteMetadata(p, &Epub{Title: "new"}); err == nil {
+				t.Error("expected an error")
+			}
+			after, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before, after) {
+				t.Error("expected the file to be left untouched")
+			}
+		})
+	}
+
+	if err := WriteMetadata(filepath.Join(t.TempDir(), "missing.epub"), &Epub{}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -7,12 +7,22 @@ import (
 	"net/http"
 )
 
+// webHookData describes a book leaving booksing, Action is either download or send
 type webHookData struct {
-	IPs  []string
-	User string
-	Hash string
+	IPs    []string
+	User   string
+	Hash   string
+	Action string
+	Format string
+	// To is the address the book was sent to, only set for sends
+	To string `json:",omitempty"`
 }
 
+const (
+	webHookDownload = "download"
+	webHookSend     = "send"
+)
+
 func (app *booksingApp) fireWebHook(d webHookData) {
 
 	jsonData, err := json.Marshal(d)
@@ -32,6 +42,7 @@ func (app *booksingApp) fireWebHook(d webHookData) {
 	response, err := client.Do(request)
 	if err != nil {
 		slog.Error("Failed to make request", "error", err)
+		return
 	}
 	defer response.Body.Close()
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const failedBucket = "failed"
+
+// reasons a file ends up in the faildir
+const (
+	failedParse     = "parse"
+	failedLanguage  = "language"
+	failedSize      = "size"
+	failedDuplicate = "duplicate"
+	// failedStore is used for books that could not be moved into the bookdir
+	failedStore = "store"
+	// failedUnknown is used for files in the faildir without a record, like files from older versions
+	failedUnknown = "unknown"
+)
+
+// failedImport records why a file was moved to the faildir, it is stored under the name of the file
+type failedImport struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Original string    `json:"original,omitempty"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+	Failed   time.Time `json:"failed"`
+	// Book is the parsed metadata, it is empty when the file could not be parsed
+	Book *Book `json:"book,omitempty"`
+}
+
+type retryRequest struct {
+	// Metadata overrides the parsed metadata, writeBack is ignored
+	Metadata *bookUpdate `json:"metadata"`
+}
+
+// moveBookToFailed moves the book and its cover to the faildir and records why. Files that are already in the
+// faildir, because a retry failed, stay where they are.
+func (app *booksingApp) moveBookToFailed(bookpath, reason string, cause error, book *Book) {
+	err := os.MkdirAll(app.cfg.FailDir, 0755)
+	if err != nil {
+		slog.Error("unable to create fail dir", "err", err)
+		return
+	}
+
+	newBookPath := bookpath
+	if filepath.Clean(filepath.Dir(bookpath)) != filepath.Clean(app.cfg.FailDir) {
+		newBookPath = filepath.Join(app.cfg.FailDir, filepath.Base(bookpath))
+		// never overwrite an earlier failure with the same name
+		if _, err := os.Stat(newBookPath); err == nil {
+			ext := filepath.Ext(newBookPath)
+			newBookPath = strings.TrimSuffix(newBookPath, ext) + "-" + randToken(3) + ext
+		}
+		err = moveFile(bookpath, newBookPath)
+		if err != nil {
+			slog.Error("unable to move book to faildir", "err", err, "faildir", app.cfg.FailDir, "bookpath", bookpath)
+			return
+		}
+		// also move the cover that belongs to the book, if there is one
+		if _, err := os.Stat(coverPath(bookpath)); err == nil {
+			err = moveFile(coverPath(bookpath), coverPath(newBookPath))
+			if err != nil {
+				slog.Warn("unable to move cover to faildir", "err", err, "bookpath", bookpath)
+			}
+		}
+	}
+
+	f := failedImport{
+		Name:     filepath.Base(newBookPath),
+		Path:     newBookPath,
+		Original: bookpath,
+		Reason:   reason,
+		Failed:   time.Now().In(app.timezone),
+		Book:     book,
+	}
+	if cause != nil {
+		f.Error = cause.Error()
+	}
+	// a retry keeps the original location of the first failure
+	var prev failedImport
+	if app.store.get(failedBucket, f.Name, &prev) == nil && newBookPath == bookpath {
+		f.Original = prev.Original
+	}
+	err = app.store.put(failedBucket, f.Name, f)
+	if err != nil {
+		slog.Error("unable to store failure reason", "err", err, "file", newBookPath)
+	}
+}
+
+// failedImports returns the records of every file in the faildir, files without a record have reason unknown
+func (app *booksingApp) failedImports() ([]failedImport, error) {
+	records, err := listAll[failedImport](app.store, failedBucket)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]failedImport{}
+	for _, f := range records {
+		byName[f.Name] = f
+	}
+
+	entries, err := os.ReadDir(app.cfg.FailDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []failedImport{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	failed := []failedImport{}
+	for _, e := range entries {
+		if e.IsDir() || strings.EqualFold(filepath.Ext(e.Name()), ".jpg") {
+			continue
+		}
+		f, ok := byName[e.Name()]
+		if !ok {
+			f = failedImport{
+				Name:   e.Name(),
+				Path:   filepath.Join(app.cfg.FailDir, e.Name()),
+				Reason: failedUnknown,
+			}
+			if fi, err := e.Info(); err == nil {
+				f.Failed = fi.ModTime()
+			}
+		}
+		failed = append(failed, f)
+	}
+	return failed, nil
+}
+
+// failedPath returns the path of a file in the faildir, names can not point outside of it
+func (app *booksingApp) failedPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", ErrNotFound
+	}
+	p := filepath.Join(app.cfg.FailDir, name)
+	if _, err := os.Stat(p); err != nil {
+		return "", ErrNotFound
+	}
+	return p, nil
+}
+
+// retryFailed imports a file from the faildir again, with upd applied to the parsed metadata
+func (app *booksingApp) retryFailed(name string, upd *bookUpdate, user string) (*importJob, error) {
+	p, err := app.failedPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	job := newImportJob(importSourceRetry, user, []string{p})
+	if upd != nil {
+		job.overrides = map[string]bookUpdate{p: *upd}
+	}
+	app.importFiles(job)
+
+	slog.Info("audit: failed import retried", "user", user, "file", name, "status", job.Files[0].Status)
+	if _, err := os.Stat(p); err == nil {
+		// it failed again, moveBookToFailed stored the new reason
+		return job, nil
+	}
+	err = errors.Join(app.store.delete(failedBucket, name), removeIfExists(coverPath(p)))
+	return job, err
+}
+
+// deleteFailed permanently removes a file and its cover from the faildir
+func (app *booksingApp) deleteFailed(name, user string) error {
+	p, err := app.failedPath(name)
+	if err != nil {
+		return err
+	}
+	err = errors.Join(os.Remove(p), removeIfExists(coverPath(p)), app.store.delete(failedBucket, name))
+	if err != nil {
+		return err
+	}
+	slog.Info("audit: failed import deleted", "user", user, "file", name)
+	return nil
+}
+
+func removeIfExists(p string) error {
+	err := os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// listFailed returns every file in the faildir with the reason it ended up there
+func (app *booksingApp) listFailed(w http.ResponseWriter, r *http.Request) {
+	failed, err := app.failedImports()
+	if err != nil {
+		slog.Error("failed to list failed imports", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, failed)
+}
+
+// retryFailedAPI imports a failed file again, the body can override the metadata of the book
+func (app *booksingApp) retryFailedAPI(w http.ResponseWriter, r *http.Request) {
+	var req retryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	job, err := app.retryFailed(r.PathValue("name"), req.Metadata, getUserFromRequest(r))
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if job == nil {
+		slog.Error("failed to retry import", "err", err)
+		renderError(w, "RETRY_FAILED", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		slog.Warn("unable to clean up after retry", "err", err)
+	}
+	writeJSON(w, job)
+}
+
+// deleteFailedAPI permanently removes a failed file
+func (app *booksingApp) deleteFailedAPI(w http.ResponseWriter, r *http.Request) {
+	err := app.deleteFailed(r.PathValue("name"), getUserFromRequest(r))
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to delete failed import", "err", err)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,157 @@
+package fb2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"golang.org/x/net/html/charset"
+)
+
+// FB2 represents a FictionBook type book
+type FB2 struct {
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	Publisher   string    `json:"publisher"`
+	Language    string    `json:"language"`
+	ISBN        string    `json:"isbn"`
+	Series      string    `json:"series"`
+	SeriesIndex float64   `json:"series_index"`
+	Description string    `json:"description"`
+	PublishDate time.Time `json:"publish_date"`
+}
+
+var ErrNotFB2 = errors.New("not a fictionbook file")
+
+// IsFB2 reports whether the header of a file looks like a FictionBook document
+func IsFB2(header []byte) bool {
+	return bytes.Contains(header, []byte("<FictionBook"))
+}
+
+// ParseFile takes a filepath and returns a FB2 and the raw cover image if possible
+func ParseFile(bookpath string) (bk *FB2, cover []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bk = nil
+			err = fmt.Errorf("Unknown error parsing book. Skipping. Error: %s", r)
+		}
+	}()
+
+	data, err := os.ReadFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc := etree.NewDocument()
+	doc.ReadSettings.CharsetReader = charsetReader
+	err = doc.ReadFromBytes(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	root := doc.SelectElement("FictionBook")
+	if root == nil {
+		return nil, nil, ErrNotFB2
+	}
+
+	book := new(FB2)
+	book.Title = strings.TrimSuffix(filepath.Base(bookpath), filepath.Ext(bookpath))
+
+	info := root.FindElement("./description/title-info")
+	if info == nil {
+		return book, nil, nil
+	}
+	if el := info.SelectElement("book-title"); el != nil {
+		book.Title = strings.TrimSpace(el.Text())
+	}
+	if el := info.SelectElement("author"); el != nil {
+		book.Author = authorName(el)
+	}
+	if el := info.SelectElement("lang"); el != nil {
+		book.Language = strings.TrimSpace(el.Text())
+	}
+	if el := info.SelectElement("annotation"); el != nil {
+		var parts []string
+		for _, p := range el.FindElements(".//p") {
+			parts = append(parts, strings.TrimSpace(p.Text()))
+		}
+		book.Description = strings.Join(parts, "\n")
+	}
+	if el := info.SelectElement("sequence"); el != nil {
+		book.Series = strings.TrimSpace(el.SelectAttrValue("name", ""))
+		book.SeriesIndex, _ = strconv.ParseFloat(el.SelectAttrValue("number", "0"), 64)
+	}
+	if el := info.SelectElement("date"); el != nil {
+		book.PublishDate = parseDate(el.SelectAttrValue("value", el.Text()))
+	}
+
+	if pub := root.FindElement("./description/publish-info"); pub != nil {
+		if el := pub.SelectElement("publisher"); el != nil {
+			book.Publisher = strings.TrimSpace(el.Text())
+		}
+		if el := pub.SelectElement("isbn"); el != nil {
+			book.ISBN = strings.ReplaceAll(strings.TrimSpace(el.Text()), "-", "")
+		}
+		if el := pub.SelectElement("year"); el != nil && book.PublishDate.IsZero() {
+			book.PublishDate = parseDate(el.Text())
+		}
+	}
+
+	// the coverpage links to a base64 encoded binary somewhere in the document
+	if img := info.FindElement("./coverpage/image"); img != nil {
+		href := ""
+		for _, a := range img.Attr {
+			if a.Key == "href" {
+				href = strings.TrimPrefix(a.Value, "#")
+			}
+		}
+		for _, bin := range root.SelectElements("binary") {
+			if href == "" || bin.SelectAttrValue("id", "") != href {
+				continue
+			}
+			raw := strings.Join(strings.Fields(bin.Text()), "")
+			cover, _ = base64.StdEncoding.DecodeString(raw)
+			break
+		}
+	}
+
+	return book, cover, nil
+}
+
+func authorName(el *etree.Element) string {
+	var parts []string
+	for _, tag := range []string{"first-name", "middle-name", "last-name"} {
+		if e := el.SelectElement(tag); e != nil && strings.TrimSpace(e.Text()) != "" {
+			parts = append(parts, strings.TrimSpace(e.Text()))
+		}
+	}
+	if len(parts) == 0 {
+		if e := el.SelectElement("nickname"); e != nil {
+			return strings.TrimSpace(e.Text())
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006-01-02", "2006"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// charsetReader handles the non utf-8 encodings that are common in fb2 files, like windows-1251
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	return charset.NewReaderLabel(label, input)
+}
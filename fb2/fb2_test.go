@@ -0,0 +1,117 @@
+package fb2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const fixture = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+  <description>
+    <title-info>
+      <author><first-name>Arkady</first-name><middle-name>N.</middle-name><last-name>Strugatsky</last-name></author>
+      <author><first-name>Boris</first-name><last-name>Strugatsky</last-name></author>
+      <book-title> Roadside Picnic </book-title>
+      <annotation><p>The Zone.</p><p>Stalkers.</p></annotation>
+      <date value="1972-01-01">1972</date>
+      <coverpage><image l:href="#cover.jpg"/></coverpage>
+      <lang>en</lang>
+      <sequence name="Noon Universe" number="3"/>
+    </title-info>
+    <publish-info>
+      <publisher>Macmillan</publisher>
+      <year>1977</year>
+      <isbn>0-02-615170-7</isbn>
+    </publish-info>
+  </description>
+  <body><section><p>text</p></section></body>
+  <binary id="other.jpg" content-type="image/jpeg">b3RoZXI=</binary>
+  <binary id="cover.jpg" content-type="image/jpeg">
+    Y292
+    ZXI=
+  </binary>
+</FictionBook>
+`
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseFile(t *testing.T) {
+	if !IsFB2([]byte(fixture)) {
+		t.Fatal("expected the fixture to be detected as fb2")
+	}
+
+	title, err := charmap.Windows1251.NewEncoder().String("Пикник на обочине")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1251 := `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook><description><title-info>
+  <author><nickname>Strugatsky</nickname></author>
+  <book-title>` + title + `</book-title>
+</title-info></description></FictionBook>`
+
+	for name, tc := range map[string]struct {
+		content string
+		want    FB2
+		cover   string
+	}{
+		"full description": {fixture, FB2{
+			Title:       "Roadside Picnic",
+			Author:      "Arkady N. Strugatsky",
+			Publisher:   "Macmillan",
+			Language:    "en",
+			ISBN:        "0026151707",
+			Series:      "Noon Universe",
+			SeriesIndex: 3,
+			Description: "The Zone.\nStalkers.",
+			PublishDate: time.Date(1972, 1, 1, 0, 0, 0, 0, time.UTC),
+		}, "cover"},
+		"windows-1251": {cp1251, FB2{
+			Title:  "Пикник на обочине",
+			Author: "Strugatsky",
+		}, ""},
+		"no title info": {`<FictionBook><body/></FictionBook>`, FB2{
+			Title: "book",
+		}, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			book, cover, err := ParseFile(writeFile(t, "book.fb2", []byte(tc.content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *book != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, *book)
+			}
+			if !bytes.Equal(cover, []byte(tc.cover)) {
+				t.Errorf("expected cover %q, got %q", tc.cover, cover)
+			}
+		})
+	}
+}
+
+func TestParseFileInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":             "",
+		"not fictionbook":   `<?xml version="1.0"?><html><body/></html>`,
+		"truncated header":  fixture[:60],
+		"truncated element": fixture[:400],
+		"unknown charset":   `<?xml version="1.0" encoding="x-unknown"?><FictionBook/>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if book, _, err := ParseFile(writeFile(t, "book.fb2", []byte(content))); err == nil {
+				t.Errorf("expected an error, got %+v", book)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnur/booksing/cbz"
+	"github.com/gnur/booksing/epub"
+	"github.com/gnur/booksing/fb2"
+	"github.com/gnur/booksing/mobi"
+	"github.com/gnur/booksing/pdf"
+)
+
+// bookFormat describes a file type that can be imported, formats are detected by extension first
+// and by their magic bytes when the extension is unknown
+type bookFormat struct {
+	Name        string
+	Extensions  []string
+	ContentType string
+	Magic       func(header []byte) bool
+	// Parse reads the metadata of a file, the returned book only has its metadata fields set
+	Parse func(bookpath string) (*Book, []byte, error)
+}
+
+const formatEPUB = "epub"
+
+// bookFormats is ordered by how specific the magic bytes are, cbz files are plain zips so they go last
+var bookFormats = []bookFormat{
+	{
+		Name:        formatEPUB,
+		Extensions:  []string{".epub"},
+		ContentType: "application/epub+zip",
+		Magic:       isEPUB,
+		Parse:       parseEPUB,
+	},
+	{
+		Name:        "mobi",
+		Extensions:  []string{".mobi", ".azw3", ".azw"},
+		ContentType: "application/x-mobipocket-ebook",
+		Magic:       mobi.IsMobi,
+		Parse:       parseMOBI,
+	},
+	{
+		Name:        "pdf",
+		Extensions:  []string{".pdf"},
+		ContentType: "application/pdf",
+		Magic:       pdf.IsPDF,
+		Parse:       parsePDF,
+	},
+	{
+		Name:        "fb2",
+		Extensions:  []string{".fb2"},
+		ContentType: "application/x-fictionbook+xml",
+		Magic:       fb2.IsFB2,
+		Parse:       parseFB2,
+	},
+	{
+		Name:        "cbz",
+		Extensions:  []string{".cbz"},
+		ContentType: "application/vnd.comicbook+zip",
+		Magic:       isZip,
+		Parse:       parseCBZ,
+	},
+}
+
+func isZip(h []byte) bool {
+	return bytes.HasPrefix(h, []byte("PK\x03\x04"))
+}
+
+// isEPUB checks for a strictly packed epub, an uncompressed mimetype entry at the start. Other epubs are only
+// recognized when h is the whole file, so the archive can be opened.
+func isEPUB(h []byte) bool {
+	if !isZip(h) {
+		return false
+	}
+	if len(h) >= 58 && string(h[30:58]) == "mimetypeapplication/epub+zip" {
+		return true
+	}
+	return isEPUBArchive(bytes.NewReader(h), int64(len(h)))
+}
+
+// isEPUBArchive looks for the container or the mimetype entry of an epub in a zip
+func isEPUBArchive(r io.ReaderAt, size int64) bool {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return false
+	}
+	for _, f := range zr.File {
+		if f.Name == "META-INF/container.xml" {
+			return true
+		}
+		if f.Name != "mimetype" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		mimetype, _ := io.ReadAll(io.LimitReader(rc, 64))
+		rc.Close()
+		if strings.TrimSpace(string(mimetype)) == "application/epub+zip" {
+			return true
+		}
+	}
+	return false
+}
+
+// formatByName returns the format of a stored book, books without a format are epubs
+func formatByName(name string) *bookFormat {
+	if name == "" {
+		name = formatEPUB
+	}
+	for i := range bookFormats {
+		if bookFormats[i].Name == name {
+			return &bookFormats[i]
+		}
+	}
+	return &bookFormats[0]
+}
+
+// formatForExt returns the format that uses ext, or nil if it is not a known book extension
+func formatForExt(ext string) *bookFormat {
+	ext = strings.ToLower(ext)
+	for i := range bookFormats {
+		for _, e := range bookFormats[i].Extensions {
+			if e == ext {
+				return &bookFormats[i]
+			}
+		}
+	}
+	return nil
+}
+
+// formatForHeader returns the format that matches the first bytes of a file, or nil
+func formatForHeader(header []byte) *bookFormat {
+	for i := range bookFormats {
+		if bookFormats[i].Magic(header) {
+			return &bookFormats[i]
+		}
+	}
+	return nil
+}
+
+// formatForFile detects the format of a file, the header is only read for files without an extension
+func formatForFile(bookpath string) *bookFormat {
+	ext := filepath.Ext(bookpath)
+	if ext != "" {
+		return formatForExt(ext)
+	}
+	f, err := os.Open(bookpath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	return formatForReader(f, info.Size())
+}
+
+// formatForReader detects the format of the content of r, zips are opened to tell epubs and comics apart
+func formatForReader(r io.ReaderAt, size int64) *bookFormat {
+	header := make([]byte, 512)
+	n, _ := r.ReadAt(header, 0)
+	header = header[:n]
+	if isZip(header) && isEPUBArchive(r, size) {
+		return formatByName(formatEPUB)
+	}
+	return formatForHeader(header)
+}
+
+// bookExt returns the extension the primary file of a book should be stored with
+func bookExt(b *Book) string {
+	return fileExt(BookFile{Format: formatByName(b.Format).Name, Path: b.Path})
+}
+
+// fileExt returns the extension a file should be stored with, the current one is kept if it belongs to the format
+func fileExt(f BookFile) string {
+	format := formatByName(f.Format)
+	ext := strings.ToLower(filepath.Ext(f.Path))
+	if formatForExt(ext) == format {
+		return ext
+	}
+	return format.Extensions[0]
+}
+
+// coverPath returns the location of the cover that belongs to a book file
+func coverPath(bookpath string) string {
+	return strings.TrimSuffix(bookpath, filepath.Ext(bookpath)) + ".jpg"
+}
+
+// toJPEG converts a cover to jpeg, nil is returned if the image can not be decoded
+func toJPEG(cover []byte) []byte {
+	if len(cover) == 0 {
+		return nil
+	}
+	if bytes.HasPrefix(cover, []byte{0xFF, 0xD8}) {
+		return cover
+	}
+	i, _, err := image.Decode(bytes.NewReader(cover))
+	if err != nil {
+		return nil
+	}
+	var b bytes.Buffer
+	err = jpeg.Encode(&b, i, nil)
+	if err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
+func parseEPUB(bookpath string) (*Book, []byte, error) {
+	e, cover, err := epub.ParseFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Book{
+		Title:       e.Title,
+		Author:      e.Author,
+		Language:    e.Language,
+		Description: e.Description,
+		Publisher:   e.Publisher,
+		ISBN:        e.ISBN,
+		Series:      e.Series,
+		PublishDate: e.PublishDate,
+		SeriesIndex: e.SeriesIndex,
+	}, cover, nil
+}
+
+func parseMOBI(bookpath string) (*Book, []byte, error) {
+	m, cover, err := mobi.ParseFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Book{
+		Title:       m.Title,
+		Author:      m.Author,
+		Language:    m.Language,
+		Description: m.Description,
+		Publisher:   m.Publisher,
+		ISBN:        m.ISBN,
+		PublishDate: m.PublishDate,
+	}, cover, nil
+}
+
+func parsePDF(bookpath string) (*Book, []byte, error) {
+	p, err := pdf.ParseFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Book{
+		Title:       p.Title,
+		Author:      p.Author,
+		Language:    p.Language,
+		Description: p.Description,
+		PublishDate: p.PublishDate,
+	}, nil, nil
+}
+
+func parseFB2(bookpath string) (*Book, []byte, error) {
+	f, cover, err := fb2.ParseFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Book{
+		Title:       f.Title,
+		Author:      f.Author,
+		Language:    f.Language,
+		Description: f.Description,
+		Publisher:   f.Publisher,
+		ISBN:        f.ISBN,
+		Series:      f.Series,
+		SeriesIndex: f.SeriesIndex,
+		PublishDate: f.PublishDate,
+	}, cover, nil
+}
+
+func parseCBZ(bookpath string) (*Book, []byte, error) {
+	c, cover, err := cbz.ParseFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Book{
+		Title:       c.Title,
+		Author:      c.Author,
+		Language:    c.Language,
+		Description: c.Description,
+		Publisher:   c.Publisher,
+		Series:      c.Series,
+		SeriesIndex: c.SeriesIndex,
+		PublishDate: c.PublishDate,
+	}, cover, nil
+}
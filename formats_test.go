@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// repack writes the entries of an epub to a new zip in the given order and with the given compression
+func repack(t *testing.T, src string, method uint16, skip func(name string) bool, order ...string) []byte {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	write := func(f *zip.File) {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, rc)
+	}
+	for _, name := range order {
+		for _, f := range zr.File {
+			if f.Name == name {
+				write(f)
+			}
+		}
+	}
+	for _, f := range zr.File {
+		if !skip(f.Name) && !contains(order, f.Name) {
+			write(f)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectFormat(t *testing.T) {
+	src := "testdata/import/gutenberg/pg84.epub"
+	strict, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keep := func(string) bool { return false }
+
+	for name, tc := range map[string]struct {
+		content []byte
+		want    string
+	}{
+		"strict epub":          {strict, formatEPUB},
+		"compressed mimetype":  {repack(t, src, zip.Deflate, keep, "mimetype"), formatEPUB},
+		"mimetype not first":   {repack(t, src, zip.Store, keep, "META-INF/container.xml", "mimetype"), formatEPUB},
+		"only the container":   {repack(t, src, zip.Deflate, func(n string) bool { return n == "mimetype" }), formatEPUB},
+		"comic":                {repack(t, src, zip.Deflate, func(n string) bool { return n == "mimetype" || n == "META-INF/container.xml" }), "cbz"},
+		"pdf":                  {[]byte("%PDF-1.4\n"), "pdf"},
+		"unknown":              {[]byte("hello"), ""},
+		"truncated epub":       {strict[:40], "cbz"},
+		"truncated loose epub": {repack(t, src, zip.Deflate, keep, "META-INF/container.xml")[:100], "cbz"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// files without an extension
+			p := filepath.Join(t.TempDir(), "book")
+			if err := os.WriteFile(p, tc.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if f := formatForFile(p); f != nil {
+				got = f.Name
+			}
+			if got != tc.want {
+				t.Errorf("expected file to be detected as %q, got %q", tc.want, got)
+			}
+
+			// uploads are checked against the whole content
+			got = ""
+			if f := formatForHeader(tc.content); f != nil {
+				got = f.Name
+			}
+			if got != tc.want {
+				t.Errorf("expected upload to be detected as %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseLooseEPUB(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "loose.epub")
+	content := repack(t, "testdata/import/gutenberg/pg84.epub", zip.Deflate, func(string) bool { return false }, "META-INF/container.xml")
+	if err := os.WriteFile(p, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	book, _, err := ParseBookFile(p)
+	if err != nil {
+		t.Fatalf("expected a loosely packed epub to parse: %v", err)
+	}
+	if book.Format != "" || book.Title == "" {
+		t.Errorf("expected an epub with a title, got format %q and title %q", book.Format, book.Title)
+	}
+}
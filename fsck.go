@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// categories of problems fsck can find and repair
+const (
+	fsckMissingFiles  = "missing-files"
+	fsckMissingCovers = "missing-covers"
+	fsckUnindexed     = "unindexed"
+	fsckOrphanCovers  = "orphan-covers"
+)
+
+var fsckCategories = []string{fsckMissingFiles, fsckMissingCovers, fsckUnindexed, fsckOrphanCovers}
+
+var errUnknownCategory = errors.New("unknown fsck category")
+
+// errIncompleteScan means the search index returned fewer books than it holds, every book it left out would show up as
+// unindexed and its cover as an orphan, so nothing is repaired
+var errIncompleteScan = errors.New("the index returned fewer books than it holds, not repairing")
+
+// fsckEntry is a book in the index that points at a file that no longer exists
+type fsckEntry struct {
+	Hash  string `json:"hash"`
+	Title string `json:"title"`
+	Path  string `json:"path"`
+}
+
+// fsckReport lists everything in the index and the bookdir that does not match up
+type fsckReport struct {
+	MissingFiles  []fsckEntry `json:"missingFiles"`
+	MissingCovers []fsckEntry `json:"missingCovers"`
+	Unindexed     []string    `json:"unindexed"`
+	OrphanCovers  []string    `json:"orphanCovers"`
+	Repaired      []string    `json:"repaired"`
+	// Scanned is the number of books fsck compared, Indexed the number of books the index holds
+	Scanned int `json:"scanned"`
+	Indexed int `json:"indexed"`
+}
+
+type fsckRequest struct {
+	Repair []string `json:"repair"`
+}
+
+// fsckAPI reports inconsistencies on GET, a POST also repairs the categories in the request
+func (app *booksingApp) fsckAPI(w http.ResponseWriter, r *http.Request) {
+	var req fsckRequest
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := app.fsck(req.Repair, getUserFromRequest(r))
+	if errors.Is(err, errUnknownCategory) {
+		renderError(w, "INVALID_CATEGORY", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errIncompleteScan) {
+		renderError(w, "INCOMPLETE_SCAN", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("fsck failed", "err", err)
+		renderError(w, "FSCK_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// fsck compares the index with the files in the bookdir and repairs the given categories
+func (app *booksingApp) fsck(repair []string, user string) (*fsckReport, error) {
+	if slices.Contains(repair, "all") {
+		repair = fsckCategories
+	}
+	for _, c := range repair {
+		if !slices.Contains(fsckCategories, c) {
+			return nil, fmt.Errorf("%w: %s", errUnknownCategory, c)
+		}
+	}
+
+	// imports move files around, so they would show up as missing or unindexed
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	report, books, err := app.fsckScan()
+	if err != nil {
+		return nil, err
+	}
+	if report.Scanned != report.Indexed {
+		slog.Warn("fsck only scanned part of the index", "scanned", report.Scanned, "indexed", report.Indexed)
+		if len(repair) > 0 {
+			return report, errIncompleteScan
+		}
+	}
+
+	var errs []error
+	for _, c := range repair {
+		var err error
+		switch c {
+		case fsckMissingFiles:
+			err = app.repairMissingFiles(report.MissingFiles, books)
+		case fsckMissingCovers:
+			err = app.repairMissingCovers(report.MissingCovers, books)
+		case fsckUnindexed:
+			err = app.repairUnindexed(report.Unindexed)
+		case fsckOrphanCovers:
+			for _, f := range report.OrphanCovers {
+				err = errors.Join(err, app.removeBookFile(f))
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c, err))
+			continue
+		}
+		report.Repaired = append(report.Repaired, c)
+		slog.Info("audit: fsck repaired", "user", user, "category", c)
+	}
+	return report, errors.Join(errs...)
+}
+
+// fsckScan walks the bookdir and compares it with every book in the index
+func (app *booksingApp) fsckScan() (*fsckReport, map[string]Book, error) {
+	report := &fsckReport{
+		MissingFiles:  []fsckEntry{},
+		MissingCovers: []fsckEntry{},
+		Unindexed:     []string{},
+		OrphanCovers:  []string{},
+		Repaired:      []string{},
+	}
+
+	all, err := app.allBooks(SearchFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	report.Scanned = len(all)
+	report.Indexed = app.searchDB.GetBookCount()
+
+	books := map[string]Book{}
+	indexed := map[string]bool{}
+	covers := map[string]bool{}
+	for _, b := range all {
+		books[b.Hash] = b
+		for _, f := range b.files() {
+			indexed[filepath.Clean(f.Path)] = true
+			if _, err := os.Stat(f.Path); errors.Is(err, os.ErrNotExist) {
+				report.MissingFiles = append(report.MissingFiles, fsckEntry{b.Hash, b.Title, f.Path})
+			}
+		}
+		if b.HasCover {
+			covers[filepath.Clean(b.CoverPath)] = true
+			if _, err := os.Stat(b.CoverPath); errors.Is(err, os.ErrNotExist) {
+				report.MissingCovers = append(report.MissingCovers, fsckEntry{b.Hash, b.Title, b.CoverPath})
+			}
+		}
+	}
+
+	var jpgs []string
+	err = filepath.WalkDir(app.bookDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		p = filepath.Clean(p)
+		if strings.EqualFold(filepath.Ext(p), ".jpg") {
+			jpgs = append(jpgs, p)
+			return nil
+		}
+		if !indexed[p] && formatForFile(p) != nil {
+			report.Unindexed = append(report.Unindexed, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// covers next to an unindexed book are picked up when that book is indexed
+	for _, u := range report.Unindexed {
+		covers[coverPath(u)] = true
+	}
+	for _, c := range jpgs {
+		if !covers[c] {
+			report.OrphanCovers = append(report.OrphanCovers, c)
+		}
+	}
+	return report, books, nil
+}
+
+// repairMissingFiles removes missing files from their books, books without any file left are removed from the index
+func (app *booksingApp) repairMissingFiles(missing []fsckEntry, books map[string]Book) error {
+	gone := map[string][]string{}
+	for _, m := range missing {
+		gone[m.Hash] = append(gone[m.Hash], m.Path)
+	}
+
+	var errs []error
+	for hash, paths := range gone {
+		b := books[hash]
+		files := slices.DeleteFunc(slices.Clone(b.files()), func(f BookFile) bool {
+			return slices.Contains(paths, f.Path)
+		})
+		if len(files) == 0 {
+			errs = append(errs, app.searchDB.DeleteBook(hash))
+			delete(books, hash)
+			if b.CoverPath != "" {
+				errs = append(errs, app.removeBookFile(b.CoverPath))
+			}
+			continue
+		}
+		b.Files = files
+		if slices.Contains(paths, b.Path) {
+			b.Path = files[0].Path
+			b.Size = files[0].Size
+			b.Format = files[0].Format
+			if b.Format == formatEPUB {
+				b.Format = ""
+			}
+		}
+		books[hash] = b
+		errs = append(errs, app.searchDB.AddBooks([]Book{b}))
+	}
+	return errors.Join(errs...)
+}
+
+// repairMissingCovers marks books with a missing cover as books without a cover
+func (app *booksingApp) repairMissingCovers(missing []fsckEntry, books map[string]Book) error {
+	var errs []error
+	for _, m := range missing {
+		b, ok := books[m.Hash]
+		if !ok {
+			continue
+		}
+		b.HasCover = false
+		b.CoverPath = ""
+		books[m.Hash] = b
+		errs = append(errs, app.searchDB.AddBooks([]Book{b}))
+	}
+	return errors.Join(errs...)
+}
+
+// repairUnindexed adds files that were put in the bookdir by hand to the index, they are left where they are
+func (app *booksingApp) repairUnindexed(files []string) error {
+	var errs []error
+	for _, f := range files {
+		book, cover, err := ParseBookFile(f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			continue
+		}
+
+		existing, err := app.searchDB.GetBook(book.Hash)
+		if err == nil {
+			// another format of a book that is already indexed
+			if _, ok := existing.file(formatByName(book.Format).Name); ok {
+				errs = append(errs, fmt.Errorf("%s: %w", f, ErrDuplicate))
+				continue
+			}
+			newFile, _ := book.file("")
+			existing.Files = append(existing.files(), newFile)
+			errs = append(errs, app.searchDB.AddBooks([]Book{*existing}))
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+
+		if book.HasCover {
+			book.CoverPath = coverPath(f)
+			if _, err := os.Stat(book.CoverPath); err != nil {
+				err = os.WriteFile(book.CoverPath, cover, 0644)
+				if err != nil {
+					book.HasCover = false
+					book.CoverPath = ""
+				}
+			}
+		}
+		errs = append(errs, app.searchDB.AddBooks([]Book{*book}))
+	}
+	return errors.Join(errs...)
+}
+
+// runFsck is the fsck command, it prints the report
+func (app *booksingApp) runFsck(repair []string) error {
+	report, err := app.fsck(repair, cliUser())
+	if report != nil {
+		printList := func(title string, items []string) {
+			fmt.Printf("%s: %d\n", title, len(items))
+			for _, i := range items {
+				fmt.Println("  " + i)
+			}
+		}
+		entries := func(es []fsckEntry) []string {
+			var items []string
+			for _, e := range es {
+				items = append(items, fmt.Sprintf("%s (%s): %s", e.Hash, e.Title, e.Path))
+			}
+			return items
+		}
+		printList(fsckMissingFiles, entries(report.MissingFiles))
+		printList(fsckMissingCovers, entries(report.MissingCovers))
+		printList(fsckUnindexed, report.Unindexed)
+		printList(fsckOrphanCovers, report.OrphanCovers)
+		if report.Scanned != report.Indexed {
+			fmt.Printf("only %d of %d indexed books were scanned\n", report.Scanned, report.Indexed)
+		}
+		if len(report.Repaired) > 0 {
+			fmt.Println("repaired:", strings.Join(report.Repaired, ", "))
+		}
+	}
+	return err
+}
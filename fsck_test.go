@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// cappedDB only returns the first max hits of a search, like meili does with its default maxTotalHits
+type cappedDB struct {
+	searchDB
+	max int64
+}
+
+func (db cappedDB) GetBooks(q SearchQuery) (*SearchResult, error) {
+	res, err := db.searchDB.GetBooks(q)
+	if err != nil {
+		return nil, err
+	}
+	res.Total = min(res.Total, db.max)
+	res.Items = res.Items[:max(0, min(int64(len(res.Items)), db.max-q.Offset))]
+	return res, nil
+}
+
+func fsckTestApp(t *testing.T) (*booksingApp, []Book) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub", "pg345.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 10, Sort: []SortOrder{{Field: "Title"}}})
+	if err != nil || len(res.Items) != 2 {
+		t.Fatalf("expected 2 books, got %v (%v)", res, err)
+	}
+	return app, res.Items
+}
+
+func TestFsck(t *testing.T) {
+	t.Run("Clean", func(t *testing.T) {
+		app, _ := fsckTestApp(t)
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.MissingFiles)+len(report.MissingCovers)+len(report.Unindexed)+len(report.OrphanCovers) != 0 {
+			t.Errorf("expected a clean report, got %+v", report)
+		}
+		if report.Scanned != 2 || report.Indexed != 2 {
+			t.Errorf("expected 2 books to be scanned, got %d of %d", report.Scanned, report.Indexed)
+		}
+	})
+
+	t.Run("MissingFiles", func(t *testing.T) {
+		app, books := fsckTestApp(t)
+		if err := os.Remove(books[0].Path); err != nil {
+			t.Fatal(err)
+		}
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.MissingFiles) != 1 || report.MissingFiles[0].Hash != books[0].Hash {
+			t.Fatalf("expected the removed file to be missing, got %+v", report.MissingFiles)
+		}
+
+		report, err = app.fsck([]string{fsckMissingFiles}, "test")
+		if err != nil || !slices.Contains(report.Repaired, fsckMissingFiles) {
+			t.Fatalf("expected repair to succeed, got %v (%v)", report.Repaired, err)
+		}
+		if ok, _ := app.searchDB.HasHash(books[0].Hash); ok {
+			t.Errorf("expected the book without files to be removed from the index")
+		}
+		if ok, _ := app.searchDB.HasHash(books[1].Hash); !ok {
+			t.Errorf("expected the other book to stay")
+		}
+	})
+
+	t.Run("MissingCovers", func(t *testing.T) {
+		app, books := fsckTestApp(t)
+		i := slices.IndexFunc(books, func(b Book) bool { return b.HasCover })
+		if i < 0 {
+			t.Fatal("expected a test book with a cover")
+		}
+		b := books[i]
+		if err := os.Remove(b.CoverPath); err != nil {
+			t.Fatal(err)
+		}
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.MissingCovers) != 1 || report.MissingCovers[0].Path != b.CoverPath {
+			t.Fatalf("expected the cover to be missing, got %+v", report.MissingCovers)
+		}
+
+		if _, err := app.fsck([]string{fsckMissingCovers}, "test"); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := app.searchDB.GetBook(b.Hash)
+		if got.HasCover || got.CoverPath != "" {
+			t.Errorf("expected the book to have no cover after repair, got %q", got.CoverPath)
+		}
+	})
+
+	t.Run("Unindexed", func(t *testing.T) {
+		app, _ := fsckTestApp(t)
+		in, err := os.ReadFile("testdata/import/gutenberg/pg174.epub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		manual := filepath.Join(app.bookDir, "manual.epub")
+		if err := os.WriteFile(manual, in, 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.Unindexed, []string{manual}) {
+			t.Fatalf("expected the manual file to be unindexed, got %v", report.Unindexed)
+		}
+
+		if _, err := app.fsck([]string{fsckUnindexed}, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if c := app.searchDB.GetBookCount(); c != 3 {
+			t.Errorf("expected the manual file to be indexed, got %d books", c)
+		}
+		if report, _ = app.fsck(nil, "test"); len(report.Unindexed) != 0 {
+			t.Errorf("expected nothing unindexed after repair, got %v", report.Unindexed)
+		}
+	})
+
+	t.Run("OrphanCovers", func(t *testing.T) {
+		app, _ := fsckTestApp(t)
+		orphan := filepath.Join(app.bookDir, "orphan.jpg")
+		if err := os.WriteFile(orphan, []byte("jpg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(report.OrphanCovers, []string{orphan}) {
+			t.Fatalf("expected the orphan cover, got %v", report.OrphanCovers)
+		}
+
+		if _, err := app.fsck([]string{fsckOrphanCovers}, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected the orphan cover to be removed")
+		}
+	})
+
+	t.Run("IncompleteScan", func(t *testing.T) {
+		app, books := fsckTestApp(t)
+		for _, b := range books {
+			if b.HasCover {
+				continue
+			}
+			b.HasCover = true
+			b.CoverPath = coverPath(b.Path)
+			if err := os.WriteFile(b.CoverPath, []byte("jpg"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.searchDB.AddBooks([]Book{b}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		app.searchDB = cappedDB{app.searchDB, 1}
+
+		report, err := app.fsck(nil, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Scanned != 1 || report.Indexed != 2 {
+			t.Errorf("expected the scan to be marked incomplete, got %d of %d", report.Scanned, report.Indexed)
+		}
+
+		_, err = app.fsck([]string{"all"}, "test")
+		if !errors.Is(err, errIncompleteScan) {
+			t.Fatalf("expected repairs to be refused, got %v", err)
+		}
+		for _, b := range books {
+			if _, err := os.Stat(coverPath(b.Path)); err != nil {
+				t.Errorf("expected every cover to stay: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const importsBucket = "imports"
+
+// maxImportJobs is the number of import jobs that are remembered, older jobs are removed
+const maxImportJobs = 200
+
+// where the files of an import job came from
+const (
+	importSourceScan   = "scan"
+	importSourceWatch  = "watch"
+	importSourceUpload = "upload"
+	importSourceRetry  = "retry"
+)
+
+// states of an import job
+const (
+	importJobQueued  = "queued"
+	importJobRunning = "running"
+	importJobDone    = "done"
+)
+
+// states of a single file in an import job
+const (
+	importQueued    = "queued"
+	importParsed    = "parsed"
+	importRejected  = "rejected"
+	importFailed    = "failed"
+	importDuplicate = "duplicate"
+	importIndexed   = "indexed"
+)
+
+// importJob tracks what happened to every file of a single import run
+type importJob struct {
+	mu    sync.Mutex
+	saved time.Time
+	index map[string]int
+	// overrides are applied to the metadata of a file after it is parsed
+	overrides map[string]bookUpdate
+
+	ID       string         `json:"id"`
+	Source   string         `json:"source"`
+	User     string         `json:"user,omitempty"`
+	Status   string         `json:"status"`
+	Created  time.Time      `json:"created"`
+	Started  *time.Time     `json:"started,omitempty"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Counts   map[string]int `json:"counts"`
+	Files    []importFile   `json:"files,omitempty"`
+}
+
+type importFile struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Status  string    `json:"status"`
+	Hash    string    `json:"hash,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// newImportJob creates a job with every file queued, the ID sorts in the order jobs were created
+func newImportJob(source, user string, paths []string) *importJob {
+	now := time.Now()
+	job := &importJob{
+		index:   map[string]int{},
+		ID:      strconv.FormatInt(now.UnixNano(), 36),
+		Source:  source,
+		User:    user,
+		Status:  importJobQueued,
+		Created: now,
+		Counts:  map[string]int{importQueued: len(paths)},
+	}
+	for i, p := range paths {
+		job.index[p] = i
+		job.Files = append(job.Files, importFile{
+			Name:    filepath.Base(p),
+			Path:    p,
+			Status:  importQueued,
+			Updated: now,
+		})
+	}
+	return job
+}
+
+func (j *importJob) paths() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	paths := make([]string, len(j.Files))
+	for i, f := range j.Files {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+func (j *importJob) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.Started = &now
+	j.Status = importJobRunning
+}
+
+func (j *importJob) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.Status = importJobDone
+}
+
+// update sets the status of the file that was at path when the job was created
+func (j *importJob) update(path, status, hash string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i, ok := j.index[path]
+	if !ok {
+		return
+	}
+	f := &j.Files[i]
+	j.Counts[f.Status]--
+	if j.Counts[f.Status] == 0 {
+		delete(j.Counts, f.Status)
+	}
+	j.Counts[status]++
+	f.Status = status
+	f.Hash = hash
+	f.Updated = time.Now()
+	if err != nil {
+		f.Error = err.Error()
+	}
+}
+
+// saveImportJob stores the job, without force it is saved at most once per second so large imports stay fast
+func (app *booksingApp) saveImportJob(job *importJob, force bool) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if !force && time.Since(job.saved) < time.Second {
+		return
+	}
+	job.saved = time.Now()
+	err := app.store.put(importsBucket, job.ID, job)
+	if err != nil {
+		slog.Warn("unable to save import job", "err", err, "id", job.ID)
+	}
+}
+
+// pruneImportJobs removes the oldest jobs when there are more than maxImportJobs
+func (app *booksingApp) pruneImportJobs() error {
+	var ids []string
+	err := app.store.each(importsBucket, func(key string, _ []byte) error {
+		ids = append(ids, key)
+		return nil
+	})
+	if err != nil || len(ids) <= maxImportJobs {
+		return err
+	}
+	var errs []error
+	for _, id := range ids[:len(ids)-maxImportJobs] {
+		errs = append(errs, app.store.delete(importsBucket, id))
+	}
+	return errors.Join(errs...)
+}
+
+// resumeUploads imports the uploads that were waiting when booksing stopped. They are not in the import dir, so
+// no scan finds them. Unfinished upload jobs run again with the same ID, files without a job get a new one.
+func (app *booksingApp) resumeUploads() error {
+	entries, err := os.ReadDir(app.uploadDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	left := map[string]bool{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			left[filepath.Join(app.uploadDir(), e.Name())] = true
+		}
+	}
+	if len(left) == 0 {
+		return nil
+	}
+
+	saved, err := listAll[*importJob](app.store, importsBucket)
+	if err != nil {
+		return err
+	}
+	var jobs []*importJob
+	for _, old := range saved {
+		if old.Source != importSourceUpload || old.Status == importJobDone {
+			continue
+		}
+		var paths []string
+		names := map[string]string{}
+		for _, f := range old.Files {
+			if left[f.Path] {
+				paths = append(paths, f.Path)
+				names[f.Path] = f.Name
+				delete(left, f.Path)
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		job := newImportJob(importSourceUpload, old.User, paths)
+		job.ID, job.Created = old.ID, old.Created
+		for i := range job.Files {
+			job.Files[i].Name = names[job.Files[i].Path]
+		}
+		jobs = append(jobs, job)
+	}
+	if len(left) > 0 {
+		var paths []string
+		for p := range left {
+			paths = append(paths, p)
+		}
+		slices.Sort(paths)
+		jobs = append(jobs, newImportJob(importSourceUpload, "", paths))
+	}
+
+	importLock.Lock()
+	defer importLock.Unlock()
+	for _, job := range jobs {
+		slog.Info("resuming upload", "id", job.ID, "user", job.User, "files", len(job.Files))
+		app.importFiles(job)
+	}
+	return nil
+}
+
+// visibleImport reports whether user may see the job, uploaders only see their own uploads
+func (app *booksingApp) visibleImport(job *importJob, user string) bool {
+	return job.User == user || app.hasRole(user, roleLibrarian)
+}
+
+// listImports returns the most recent import jobs without their files, newest first
+func (app *booksingApp) listImports(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	jobs, err := listAll[*importJob](app.store, importsBucket)
+	if err != nil {
+		slog.Error("failed to list imports", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	visible := []*importJob{}
+	for _, j := range slices.Backward(jobs) {
+		if app.visibleImport(j, user) {
+			j.Files = nil
+			visible = append(visible, j)
+		}
+	}
+	writeJSON(w, visible)
+}
+
+// getImport returns a single import job with the status of every file
+func (app *booksingApp) getImport(w http.ResponseWriter, r *http.Request) {
+	var job importJob
+	err := app.store.get(importsBucket, r.PathValue("id"), &job)
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to get import", "err", err)
+		renderError(w, "GET_FAILED", http.StatusInternalServerError)
+		return
+	}
+	if !app.visibleImport(&job, getUserFromRequest(r)) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, &job)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gnur/booksing/kepub"
+)
+
+const (
+	formatKEPUB      = "kepub"
+	kepubContentType = "application/kepub+zip"
+)
+
+// isKobo reports whether the request comes from the browser of a kobo reader
+func isKobo(r *http.Request) bool {
+	return strings.Contains(r.UserAgent(), "Kobo")
+}
+
+func (app *booksingApp) kepubCachePath(hash string) string {
+	return filepath.Join(app.cfg.CacheDir, "kepub", hash+".kepub.epub")
+}
+
+// serveKepub converts the epub file of a book to a kepub, conversions are cached until the epub changes
+func (app *booksingApp) serveKepub(w http.ResponseWriter, r *http.Request, book *Book, file BookFile) {
+	cached, err := app.cachedKepub(book.Hash, file.Path)
+	if err != nil {
+		slog.Error("failed to convert to kepub", "err", err, "hash", book.Hash)
+		renderError(w, "CONVERSION_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	fName := strings.TrimSuffix(filepath.Base(file.Path), filepath.Ext(file.Path)) + ".kepub.epub"
+	w.Header().Set("Content-Type", kepubContentType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s\"", fName))
+	http.ServeFile(w, r, cached)
+}
+
+// cachedKepub returns the path of the kepub of an epub, it is converted if there is no up to date conversion yet
+func (app *booksingApp) cachedKepub(hash, epubPath string) (string, error) {
+	src, err := os.Stat(epubPath)
+	if err != nil {
+		return "", err
+	}
+	target := app.kepubCachePath(hash)
+	if fi, err := os.Stat(target); err == nil && !fi.ModTime().Before(src.ModTime()) {
+		return target, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return "", err
+	}
+	// convert into a temp file so concurrent downloads never see a partial kepub
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".kepub-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = kepub.Convert(epubPath, tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	slog.Debug("converted book to kepub", "hash", hash)
+	return target, os.Rename(tmp.Name(), target)
+}
+
+// removeKepub removes the cached conversion of a book, if there is one
+func (app *booksingApp) removeKepub(hash string) {
+	err := os.Remove(app.kepubCachePath(hash))
+	if err != nil && !os.IsNotExist(err) {
+		slog.Warn("unable to remove cached kepub", "err", err, "hash", hash)
+	}
+}
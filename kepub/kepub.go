@@ -0,0 +1,196 @@
+package kepub
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// blockTags start a new paragraph in the kobo span numbering
+var blockTags = map[string]bool{
+	"p": true, "div": true, "li": true, "blockquote": true, "dd": true, "dt": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"td": true, "th": true, "figcaption": true, "caption": true, "section": true,
+}
+
+// skipTags contain text that should not be split into spans
+var skipTags = map[string]bool{
+	"script": true, "style": true, "pre": true, "svg": true, "math": true, "title": true,
+}
+
+var sentence = regexp.MustCompile(`[^.!?…]*[.!?…]+["'”’)\]]*(\s+|$)`)
+
+const koboStyle = `div#book-inner { margin-top: 0; margin-bottom: 0; }`
+
+// Convert reads the epub at src and writes a kepub to w. Every sentence of the XHTML content
+// is wrapped in a koboSpan, which the kobo reader uses for page numbers and reading statistics.
+// Content files that can not be parsed are copied as is.
+func Convert(src string, w io.Writer) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	zw := zip.NewWriter(w)
+	for _, f := range zr.File {
+		if !isContent(f.Name) {
+			// this keeps the uncompressed mimetype as first entry
+			err = zw.Copy(f)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		doc, err := readContent(f)
+		if err != nil {
+			err = zw.Copy(f)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		transform(doc)
+
+		header := f.FileHeader
+		header.Method = zip.Deflate
+		out, err := zw.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		_, err = doc.WriteTo(out)
+		if err != nil {
+			return fmt.Errorf("unable to write %s: %w", f.Name, err)
+		}
+	}
+	return zw.Close()
+}
+
+func isContent(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".xhtml", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+func readContent(f *zip.File) (*etree.Document, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	doc := etree.NewDocument()
+	doc.ReadSettings.Permissive = true
+	doc.ReadSettings.Entity = xml.HTMLEntity
+	_, err = doc.ReadFrom(rc)
+	if err != nil {
+		return nil, err
+	}
+	if doc.FindElement("//body") == nil {
+		return nil, fmt.Errorf("%s has no body", f.Name)
+	}
+	return doc, nil
+}
+
+// transform adds the kobo spans and the book-columns wrappers to a content document
+func transform(doc *etree.Document) {
+	body := doc.FindElement("//body")
+	if body.FindElement(".//span[@class='koboSpan']") != nil {
+		// already a kepub
+		return
+	}
+
+	c := &counter{para: 0}
+	c.walk(body)
+
+	inner := etree.NewElement("div")
+	inner.CreateAttr("id", "book-inner")
+	for len(body.Child) > 0 {
+		inner.AddChild(body.Child[0])
+	}
+	columns := body.CreateElement("div")
+	columns.CreateAttr("id", "book-columns")
+	columns.AddChild(inner)
+
+	if head := doc.FindElement("//head"); head != nil {
+		style := head.CreateElement("style")
+		style.CreateAttr("type", "text/css")
+		style.CreateAttr("class", "kobostylehacks")
+		style.SetText(koboStyle)
+	}
+}
+
+type counter struct {
+	para int
+	seg  int
+}
+
+func (c *counter) span(text string) *etree.Element {
+	c.seg++
+	span := etree.NewElement("span")
+	span.CreateAttr("class", "koboSpan")
+	span.CreateAttr("id", fmt.Sprintf("kobo.%d.%d", c.para, c.seg))
+	if text != "" {
+		span.SetText(text)
+	}
+	return span
+}
+
+func (c *counter) walk(el *etree.Element) {
+	if blockTags[el.Tag] || c.para == 0 {
+		c.para++
+		c.seg = 0
+	}
+
+	for i := 0; i < len(el.Child); i++ {
+		switch t := el.Child[i].(type) {
+		case *etree.CharData:
+			if strings.TrimSpace(t.Data) == "" {
+				continue
+			}
+			el.RemoveChildAt(i)
+			for _, s := range splitSentences(t.Data) {
+				el.InsertChildAt(i, c.span(s))
+				i++
+			}
+			i--
+		case *etree.Element:
+			switch {
+			case skipTags[t.Tag]:
+			case t.Tag == "img":
+				el.RemoveChildAt(i)
+				span := c.span("")
+				span.AddChild(t)
+				el.InsertChildAt(i, span)
+			default:
+				c.walk(t)
+			}
+		}
+	}
+}
+
+// splitSentences splits text after sentence endings that are followed by whitespace, the whitespace is kept
+// with the sentence before it
+func splitSentences(text string) []string {
+	var parts []string
+	last := 0
+	for _, loc := range sentence.FindAllStringIndex(text, -1) {
+		if loc[1] > last {
+			parts = append(parts, text[last:loc[1]])
+			last = loc[1]
+		}
+	}
+	if last < len(text) {
+		parts = append(parts, text[last:])
+	}
+	return parts
+}
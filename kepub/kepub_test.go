@@ -0,0 +1,138 @@
+package kepub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const chapter = `<?xml version="1.0" encoding="utf-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>One. Two.</title></head>
+<body><h1>Chapter one</h1><p>It was a dark night. The wind howled! <img src="a.png"/></p><pre>Keep. This.</pre></body></html>`
+
+const converted = `<p><span class="koboSpan" id="kobo.1.1">Done.</span></p>`
+
+// buildEPUB writes the given files to a zip, the mimetype is stored first like in a real epub
+func buildEPUB(t *testing.T, files ...string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("application/epub+zip"))
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "book.epub")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConvert(t *testing.T) {
+	src := buildEPUB(t,
+		"META-INF/container.xml", "<container/>",
+		"OEBPS/style.css", "p { margin: 0; }",
+		"OEBPS/ch1.xhtml", chapter,
+		"OEBPS/broken.xhtml", "<html><p>no body",
+		"OEBPS/kepub.xhtml", "<html><head/><body>"+converted+"</body></html>",
+	)
+	var out bytes.Buffer
+	if err := Convert(src, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+		names = append(names, f.Name)
+	}
+	if names[0] != "mimetype" || zr.File[0].Method != zip.Store {
+		t.Errorf("expected an uncompressed mimetype as first entry, got %v", names)
+	}
+	if !slices.Equal(names, []string{"mimetype", "META-INF/container.xml", "OEBPS/style.css", "OEBPS/ch1.xhtml", "OEBPS/broken.xhtml", "OEBPS/kepub.xhtml"}) {
+		t.Errorf("expected every file to be kept in order, got %v", names)
+	}
+
+	ch1 := files["OEBPS/ch1.xhtml"]
+	for _, want := range []string{
+		`<title>One. Two.</title>`,
+		`<span class="koboSpan" id="kobo.2.1">Chapter one</span>`,
+		`<span class="koboSpan" id="kobo.3.1">It was a dark night. </span>`,
+		`<span class="koboSpan" id="kobo.3.2">The wind howled! </span>`,
+		`<span class="koboSpan" id="kobo.3.3"><img src="a.png"/></span>`,
+		`<pre>Keep. This.</pre>`,
+		`<body><div id="book-columns"><div id="book-inner"><h1>`,
+		`class="kobostylehacks"`,
+	} {
+		if !strings.Contains(ch1, want) {
+			t.Errorf("expected %s in the converted chapter:\n%s", want, ch1)
+		}
+	}
+	if files["OEBPS/broken.xhtml"] != "<html><p>no body" {
+		t.Errorf("expected content that can not be parsed to be copied, got %q", files["OEBPS/broken.xhtml"])
+	}
+	if k := files["OEBPS/kepub.xhtml"]; strings.Count(k, "koboSpan") != 1 || strings.Contains(k, "book-columns") {
+		t.Errorf("expected a kepub not to be converted again, got %s", k)
+	}
+	if files["OEBPS/style.css"] != "p { margin: 0; }" {
+		t.Errorf("expected other files to be copied, got %q", files["OEBPS/style.css"])
+	}
+}
+
+func TestConvertInvalid(t *testing.T) {
+	src := buildEPUB(t, "OEBPS/ch1.xhtml", chapter)
+	in, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.epub")
+	if err := os.WriteFile(truncated, in[:len(in)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{truncated, filepath.Join(t.TempDir(), "missing.epub")} {
+		if err := Convert(p, io.Discard); err == nil {
+			t.Errorf("expected converting %s to fail", filepath.Base(p))
+		}
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	for text, want := range map[string][]string{
+		"One. Two? Three":         {"One. ", "Two? ", "Three"},
+		`He said "Hi." Then left`: {`He said "Hi." `, "Then left"},
+		"Wait... what":            {"Wait... ", "what"},
+		"3.14 is pi.":             {"3.14 is pi."},
+		"no ending":               {"no ending"},
+		"Done!\n":                 {"Done!\n"},
+	} {
+		if got := splitSentences(text); !slices.Equal(got, want) {
+			t.Errorf("splitSentences(%q) = %q, expected %q", text, got, want)
+		}
+	}
+}
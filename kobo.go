@@ -0,0 +1,506 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The kobo sync api lets kobo readers sync the library as if it was the kobo store. A device is pointed at
+// booksing by setting api_endpoint in its Kobo eReader.conf to the endpoint of a device token. Only books
+// with an epub file are synced, they are downloaded as kepub.
+
+const (
+	koboDevicesBucket = "kobo_devices"
+	koboBooksBucket   = "kobo_books"
+	koboSyncedBucket  = "kobo_synced"
+	koboSyncPageSize  = 100
+)
+
+// koboDevice is a kobo reader of a user, the token is part of every url the device uses. Devices are stored
+// under the hash of their token like api tokens, the sync state under the ID.
+type koboDevice struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created"`
+	LastSync time.Time `json:"lastSync"`
+	// Local is set when the owner is a local user, the device stops working when that user is removed
+	Local bool `json:"local,omitempty"`
+	// Token is only set in the response that creates the device and while a request of the device is handled
+	Token string `json:"token,omitempty"`
+}
+
+type koboDeviceResponse struct {
+	koboDevice
+	Endpoint string `json:"endpoint"`
+}
+
+// koboSyncToken is handed to the device after every sync, it is sent back on the next sync. A device that
+// sends no token or a token of another generation, like after a reset, gets the whole library again.
+type koboSyncToken struct {
+	Generation string `json:"generation"`
+}
+
+// koboSyncState is what a device got in earlier syncs. The library is compared with it on every sync, so
+// books that were imported with an old date, edited or deleted since the last sync are not missed.
+type koboSyncState struct {
+	Generation string `json:"generation"`
+	// Books maps the hash of every synced book to the fingerprint of what was sent
+	Books map[string]string `json:"books"`
+}
+
+// baseURL returns the scheme and host the request was made to
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		scheme = p
+	}
+	return scheme + "://" + r.Host
+}
+
+// koboID turns a book hash into the uuid a kobo expects, the reverse is kept in the store
+func koboID(hash string) string {
+	h := sha1.Sum([]byte(hash))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func (app *booksingApp) koboBook(id string) (*Book, error) {
+	var hash string
+	err := app.store.get(koboBooksBucket, id, &hash)
+	if err != nil {
+		return nil, err
+	}
+	return app.searchDB.GetBook(hash)
+}
+
+// listKoboDevices returns the kobo devices of the current user
+func (app *booksingApp) listKoboDevices(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	devices, err := listAll[koboDevice](app.store, koboDevicesBucket)
+	if err != nil {
+		slog.Error("failed to list kobo devices", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	res := []koboDevice{}
+	for _, d := range devices {
+		if d.User == user {
+			res = append(res, d)
+		}
+	}
+	writeJSON(w, res)
+}
+
+// addKoboDevice creates a new device token for the current user, the token is only returned once
+func (app *booksingApp) addKoboDevice(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Name) == "" {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+
+	token := randToken(16)
+	d := koboDevice{
+		ID:      randToken(6),
+		User:    getUserFromRequest(r),
+		Name:    strings.TrimSpace(req.Name),
+		Created: time.Now().In(app.timezone),
+	}
+	d.Local = app.isLocalUser(d.User)
+	err = app.store.put(koboDevicesBucket, hashToken(token), d)
+	if err != nil {
+		slog.Error("failed to store kobo device", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: kobo device added", "user", d.User, "id", d.ID, "name", d.Name)
+	d.Token = token
+	writeJSON(w, koboDeviceResponse{d, baseURL(r) + "/kobo/" + token})
+}
+
+// deleteKoboDevice revokes a device token of the current user
+func (app *booksingApp) deleteKoboDevice(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	keys, err := app.koboDeviceKeys(user)
+	key, ok := keys[r.PathValue("id")]
+	if err == nil && !ok {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = errors.Join(app.store.delete(koboDevicesBucket, key), app.store.delete(koboSyncedBucket, r.PathValue("id")))
+	}
+	if err != nil {
+		slog.Error("failed to delete kobo device", "err", err)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: kobo device removed", "user", user, "id", r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// koboDeviceKeys returns the store keys of the devices of a user by device ID
+func (app *booksingApp) koboDeviceKeys(user string) (map[string]string, error) {
+	keys := map[string]string{}
+	err := app.store.each(koboDevicesBucket, func(k string, val []byte) error {
+		var d koboDevice
+		if json.Unmarshal(val, &d) == nil && d.User == user {
+			keys[d.ID] = k
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// deleteKoboDevices removes every device of a user with its sync state
+func (app *booksingApp) deleteKoboDevices(user string) error {
+	keys, err := app.koboDeviceKeys(user)
+	errs := []error{err}
+	for id, k := range keys {
+		errs = append(errs, app.store.delete(koboDevicesBucket, k), app.store.delete(koboSyncedBucket, id))
+	}
+	return errors.Join(errs...)
+}
+
+// koboAuth only allows requests with a known device token of a user that still exists
+func (app *booksingApp) koboAuth(next func(http.ResponseWriter, *http.Request, koboDevice)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d koboDevice
+		err := app.store.get(koboDevicesBucket, hashToken(r.PathValue("token")), &d)
+		if err != nil || (d.Local && !app.isLocalUser(d.User)) {
+			renderError(w, "UNAUTHORIZED", http.StatusUnauthorized)
+			return
+		}
+		// the urls the device is sent contain the token
+		d.Token = r.PathValue("token")
+		next(w, r, d)
+	}
+}
+
+// koboAuthDevice is called when the device signs in, the tokens it gets back are not used
+func (app *booksingApp) koboAuthDevice(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	var req struct {
+		UserKey string
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	writeJSON(w, map[string]string{
+		"AccessToken":  randToken(24),
+		"RefreshToken": randToken(24),
+		"TokenType":    "Bearer",
+		"TrackingId":   koboID(d.ID),
+		"UserKey":      req.UserKey,
+	})
+}
+
+// koboInitialization tells the device where to find the resources that booksing provides
+func (app *booksingApp) koboInitialization(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	base := baseURL(r) + "/kobo/" + d.Token
+	w.Header().Set("x-kobo-apitoken", "e30=")
+	writeJSON(w, map[string]interface{}{
+		"Resources": map[string]string{
+			"image_host":                 baseURL(r),
+			"image_url_template":         base + "/{ImageId}/{Width}/{Height}/false/image.jpg",
+			"image_url_quality_template": base + "/{ImageId}/{Width}/{Height}/{Quality}/{IsGreyscale}/image.jpg",
+			"library_sync":               base + "/v1/library/sync",
+			"library_items":              base + "/v1/user/library",
+			"library_metadata":           base + "/v1/library/{Ids}/metadata",
+			"reading_state":              base + "/v1/library/{Ids}/state",
+			"user_profile":               base + "/v1/user/profile",
+		},
+	})
+}
+
+func encodeKoboSyncToken(token koboSyncToken) string {
+	js, _ := json.Marshal(token)
+	return base64.StdEncoding.EncodeToString(js)
+}
+
+// decodeKoboSyncToken reads the token the device sent, tokens that can not be read are empty
+func decodeKoboSyncToken(raw string) koboSyncToken {
+	var token koboSyncToken
+	js, err := base64.StdEncoding.DecodeString(raw)
+	if err == nil {
+		_ = json.Unmarshal(js, &token)
+	}
+	return token
+}
+
+// koboFingerprint changes when anything the device shows of a book changes
+func koboFingerprint(b Book) string {
+	file, _ := b.file(formatEPUB)
+	h := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%s|%s|%g|%s|%s|%s|%s|%t|%d|%s", b.Title, b.Author, b.Description,
+		b.Series, b.SeriesIndex, b.Language, b.Publisher, b.ISBN, koboTime(b.PublishDate), b.HasCover, file.Size, file.Checksum)))
+	return hex.EncodeToString(h[:8])
+}
+
+// koboSync sends the changes since the last sync to the device, a page at a time. New books are sent as
+// new entitlements, books that changed or were deleted as changed entitlements.
+func (app *booksingApp) koboSync(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	token := decodeKoboSyncToken(r.Header.Get("X-Kobo-SyncToken"))
+
+	var state koboSyncState
+	err := app.store.get(koboSyncedBucket, d.ID, &state)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		slog.Error("kobo sync failed", "err", err, "device", d.Name)
+		renderError(w, "SYNC_FAILED", http.StatusInternalServerError)
+		return
+	}
+	if token.Generation == "" || token.Generation != state.Generation {
+		state = koboSyncState{Generation: randToken(8), Books: map[string]string{}}
+	}
+
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil {
+		slog.Error("kobo sync failed", "err", err, "device", d.Name)
+		renderError(w, "SYNC_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slices.SortFunc(books, func(a, b Book) int {
+		return cmp.Or(a.Added.Compare(b.Added), strings.Compare(a.Hash, b.Hash))
+	})
+
+	entitlements := []interface{}{}
+	more := false
+	inLibrary := map[string]bool{}
+	for _, b := range books {
+		if _, ok := b.file(formatEPUB); !ok {
+			continue
+		}
+		inLibrary[b.Hash] = true
+		fp := koboFingerprint(b)
+		synced, ok := state.Books[b.Hash]
+		if ok && synced == fp {
+			continue
+		}
+		if len(entitlements) >= koboSyncPageSize {
+			more = true
+			break
+		}
+		id := koboID(b.Hash)
+		err = app.store.put(koboBooksBucket, id, b.Hash)
+		if err != nil {
+			slog.Error("unable to store kobo id", "err", err, "hash", b.Hash)
+			continue
+		}
+		kind := "NewEntitlement"
+		entitlement := koboEntitlement(id, b)
+		if ok {
+			kind = "ChangedEntitlement"
+			entitlement["LastModified"] = koboTime(time.Now())
+		}
+		entitlements = append(entitlements, map[string]interface{}{
+			kind: map[string]interface{}{
+				"BookEntitlement": entitlement,
+				"BookMetadata":    app.koboMetadata(r, d, id, b),
+				"ReadingState":    koboReadingState(id, b),
+			},
+		})
+		state.Books[b.Hash] = fp
+	}
+
+	// books are only known to be gone once the whole library was compared
+	if !more {
+		for hash := range state.Books {
+			if inLibrary[hash] {
+				continue
+			}
+			if len(entitlements) >= koboSyncPageSize {
+				more = true
+				break
+			}
+			removed := koboEntitlement(koboID(hash), Book{Added: time.Now()})
+			removed["IsRemoved"] = true
+			entitlements = append(entitlements, map[string]interface{}{
+				"ChangedEntitlement": map[string]interface{}{
+					"BookEntitlement": removed,
+				},
+			})
+			delete(state.Books, hash)
+		}
+	}
+
+	err = app.store.put(koboSyncedBucket, d.ID, state)
+	if err != nil {
+		slog.Error("unable to store kobo sync state", "err", err, "device", d.Name)
+		renderError(w, "SYNC_FAILED", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Kobo-SyncToken", encodeKoboSyncToken(koboSyncToken{Generation: state.Generation}))
+	if more {
+		w.Header().Set("X-Kobo-Sync", "continue")
+	}
+
+	stored := d
+	stored.Token = ""
+	stored.LastSync = time.Now().In(app.timezone)
+	err = app.store.put(koboDevicesBucket, hashToken(d.Token), stored)
+	if err != nil {
+		slog.Warn("unable to update kobo device", "err", err, "device", d.Name)
+	}
+	slog.Info("kobo sync", "user", d.User, "device", d.Name, "changes", len(entitlements), "synced", len(state.Books))
+	writeJSON(w, entitlements)
+}
+
+// koboMetadataAPI returns the metadata of a single book
+func (app *booksingApp) koboMetadataAPI(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	id := r.PathValue("id")
+	b, err := app.koboBook(id)
+	if err != nil {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, []interface{}{app.koboMetadata(r, d, id, *b)})
+}
+
+// koboState accepts reading state updates, they are not stored
+func (app *booksingApp) koboState(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	writeJSON(w, map[string]interface{}{
+		"RequestResult": "Success",
+		"UpdateResults": []interface{}{},
+	})
+}
+
+// koboCover serves the cover of a book through getCover, the size the device asks for is ignored
+func (app *booksingApp) koboCover(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	b, err := app.koboBook(r.PathValue("id"))
+	if err != nil || !b.HasCover {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	cr := r.Clone(r.Context())
+	cr.URL.RawQuery = url.Values{"file": {strings.TrimPrefix(b.CoverPath, app.bookDir)}}.Encode()
+	app.getCover(w, cr)
+}
+
+// koboDownload serves the kepub of a book
+func (app *booksingApp) koboDownload(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	b, err := app.koboBook(r.PathValue("id"))
+	if err != nil {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	file, ok := b.file(formatEPUB)
+	if !ok {
+		renderError(w, "FORMAT_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	app.trackDownload(webHookData{
+		IPs:    getIPFromRequest(r),
+		User:   d.User,
+		Hash:   b.Hash,
+		Action: webHookDownload,
+		Format: formatKEPUB,
+	}, b, "kobo "+d.Name)
+	app.serveKepub(w, r, b, file)
+}
+
+// koboEmpty answers the store requests booksing has nothing for, like recommendations
+func (app *booksingApp) koboEmpty(w http.ResponseWriter, r *http.Request, d koboDevice) {
+	writeJSON(w, map[string]interface{}{})
+}
+
+func koboTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+func koboEntitlement(id string, b Book) map[string]interface{} {
+	added := koboTime(b.Added)
+	return map[string]interface{}{
+		"Accessibility":       "Full",
+		"ActivePeriod":        map[string]string{"From": added},
+		"Created":             added,
+		"CrossRevisionId":     id,
+		"Id":                  id,
+		"IsHiddenFromArchive": false,
+		"IsLocked":            false,
+		"IsRemoved":           false,
+		"LastModified":        added,
+		"OriginCategory":      "Imported",
+		"RevisionId":          id,
+		"Status":              "Active",
+	}
+}
+
+func koboReadingState(id string, b Book) map[string]interface{} {
+	added := koboTime(b.Added)
+	return map[string]interface{}{
+		"EntitlementId":     id,
+		"Created":           added,
+		"LastModified":      added,
+		"PriorityTimestamp": added,
+		"StatusInfo": map[string]interface{}{
+			"LastModified":        added,
+			"Status":              "ReadyToRead",
+			"TimesStartedReading": 0,
+		},
+		"Statistics":      map[string]string{"LastModified": added},
+		"CurrentBookmark": map[string]string{"LastModified": added},
+	}
+}
+
+func (app *booksingApp) koboMetadata(r *http.Request, d koboDevice, id string, b Book) map[string]interface{} {
+	file, _ := b.file(formatEPUB)
+	m := map[string]interface{}{
+		"Categories":              []string{"00000000-0000-0000-0000-000000000001"},
+		"CoverImageId":            id,
+		"CrossRevisionId":         id,
+		"CurrentDisplayPrice":     map[string]interface{}{"CurrencyCode": "USD", "TotalAmount": 0},
+		"CurrentLoveDisplayPrice": map[string]interface{}{"TotalAmount": 0},
+		"Description":             b.Description,
+		"DownloadUrls": []map[string]interface{}{{
+			"Format":   "KEPUB",
+			"Size":     file.Size,
+			"Url":      fmt.Sprintf("%s/kobo/%s/download/%s/kepub", baseURL(r), d.Token, id),
+			"Platform": "Generic",
+		}},
+		"EntitlementId":          id,
+		"ExternalIds":            []string{},
+		"Genre":                  "00000000-0000-0000-0000-000000000001",
+		"IsEligibleForKoboLove":  false,
+		"IsInternetArchive":      false,
+		"IsPreOrder":             false,
+		"IsSocialEnabled":        true,
+		"Language":               b.Language,
+		"PhoneticPronunciations": map[string]interface{}{},
+		"Publisher":              map[string]string{"Imprint": "", "Name": b.Publisher},
+		"RevisionId":             id,
+		"Title":                  b.Title,
+		"WorkId":                 id,
+		"ContributorRoles":       []map[string]string{{"Name": b.Author}},
+		"Contributors":           []string{b.Author},
+	}
+	if !b.PublishDate.IsZero() {
+		m["PublicationDate"] = koboTime(b.PublishDate)
+	}
+	if b.ISBN != "" {
+		m["Isbn"] = b.ISBN
+	}
+	if b.Series != "" {
+		m["Series"] = map[string]interface{}{
+			"Name":        b.Series,
+			"Number":      fmt.Sprintf("%g", b.SeriesIndex),
+			"NumberFloat": b.SeriesIndex,
+			"Id":          koboID("series:" + b.Series),
+		}
+	}
+	return m
+}
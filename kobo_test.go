@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKoboSyncToken(t *testing.T) {
+	token := koboSyncToken{Generation: "abc123"}
+	if got := decodeKoboSyncToken(encodeKoboSyncToken(token)); got != token {
+		t.Errorf("expected %+v after a round trip, got %+v", token, got)
+	}
+	for _, raw := range []string{"", "not base64!", "eyJvZmZzZXQiOjEwMH0="} {
+		if got := decodeKoboSyncToken(raw); got.Generation != "" {
+			t.Errorf("expected %q to decode to an empty token, got %+v", raw, got)
+		}
+	}
+}
+
+func TestKoboSync(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub", "pg345.epub")
+	d := koboDevice{ID: "device", Token: "token", User: "alice", Name: "libra"}
+
+	var token string
+	sync := func(withToken bool) map[string][]map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/kobo/device/v1/library/sync", nil)
+		if withToken {
+			req.Header.Set("X-Kobo-SyncToken", token)
+		}
+		rec := httptest.NewRecorder()
+		app.koboSync(rec, req, d)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected sync to succeed, got %d", rec.Code)
+		}
+		if rec.Header().Get("X-Kobo-Sync") != "" {
+			t.Errorf("expected everything in a single page")
+		}
+		token = rec.Header().Get("X-Kobo-SyncToken")
+		var res []map[string]map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		changes := map[string][]map[string]interface{}{}
+		for _, e := range res {
+			for kind, v := range e {
+				changes[kind] = append(changes[kind], v["BookEntitlement"].(map[string]interface{}))
+			}
+		}
+		return changes
+	}
+	count := func(changes map[string][]map[string]interface{}, newBooks, changed int) {
+		t.Helper()
+		if len(changes["NewEntitlement"]) != newBooks || len(changes["ChangedEntitlement"]) != changed {
+			t.Errorf("expected %d new and %d changed books, got %d and %d", newBooks, changed,
+				len(changes["NewEntitlement"]), len(changes["ChangedEntitlement"]))
+		}
+	}
+
+	count(sync(false), 2, 0)
+	count(sync(true), 0, 0)
+
+	// books imported with an old date are still new to the device
+	importTestBooks(t, app, "pg174.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 10, Sort: []SortOrder{{Field: "Added", Descending: true}}})
+	if err != nil || len(res.Items) != 3 {
+		t.Fatalf("expected 3 books, got %v (%v)", res, err)
+	}
+	old := res.Items[0]
+	old.Added = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := app.searchDB.AddBooks([]Book{old}); err != nil {
+		t.Fatal(err)
+	}
+	changes := sync(true)
+	count(changes, 1, 0)
+	if id := koboID(old.Hash); len(changes["NewEntitlement"]) == 1 && changes["NewEntitlement"][0]["Id"] != id {
+		t.Errorf("expected the old book %s to be synced, got %v", id, changes["NewEntitlement"][0]["Id"])
+	}
+
+	// edits are sent as changes
+	description := "Edited"
+	if _, err := app.updateBook(res.Items[1].Hash, bookUpdate{Description: &description}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	count(sync(true), 0, 1)
+
+	// deleted books are removed from the device
+	if err := app.deleteBook(res.Items[2].Hash, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	changes = sync(true)
+	count(changes, 0, 1)
+	if len(changes["ChangedEntitlement"]) == 1 {
+		e := changes["ChangedEntitlement"][0]
+		if e["Id"] != koboID(res.Items[2].Hash) || e["IsRemoved"] != true {
+			t.Errorf("expected the deleted book to be removed, got %v", e)
+		}
+	}
+	count(sync(true), 0, 0)
+
+	// a device without a token, like after a reset, gets the whole library again
+	count(sync(false), 2, 0)
+}
+
+func TestKoboDeviceOfDeletedUser(t *testing.T) {
+	app := newTestApp(t)
+	if err := app.addUser("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/kobo/devices", strings.NewReader(`{"name":"libra"}`))
+	rec := httptest.NewRecorder()
+	app.addKoboDevice(rec, req.WithContext(withUser(req.Context(), "alice")))
+	var d koboDeviceResponse
+	if err := json.NewDecoder(rec.Body).Decode(&d); err != nil || !d.Local {
+		t.Fatalf("expected a device of a local user, got %+v (%v)", d, err)
+	}
+	if err := app.store.put(koboSyncedBucket, d.ID, koboSyncState{Generation: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	// like api tokens only the hash of the token is stored
+	var stored koboDevice
+	if err := app.store.get(koboDevicesBucket, d.Token, &stored); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the token not to be stored, got %v", err)
+	}
+	if err := app.store.get(koboDevicesBucket, hashToken(d.Token), &stored); err != nil || stored.Token != "" {
+		t.Errorf("expected the device under the hash of its token, got %+v (%v)", stored, err)
+	}
+
+	handler := app.koboAuth(func(w http.ResponseWriter, r *http.Request, d koboDevice) {})
+	auth := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/kobo/"+token+"/v1/initialization", nil)
+		req.SetPathValue("token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	if code := auth(d.Token); code != http.StatusOK {
+		t.Fatalf("expected the device to be accepted, got %d", code)
+	}
+
+	// a device that is stored again after the user was removed, like by a sync that was running, is refused too
+	if err := app.deleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var state koboSyncState
+	if err := app.store.get(koboSyncedBucket, d.ID, &state); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the sync state to be removed, got %v", err)
+	}
+	if code := auth(d.Token); code != http.StatusUnauthorized {
+		t.Errorf("expected the device of a removed user to be refused, got %d", code)
+	}
+	if err := app.store.put(koboDevicesBucket, hashToken(d.Token), stored); err != nil {
+		t.Fatal(err)
+	}
+	if code := auth(d.Token); code != http.StatusUnauthorized {
+		t.Errorf("expected a leftover device of a removed user to be refused, got %d", code)
+	}
+}
+
+func TestKoboDevices(t *testing.T) {
+	app := newTestApp(t)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(withUser(req.Context(), "alice"))
+		if id, ok := strings.CutPrefix(target, "/api/kobo/devices/"); ok {
+			req.SetPathValue("id", id)
+		}
+		rec := httptest.NewRecorder()
+		switch method {
+		case http.MethodPost:
+			app.addKoboDevice(rec, req)
+		case http.MethodGet:
+			app.listKoboDevices(rec, req)
+		case http.MethodDelete:
+			app.deleteKoboDevice(rec, req)
+		}
+		return rec
+	}
+
+	var created koboDeviceResponse
+	if err := json.NewDecoder(do(http.MethodPost, "/api/kobo/devices", `{"name":"libra"}`).Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || !strings.HasSuffix(created.Endpoint, "/kobo/"+created.Token) {
+		t.Fatalf("expected the token and endpoint in the response, got %+v", created)
+	}
+
+	var listed []koboDevice
+	if err := json.NewDecoder(do(http.MethodGet, "/api/kobo/devices", "").Body).Decode(&listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].ID != created.ID || listed[0].Token != "" {
+		t.Errorf("expected the device to be listed without its token, got %+v", listed)
+	}
+
+	if rec := do(http.MethodDelete, "/api/kobo/devices/"+created.Token, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected devices to be removed by id, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/api/kobo/devices/"+created.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("expected the device to be removed, got %d", rec.Code)
+	}
+	var d koboDevice
+	if err := app.store.get(koboDevicesBucket, hashToken(created.Token), &d); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected the device to be gone, got %v", err)
+	}
+}
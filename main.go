@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -13,18 +14,44 @@ import (
 )
 
 type configuration struct {
-	AcceptedLanguages []string `default:""`
-	BindAddress       string   `default:":7132"`
-	MeiliAddress      string   `default:"http://localhost:7700"`
-	MeiliIndex        string   `default:"booksing"`
-	MeiliSecret       string   `default:""`
-	BookDir           string   `default:"./books/"`
-	FailDir           string   `default:"./failed"`
-	ImportDir         string   `default:"./import"`
-	LogLevel          string   `default:"info"`
-	MaxSize           int64    `default:"0"`
-	Timezone          string   `default:"Europe/Amsterdam"`
-	WebHookURL        string   `default:""`
+	AcceptedLanguages []string      `default:""`
+	Admins            []string      `default:""`
+	DefaultRole       string        `default:"reader"`
+	Librarians        []string      `default:""`
+	Uploaders         []string      `default:""`
+	AllowAnonymous    bool          `default:"false"`
+	AuthProviders     []string      `default:""`
+	BindAddress       string        `default:":7132"`
+	CacheDir          string        `default:"./cache"`
+	SearchBackend     string        `default:"meili"`
+	DatabaseDir       string        `default:"./db"`
+	DuplicateDir      string        `default:"./duplicates"`
+	DownloadRetention time.Duration `default:"8760h"`
+	MeiliAddress      string        `default:"http://localhost:7700"`
+	MeiliIndex        string        `default:"booksing"`
+	MeiliSecret       string        `default:""`
+	BookDir           string        `default:"./books/"`
+	FailDir           string        `default:"./failed"`
+	ImportDir         string        `default:"./import"`
+	LogLevel          string        `default:"info"`
+	MaxSize           int64         `default:"0"`
+	OIDCAudience      string        `default:""`
+	OIDCClaims        []string      `default:"email,common_name"`
+	OIDCHeader        string        `default:"Cf-Access-Jwt-Assertion"`
+	OIDCIssuer        string        `default:""`
+	OIDCJWKSURL       string        `default:""`
+	OIDCSkipAudience  bool          `default:"false"`
+	ScanInterval      time.Duration `default:"1h"`
+	SendMaxSize       int64         `default:"52428800"`
+	SessionDuration   time.Duration `default:"720h"`
+	SMTPAddress       string        `default:""`
+	SMTPFrom          string        `default:""`
+	SMTPPassword      string        `default:""`
+	SMTPUser          string        `default:""`
+	Timezone          string        `default:"Europe/Amsterdam"`
+	TrashDir          string        `default:""`
+	WatchDelay        time.Duration `default:"2s"`
+	WebHookURL        string        `default:""`
 }
 
 func main() {
@@ -37,14 +64,20 @@ func main() {
 
 	slog.Info("Starting booksing")
 
-	var search searchDB
-	search, err = NewMeiliSearch(cfg.MeiliAddress, cfg.MeiliSecret, cfg.MeiliIndex)
+	// the store is opened first, it fails after a timeout when another booksing is running while the
+	// embedded search index would wait for its lock forever
+	db, err := newStore(cfg.DatabaseDir)
 	if err != nil {
-		slog.Error("could not create meili search", "err", err)
+		slog.Error("could not open database", "dir", cfg.DatabaseDir, "err", err)
 		return
 	}
+	defer db.Close()
 
-	slog.Info("Started meili integration")
+	search, err := newSearchDB(cfg)
+	if err != nil {
+		slog.Error("could not create search backend", "backend", cfg.SearchBackend, "err", err)
+		return
+	}
 
 	tz, err := time.LoadLocation(cfg.Timezone)
 	if err != nil {
@@ -54,18 +87,66 @@ func main() {
 
 	slog.Info("Loaded timezone")
 
+	for _, p := range cfg.AuthProviders {
+		if !contains(authProviders, p) {
+			slog.Error("unknown auth provider", "provider", p, "supported", authProviders)
+			return
+		}
+	}
+
+	if !contains(roles, cfg.DefaultRole) {
+		slog.Error("unknown default role", "role", cfg.DefaultRole, "supported", roles)
+		return
+	}
+
+	var verifier *oidcVerifier
+	if contains(cfg.AuthProviders, providerOIDC) {
+		verifier, err = newOIDCVerifier(context.Background(), cfg)
+		if err != nil {
+			slog.Error("could not set up oidc", "err", err)
+			return
+		}
+		slog.Info("Verifying identity tokens", "issuer", cfg.OIDCIssuer, "header", cfg.OIDCHeader)
+	}
+
 	app := booksingApp{
-		searchDB:    search,
-		bookDir:     cfg.BookDir,
-		importDir:   cfg.ImportDir,
-		timezone:    tz,
-		cfg:         cfg,
-		refreshChan: make(chan bool),
+		searchDB:  search,
+		store:     db,
+		bookDir:   cfg.BookDir,
+		importDir: cfg.ImportDir,
+		timezone:  tz,
+		cfg:       cfg,
+		oidc:      verifier,
 	}
 
+	if len(os.Args) > 1 {
+		err = app.runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			slog.Error("command failed", "command", os.Args[1], "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = app.migrateSearchIndex()
+	if err != nil {
+		slog.Error("unable to update the search index, sorting and filtering can skip books until booksing rebuild is run", "err", err)
+	}
+
+	go func() {
+		err := app.resumeUploads()
+		if err != nil {
+			slog.Error("unable to resume uploads", "err", err)
+		}
+	}()
+
 	if cfg.ImportDir != "" {
-		slog.Info("Starting refresh loop", "importDir", cfg.ImportDir)
+		slog.Info("Starting refresh loop", "importDir", cfg.ImportDir, "scanInterval", cfg.ScanInterval)
 		go app.refreshLoop()
+		_, err = app.watchImportDir()
+		if err != nil {
+			slog.Warn("unable to watch import dir, only periodic scans are used", "err", err)
+		}
 	}
 
 	if cfg.WebHookURL != "" {
@@ -82,11 +163,80 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_nuxt/", static)
 	mux.HandleFunc("/book.png", bookPNG)
+	mux.HandleFunc("POST /api/login", app.login)
+	mux.HandleFunc("POST /api/logout", app.logout)
+	mux.HandleFunc("GET /api/me", app.me)
+	mux.HandleFunc("PUT /api/me/password", app.changePassword)
+	mux.HandleFunc("GET /api/me/downloads", app.myDownloads)
+	mux.HandleFunc("GET /api/stats/downloads", app.requireRole(roleAdmin, app.downloadStatsAPI))
+	mux.HandleFunc("GET /api/tokens", requireUser(app.listTokens))
+	mux.HandleFunc("POST /api/tokens", requireUser(app.addToken))
+	mux.HandleFunc("DELETE /api/tokens/{id}", requireUser(app.deleteToken))
+	mux.HandleFunc("GET /api/users", app.requireRole(roleAdmin, app.listUsers))
+	mux.HandleFunc("POST /api/users", app.requireRole(roleAdmin, app.addUserAPI))
+	mux.HandleFunc("DELETE /api/users/{name}", app.requireRole(roleAdmin, app.deleteUserAPI))
+	mux.HandleFunc("GET /api/roles", app.requireRole(roleAdmin, app.listRoles))
+	mux.HandleFunc("PUT /api/users/{name}/role", app.requireRole(roleAdmin, app.setRoleAPI))
 	mux.HandleFunc("/api/count", app.count)
 	mux.HandleFunc("/api/cover", app.getCover)
 	mux.HandleFunc("/api/download", app.downloadBook)
 	mux.HandleFunc("/api/search", app.searchAPI)
-	mux.HandleFunc("/api/add", app.addBook)
+	mux.HandleFunc("POST /api/add", app.requireRole(roleUploader, app.addBook))
+	mux.HandleFunc("GET /api/imports", app.listImports)
+	mux.HandleFunc("GET /api/imports/{id}", app.getImport)
+	mux.HandleFunc("POST /api/send", requireUser(app.sendBookAPI))
+	mux.HandleFunc("GET /api/devices", requireUser(app.listDevices))
+	mux.HandleFunc("PUT /api/devices", requireUser(app.saveDevices))
+	mux.HandleFunc("PUT /api/book", app.requireRole(roleLibrarian, app.updateBookAPI))
+	mux.HandleFunc("DELETE /api/book", app.requireRole(roleLibrarian, app.deleteBookAPI))
+	mux.HandleFunc("GET /api/duplicates", app.requireRole(roleLibrarian, app.listDuplicates))
+	mux.HandleFunc("GET /api/duplicates/{id}/cover", app.requireRole(roleLibrarian, app.getDuplicateCover))
+	mux.HandleFunc("POST /api/duplicates/{id}/resolve", app.requireRole(roleLibrarian, app.resolveDuplicateAPI))
+	mux.HandleFunc("GET /api/failed", app.requireRole(roleLibrarian, app.listFailed))
+	mux.HandleFunc("POST /api/failed/{name}/retry", app.requireRole(roleLibrarian, app.retryFailedAPI))
+	mux.HandleFunc("DELETE /api/failed/{name}", app.requireRole(roleLibrarian, app.deleteFailedAPI))
+	mux.HandleFunc("GET /api/fsck", app.requireRole(roleAdmin, app.fsckAPI))
+	mux.HandleFunc("POST /api/fsck", app.requireRole(roleAdmin, app.fsckAPI))
+	mux.HandleFunc("POST /api/rebuild", app.requireRole(roleAdmin, app.rebuildAPI))
+	mux.HandleFunc("/api/series", app.listSeries)
+	mux.HandleFunc("/api/series/{name}", app.getSeries)
+	mux.HandleFunc("/api/authors", app.listAuthors)
+	mux.HandleFunc("POST /api/authors/merge", app.requireRole(roleLibrarian, app.mergeAuthors))
+	mux.HandleFunc("GET /api/shelves", app.listShelves)
+	mux.HandleFunc("POST /api/shelves", app.addShelf)
+	mux.HandleFunc("GET /api/shelves/{id}", app.getShelfAPI)
+	mux.HandleFunc("PUT /api/shelves/{id}", app.renameShelf)
+	mux.HandleFunc("DELETE /api/shelves/{id}", app.deleteShelf)
+	mux.HandleFunc("POST /api/shelves/{id}/books", app.addToShelf)
+	mux.HandleFunc("PUT /api/shelves/{id}/books", app.reorderShelf)
+	mux.HandleFunc("DELETE /api/shelves/{id}/books/{hash}", app.removeFromShelf)
+	mux.HandleFunc("POST /api/shelves/{id}/share", app.shareShelf)
+	mux.HandleFunc("DELETE /api/shelves/{id}/share", app.unshareShelf)
+	mux.HandleFunc("GET /api/shared/{token}", app.getSharedShelf)
+	mux.HandleFunc("GET /api/shared/{token}/download", app.sharedDownload)
+	mux.HandleFunc("GET /api/shared/{token}/cover", app.sharedCover)
+	mux.HandleFunc("GET /api/kobo/devices", requireUser(app.listKoboDevices))
+	mux.HandleFunc("POST /api/kobo/devices", requireUser(app.addKoboDevice))
+	mux.HandleFunc("DELETE /api/kobo/devices/{id}", requireUser(app.deleteKoboDevice))
+	mux.HandleFunc("POST /kobo/{token}/v1/auth/device", app.koboAuth(app.koboAuthDevice))
+	mux.HandleFunc("GET /kobo/{token}/v1/initialization", app.koboAuth(app.koboInitialization))
+	mux.HandleFunc("GET /kobo/{token}/v1/library/sync", app.koboAuth(app.koboSync))
+	mux.HandleFunc("GET /kobo/{token}/v1/library/{id}/metadata", app.koboAuth(app.koboMetadataAPI))
+	mux.HandleFunc("PUT /kobo/{token}/v1/library/{id}/state", app.koboAuth(app.koboState))
+	mux.HandleFunc("GET /kobo/{token}/{id}/{width}/{height}/{grey}/image.jpg", app.koboAuth(app.koboCover))
+	mux.HandleFunc("GET /kobo/{token}/{id}/{width}/{height}/{quality}/{grey}/image.jpg", app.koboAuth(app.koboCover))
+	mux.HandleFunc("GET /kobo/{token}/download/{id}/{format}", app.koboAuth(app.koboDownload))
+	mux.HandleFunc("/kobo/{token}/", app.koboAuth(app.koboEmpty))
+	mux.HandleFunc("/opds", app.opdsRoot)
+	mux.HandleFunc("/opds/new", app.opdsNew)
+	mux.HandleFunc("/opds/search", app.opdsSearch)
+	mux.HandleFunc("/opds/opensearch.xml", app.opdsOpenSearch)
+	mux.HandleFunc("/opds/authors", app.opdsAuthors)
+	mux.HandleFunc("/opds/series", app.opdsSeries)
+	mux.HandleFunc("/opds/languages", app.opdsLanguages)
+	mux.HandleFunc("/opds/shelves", app.opdsShelves)
+	mux.HandleFunc("/opds/shelves/{id}", app.opdsShelf)
+	mux.HandleFunc("/opds/shared/{token}", app.opdsSharedShelf)
 	mux.HandleFunc("/", index)
 
 	if port == "" {
@@ -96,26 +246,46 @@ func main() {
 	}
 	slog.Info("booksing will now start listening", "port", port)
 
-	err = http.ListenAndServe(port, mux)
+	err = http.ListenAndServe(port, app.authenticate(mux))
 	if err != nil {
 		slog.Error("unable to start running", "err", err)
 	}
 }
 
-func (app *booksingApp) keepBook(b *Book) bool {
-	if b == nil {
-		return false
+func newSearchDB(cfg configuration) (searchDB, error) {
+	switch cfg.SearchBackend {
+	case "meili":
+		search, err := NewMeiliSearch(cfg.MeiliAddress, cfg.MeiliSecret, cfg.MeiliIndex)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Started meili integration")
+		return search, nil
+	case "local":
+		search, err := NewBleveSearch(cfg.DatabaseDir)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Opened local search index")
+		return search, nil
+	case "memory":
+		slog.Warn("Using in-memory search, the index will be lost on restart")
+		return NewMemorySearch(), nil
 	}
+	return nil, fmt.Errorf("unknown search backend %q", cfg.SearchBackend)
+}
 
+// rejectBook returns why the book is not imported, the reason is empty for books that are kept
+func (app *booksingApp) rejectBook(b *Book) (string, error) {
 	if app.cfg.MaxSize > 0 && b.Size > app.cfg.MaxSize {
-		return false
+		return failedSize, fmt.Errorf("size of %d bytes is larger than the maximum of %d", b.Size, app.cfg.MaxSize)
 	}
 
-	if len(app.cfg.AcceptedLanguages) > 0 {
-		return contains(app.cfg.AcceptedLanguages, b.Language)
+	if len(app.cfg.AcceptedLanguages) > 0 && !contains(app.cfg.AcceptedLanguages, b.Language) {
+		return failedLanguage, fmt.Errorf("language %q is not accepted", b.Language)
 	}
 
-	return true
+	return "", nil
 }
 
 func contains(haystack []string, needle string) bool {
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/meilisearch/meilisearch-go"
@@ -12,8 +15,31 @@ import (
 type meiliDB struct {
 	db    *meilisearch.Client
 	index *meilisearch.Index
+	name  string
 }
 
+// meiliBook adds fields that are only needed to filter and sort in meili, dates are stored as strings
+// so they can not be used in range filters and do not sort correctly across timezones
+type meiliBook struct {
+	Book
+	PublishUnix int64
+	AddedUnix   int64
+}
+
+// meiliSortFields maps the sort fields to the attributes meili sorts on
+var meiliSortFields = map[string]string{
+	"Added":       "AddedUnix",
+	"Title":       "Title",
+	"Author":      "Author",
+	"Series":      "Series",
+	"SeriesIndex": "SeriesIndex",
+	"PublishDate": "PublishUnix",
+}
+
+// meiliMaxTotalHits replaces the default of 1000, meili never returns hits past it so paging through
+// all books would silently stop there
+const meiliMaxTotalHits = 1000000
+
 var stopWords = []string{"de", "het", "een", "the", "a", "an", "of", "and", "or", "in", "to", "for", "on", "at", "by"}
 
 func NewMeiliSearch(host, key, indexName string) (*meiliDB, error) {
@@ -24,9 +50,24 @@ func NewMeiliSearch(host, key, indexName string) (*meiliDB, error) {
 		//APIKey: key,
 	})
 
+	db := &meiliDB{
+		db:   client,
+		name: indexName,
+	}
+	index, err := db.setupIndex(indexName)
+	if err != nil {
+		return nil, err
+	}
+	db.index = index
+
+	return db, nil
+}
+
+// setupIndex creates the index if needed and applies the settings booksing depends on
+func (db *meiliDB) setupIndex(indexName string) (*meilisearch.Index, error) {
 	slog.Info("Creating meili search index", "index", indexName)
-	index := client.Index(indexName)
-	state, err := client.CreateIndex(&meilisearch.IndexConfig{
+	index := db.db.Index(indexName)
+	state, err := db.db.CreateIndex(&meilisearch.IndexConfig{
 		Uid:        indexName,
 		PrimaryKey: "Hash",
 	})
@@ -37,7 +78,7 @@ func NewMeiliSearch(host, key, indexName string) (*meiliDB, error) {
 
 	for {
 		slog.Info("Waiting for index to be created")
-		t, err := client.GetTask(state.TaskUID)
+		t, err := db.db.GetTask(state.TaskUID)
 		if err != nil {
 			return nil, fmt.Errorf("unable to retrieve meili task status: %w", err)
 		}
@@ -67,10 +108,81 @@ func NewMeiliSearch(host, key, indexName string) (*meiliDB, error) {
 		}
 	}
 
-	return &meiliDB{
-		db:    client,
-		index: index,
-	}, nil
+	err = db.ensureAttributes("filterable", append(slices.Clone(facetFields), "ISBN", "PublishUnix"),
+		index.GetFilterableAttributes, index.UpdateFilterableAttributes)
+	if err != nil {
+		slog.Warn("Failed to update filterable attributes", "err", err)
+		return nil, err
+	}
+
+	var sortable []string
+	for _, attr := range meiliSortFields {
+		sortable = append(sortable, attr)
+	}
+	err = db.ensureAttributes("sortable", sortable, index.GetSortableAttributes, index.UpdateSortableAttributes)
+	if err != nil {
+		slog.Warn("Failed to update sortable attributes", "err", err)
+		return nil, err
+	}
+
+	faceting, err := index.GetFaceting()
+	if err != nil {
+		slog.Warn("Failed to get faceting settings", "err", err)
+		return nil, err
+	}
+	if faceting.MaxValuesPerFacet != maxFacetValues {
+		slog.Info("updating faceting in database", "current", faceting.MaxValuesPerFacet, "new", maxFacetValues)
+		task, err := index.UpdateFaceting(&meilisearch.Faceting{MaxValuesPerFacet: maxFacetValues})
+		if err == nil {
+			err = db.waitForTask(task)
+		}
+		if err != nil {
+			slog.Warn("Failed to update faceting", "err", err)
+			return nil, err
+		}
+	}
+
+	pagination, err := index.GetPagination()
+	if err != nil {
+		slog.Warn("Failed to get pagination settings", "err", err)
+		return nil, err
+	}
+	if pagination.MaxTotalHits < meiliMaxTotalHits {
+		slog.Info("updating pagination in database", "current", pagination.MaxTotalHits, "new", meiliMaxTotalHits)
+		task, err := index.UpdatePagination(&meilisearch.Pagination{MaxTotalHits: meiliMaxTotalHits})
+		if err == nil {
+			err = db.waitForTask(task)
+		}
+		if err != nil {
+			slog.Warn("Failed to update pagination", "err", err)
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+// ensureAttributes only updates an attribute setting when it changed, because meili reindexes on every update
+func (db *meiliDB) ensureAttributes(kind string, attrs []string, get func() (*[]string, error), update func(*[]string) (*meilisearch.TaskInfo, error)) error {
+	cur, err := get()
+	if err != nil {
+		return err
+	}
+	slices.Sort(attrs)
+	if cur != nil {
+		slices.Sort(*cur)
+		if slices.Equal(*cur, attrs) {
+			slog.Info("Attributes are already set", "kind", kind)
+			return nil
+		}
+	}
+
+	slog.Info("updating attributes in database", "kind", kind, "current", cur, "new", attrs)
+	task, err := update(&attrs)
+	if err != nil {
+		return err
+	}
+	return db.waitForTask(task)
 }
 
 func (db *meiliDB) GetBookCount() int {
@@ -82,39 +194,114 @@ func (db *meiliDB) GetBookCount() int {
 }
 
 func (db *meiliDB) HasHash(h string) (bool, error) {
-	var doc Book
-	err := db.index.GetDocument(h, nil, &doc)
-	if doc.Hash == h {
-		return true, nil
+	_, err := db.GetBook(h)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
 	}
-	return false, err
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (db *meiliDB) GetBook(h string) (*Book, error) {
 	var b Book
 	err := db.index.GetDocument(h, nil, &b)
-	return &b, err
+	var meiliErr *meilisearch.Error
+	if errors.As(err, &meiliErr) && meiliErr.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
 }
 
 func (db *meiliDB) AddBooks(books []Book) error {
-	//TODO: do something with task info or ignore?
-	_, err := db.index.AddDocuments(books)
-	return err
+	docs := make([]meiliBook, len(books))
+	for i, b := range books {
+		docs[i] = meiliBook{
+			Book:        b,
+			PublishUnix: b.PublishDate.Unix(),
+			AddedUnix:   b.Added.Unix(),
+		}
+	}
+	task, err := db.index.AddDocuments(docs)
+	if err != nil {
+		return err
+	}
+	return db.waitForTask(task)
 }
 
 func (db *meiliDB) DeleteBook(hash string) error {
-	//TODO: do something with task info or ignore?
-	_, err := db.index.DeleteDocument(hash)
-	return err
+	task, err := db.index.DeleteDocument(hash)
+	if err != nil {
+		return err
+	}
+	return db.waitForTask(task)
 }
 
-func (db *meiliDB) GetBooks(q string, limit, offset int64) (*SearchResult, error) {
+// Rebuild fills a second index with the same settings and swaps it with the live index when it is complete,
+// the old documents end up in the second index which is then removed
+func (db *meiliDB) Rebuild(fill func(add func([]Book) error) error) error {
+	tmpName := db.name + "_rebuild"
+	// a previous rebuild might have been interrupted, a missing index only fails the task
+	if task, err := db.db.DeleteIndex(tmpName); err == nil {
+		_, _ = db.db.WaitForTask(task.TaskUID)
+	}
+
+	tmp, err := db.setupIndex(tmpName)
+	if err != nil {
+		return err
+	}
+	staging := &meiliDB{
+		db:    db.db,
+		index: tmp,
+		name:  tmpName,
+	}
+	err = fill(staging.AddBooks)
+	if err != nil {
+		return err
+	}
+
+	task, err := db.db.SwapIndexes([]meilisearch.SwapIndexesParams{{Indexes: []string{db.name, tmpName}}})
+	if err != nil {
+		return err
+	}
+	err = db.waitForTask(task)
+	if err != nil {
+		return err
+	}
+
+	task, err = db.db.DeleteIndex(tmpName)
+	if err != nil {
+		return err
+	}
+	return db.waitForTask(task)
+}
+
+// waitForTask blocks until meili has processed the task so changes are visible to the next read
+func (db *meiliDB) waitForTask(task *meilisearch.TaskInfo) error {
+	t, err := db.db.WaitForTask(task.TaskUID)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve meili task status: %w", err)
+	}
+	if t.Status == meilisearch.TaskStatusFailed {
+		return fmt.Errorf("meili task failed: %s", t.Error.Message)
+	}
+	return nil
+}
+
+func (db *meiliDB) GetBooks(q SearchQuery) (*SearchResult, error) {
 
 	var books []Book
 
-	resp, err := db.index.Search(q, &meilisearch.SearchRequest{
-		Limit:  limit,
-		Offset: offset,
+	resp, err := db.index.Search(q.Query, &meilisearch.SearchRequest{
+		Limit:  q.Limit,
+		Offset: q.Offset,
+		Filter: meiliFilter(q.Filter),
+		Facets: q.Facets,
+		Sort:   meiliSort(q.Sort),
 	})
 	if err != nil {
 		return nil, err
@@ -124,12 +311,69 @@ func (db *meiliDB) GetBooks(q string, limit, offset int64) (*SearchResult, error
 		book, err := parseResult(hit)
 		if err != nil {
 			slog.Warn("Failed to decode book", "err", err)
+			continue
 		}
 		books = append(books, *book)
 	}
 
 	return &SearchResult{
-		Items: books,
-		Total: resp.EstimatedTotalHits,
+		Items:  books,
+		Total:  resp.EstimatedTotalHits,
+		Facets: parseFacets(resp.FacetDistribution),
 	}, nil
 }
+
+func meiliFilter(f SearchFilter) []string {
+	var filters []string
+	for field, val := range map[string]string{
+		"Language":  f.Language,
+		"Author":    f.Author,
+		"Series":    f.Series,
+		"Publisher": f.Publisher,
+		"ISBN":      f.ISBN,
+	} {
+		if val != "" {
+			filters = append(filters, fmt.Sprintf("%s = %q", field, val))
+		}
+	}
+	if !f.PublishedAfter.IsZero() {
+		filters = append(filters, fmt.Sprintf("PublishUnix >= %d", f.PublishedAfter.Unix()))
+	}
+	if !f.PublishedBefore.IsZero() {
+		filters = append(filters, fmt.Sprintf("PublishUnix <= %d", f.PublishedBefore.Unix()))
+	}
+	return filters
+}
+
+func meiliSort(order []SortOrder) []string {
+	var sort []string
+	for _, s := range order {
+		dir := "asc"
+		if s.Descending {
+			dir = "desc"
+		}
+		sort = append(sort, meiliSortFields[s.Field]+":"+dir)
+	}
+	return sort
+}
+
+func parseFacets(dist interface{}) map[string]map[string]int64 {
+	fields, ok := dist.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	facets := make(map[string]map[string]int64)
+	for field, values := range fields {
+		counts, ok := values.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		facets[field] = make(map[string]int64)
+		for val, c := range counts {
+			if n, ok := c.(float64); ok && strings.TrimSpace(val) != "" {
+				facets[field][val] = int64(n)
+			}
+		}
+	}
+	return facets
+}
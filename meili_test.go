@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMeili is a stand-in for the parts of the meili api booksing uses. Like meili it stops returning
+// search hits after pagination.maxTotalHits, which defaults to 1000.
+type fakeMeili struct {
+	mu       sync.Mutex
+	settings map[string]json.RawMessage
+	docs     map[string]json.RawMessage
+}
+
+func newFakeMeili(t *testing.T) *httptest.Server {
+	f := &fakeMeili{
+		settings: map[string]json.RawMessage{
+			"stop-words":            json.RawMessage(`[]`),
+			"filterable-attributes": json.RawMessage(`[]`),
+			"sortable-attributes":   json.RawMessage(`[]`),
+			"faceting":              json.RawMessage(`{"maxValuesPerFacet":100}`),
+			"pagination":            json.RawMessage(`{"maxTotalHits":1000}`),
+		},
+		docs: map[string]json.RawMessage{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeMeili) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	task := func() {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"taskUid":1,"status":"enqueued"}`)
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/indexes" && r.Method == http.MethodPost:
+		task()
+	case parts[0] == "tasks":
+		fmt.Fprintf(w, `{"uid":%s,"status":"succeeded"}`, parts[1])
+	case len(parts) == 4 && parts[2] == "settings":
+		if r.Method == http.MethodGet {
+			w.Write(f.settings[parts[3]])
+			return
+		}
+		var v json.RawMessage
+		json.NewDecoder(r.Body).Decode(&v)
+		f.settings[parts[3]] = v
+		task()
+	case len(parts) == 3 && parts[2] == "documents" && r.Method == http.MethodPost:
+		var docs []map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&docs)
+		for _, d := range docs {
+			var hash string
+			json.Unmarshal(d["Hash"], &hash)
+			f.docs[hash], _ = json.Marshal(d)
+		}
+		task()
+	case len(parts) == 3 && parts[2] == "stats":
+		fmt.Fprintf(w, `{"numberOfDocuments":%d}`, len(f.docs))
+	case len(parts) == 3 && parts[2] == "search":
+		var req struct {
+			Limit  int `json:"limit"`
+			Offset int `json:"offset"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var pagination struct {
+			MaxTotalHits int `json:"maxTotalHits"`
+		}
+		json.Unmarshal(f.settings["pagination"], &pagination)
+
+		var hashes []string
+		for h := range f.docs {
+			hashes = append(hashes, h)
+		}
+		slices.Sort(hashes)
+		hashes = hashes[:min(len(hashes), pagination.MaxTotalHits)]
+		hits := []json.RawMessage{}
+		for _, h := range hashes[min(req.Offset, len(hashes)):min(req.Offset+req.Limit, len(hashes))] {
+			hits = append(hits, f.docs[h])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"hits":               hits,
+			"estimatedTotalHits": len(hashes),
+			"limit":              req.Limit,
+			"offset":             req.Offset,
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMeiliAllBooksPastMaxTotalHits(t *testing.T) {
+	srv := newFakeMeili(t)
+	db, err := NewMeiliSearch(srv.URL, "", "books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var books []Book
+	for i := range 1500 {
+		books = append(books, testBook(fmt.Sprintf("book%04d", i), fmt.Sprintf("Title %d", i), "Author"))
+	}
+	if err := db.AddBooks(books); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &booksingApp{searchDB: db}
+	all, err := app.allBooks(SearchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(books) {
+		t.Errorf("expected all %d books, got %d", len(books), len(all))
+	}
+}
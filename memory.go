@@ -0,0 +1,196 @@
+package main
+
+import (
+	"cmp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryDB is a searchDB that only lives in memory, useful for tests and trying out booksing
+type memoryDB struct {
+	mu    sync.RWMutex
+	books map[string]Book
+}
+
+// NewMemorySearch creates an empty in-memory searchDB
+func NewMemorySearch() *memoryDB {
+	return &memoryDB{
+		books: make(map[string]Book),
+	}
+}
+
+func (db *memoryDB) GetBookCount() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.books)
+}
+
+func (db *memoryDB) HasHash(h string) (bool, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.books[h]
+	return ok, nil
+}
+
+func (db *memoryDB) GetBook(h string) (*Book, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	b, ok := db.books[h]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &b, nil
+}
+
+func (db *memoryDB) AddBooks(books []Book) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, b := range books {
+		db.books[b.Hash] = b
+	}
+	return nil
+}
+
+func (db *memoryDB) DeleteBook(hash string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.books, hash)
+	return nil
+}
+
+// Rebuild fills a new map and only replaces the current books when it is complete
+func (db *memoryDB) Rebuild(fill func(add func([]Book) error) error) error {
+	staging := NewMemorySearch()
+	err := fill(staging.AddBooks)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.books = staging.books
+	return nil
+}
+
+func (db *memoryDB) GetBooks(q SearchQuery) (*SearchResult, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(q.Query)) {
+		if !contains(stopWords, w) {
+			words = append(words, w)
+		}
+	}
+
+	var hits []Book
+	for _, b := range db.books {
+		if matchesWords(b, words) && matchesFilter(b, q.Filter) {
+			hits = append(hits, b)
+		}
+	}
+
+	order := q.Sort
+	if len(order) == 0 {
+		order = []SortOrder{{Field: "Title"}}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		for _, o := range order {
+			c := compareField(hits[i], hits[j], o.Field)
+			if c == 0 {
+				continue
+			}
+			if o.Descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return hits[i].Hash < hits[j].Hash
+	})
+
+	res := &SearchResult{
+		Items: append([]Book{}, page(hits, q.Limit, q.Offset)...),
+		Total: int64(len(hits)),
+	}
+
+	if len(q.Facets) > 0 {
+		res.Facets = make(map[string]map[string]int64)
+		for _, f := range q.Facets {
+			res.Facets[f] = make(map[string]int64)
+			for _, b := range hits {
+				if v := facetValue(b, f); v != "" {
+					res.Facets[f][v]++
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func matchesFilter(b Book, f SearchFilter) bool {
+	for _, field := range [][2]string{
+		{b.Language, f.Language},
+		{b.Author, f.Author},
+		{b.Series, f.Series},
+		{b.Publisher, f.Publisher},
+		{b.ISBN, f.ISBN},
+	} {
+		if field[1] != "" && field[0] != field[1] {
+			return false
+		}
+	}
+	if !f.PublishedAfter.IsZero() && b.PublishDate.Before(f.PublishedAfter) {
+		return false
+	}
+	if !f.PublishedBefore.IsZero() && b.PublishDate.After(f.PublishedBefore) {
+		return false
+	}
+	return true
+}
+
+func compareField(a, b Book, field string) int {
+	switch field {
+	case "Added":
+		return a.Added.Compare(b.Added)
+	case "PublishDate":
+		return a.PublishDate.Compare(b.PublishDate)
+	case "SeriesIndex":
+		return cmp.Compare(a.SeriesIndex, b.SeriesIndex)
+	case "Title":
+		return strings.Compare(a.Title, b.Title)
+	}
+	return strings.Compare(facetValue(a, field), facetValue(b, field))
+}
+
+func facetValue(b Book, field string) string {
+	switch field {
+	case "Language":
+		return b.Language
+	case "Author":
+		return b.Author
+	case "Series":
+		return b.Series
+	case "Publisher":
+		return b.Publisher
+	}
+	return ""
+}
+
+// matchesWords returns true if every word is found in one of the searchable fields of the book
+func matchesWords(b Book, words []string) bool {
+	haystack := strings.ToLower(strings.Join([]string{
+		b.Title,
+		b.Author,
+		b.Series,
+		b.Publisher,
+		b.Description,
+	}, " "))
+	for _, w := range words {
+		if !strings.Contains(haystack, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,72 +2,122 @@ package main
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
-	"runtime"
-
-	"github.com/coreos/go-oidc"
+	"strings"
 )
 
-var (
-	timeFormat = "02/Jan/2006:15:04:05 -0700"
-	authDomain = "https://egdk.cloudflareaccess.com"
-	certsUrl   = "https://egdk.cloudflareaccess.com/cdn-cgi/access/certs"
-	//maybe this is private? I don't know, I feel pretty safe committing this for now
-	audience = "5f08d8662487c020cb66fc58f85e1189e848112088c1de0ab60236f264098db0"
+var timeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// trusted providers are proxies in front of booksing that set the user in a header, they are only used when configured
+const (
+	providerTobab     = "tobab"
+	providerTailscale = "tailscale"
+	providerOIDC      = "oidc"
 )
 
-type claims struct {
-	Email string `json:"email"`
-	CN    string `json:"common_name"`
-	Type  string `json:"type"`
-}
+var authProviders = []string{providerTobab, providerTailscale, providerOIDC}
 
-func verifyJWT(cfHeader string) (string, bool) {
-	ctx := context.TODO()
+// anonymousUser is the user of requests without credentials
+const anonymousUser = "unknown"
 
-	config := &oidc.Config{
-		ClientID: audience,
-	}
-	keyset := oidc.NewRemoteKeySet(ctx, certsUrl)
-	verifier := oidc.NewVerifier(authDomain, keyset, config)
-	t, err := verifier.Verify(ctx, cfHeader)
-	if err != nil {
-		return "", false
+type userKey struct{}
+
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// getUserFromRequest returns the user that authenticate found for the request
+func getUserFromRequest(r *http.Request) string {
+	if user, ok := r.Context().Value(userKey{}).(string); ok {
+		return user
 	}
-	var c claims
-	err = t.Claims(&c)
-	id := ""
-	if err == nil {
-		//maybe this should be exclusive?
-		if c.CN != "" {
-			id = c.CN
-		}
-		if c.Email != "" {
-			id = c.Email
+	return anonymousUser
+}
+
+// authenticate finds the user of every request and refuses requests to the api and the opds feeds without one.
+// Kobo routes carry their own device token and the frontend is public so it can show a login form.
+func (app *booksingApp) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.identify(r)
+		if user == "" {
+			if needsAuth(r.URL.Path) && !app.cfg.AllowAnonymous {
+				// lets e-readers ask for a username and password or token
+				w.Header().Set("WWW-Authenticate", `Basic realm="booksing"`)
+				renderError(w, "UNAUTHORIZED", http.StatusUnauthorized)
+				return
+			}
+			user = anonymousUser
 		}
-	}
-	return id, true
+		next.ServeHTTP(w, r.WithContext(withUser(r.Context(), user)))
+	})
 }
 
-func getUserFromRequest(r *http.Request) string {
-	user := "unknown"
-	if runtime.GOOS == "darwin" {
-		user = "erwin-dev"
+func needsAuth(p string) bool {
+	if p == "/api/login" || p == "/api/logout" {
+		return false
 	}
+	// shared shelves are read-only links for people without an account
+	if strings.HasPrefix(p, "/api/shared/") || strings.HasPrefix(p, "/opds/shared/") {
+		return false
+	}
+	return strings.HasPrefix(p, "/api/") || p == "/opds" || strings.HasPrefix(p, "/opds/")
+}
 
-	if r.Header.Get("X-Tobab-User") != "" {
-		user = r.Header.Get("X-Tobab-User")
+// identify returns the user of the request or an empty string. Sessions come first, then api tokens as bearer
+// token or basic auth password, local passwords over basic auth and finally the configured trusted providers.
+func (app *booksingApp) identify(r *http.Request) string {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if user, ok := app.sessionUser(c.Value); ok {
+			return user
+		}
 	}
 
-	if r.Header.Get("Tailscale-User-Login") != "" {
-		user = r.Header.Get("Tailscale-User-Login")
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if user, ok := app.tokenUser(token); ok {
+			return user
+		}
+		// it can still be an identity token for the oidc provider
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		if user, ok := app.tokenUser(password); ok && user == name {
+			return user
+		}
+		if app.basicAuth.check(name, password) {
+			return name
+		}
+		err := app.verifyPassword(r, name, password)
+		if err == nil {
+			app.basicAuth.add(name, password)
+			return name
+		}
+		slog.Warn("failed basic auth", "user", name, "ips", getIPFromRequest(r), "err", err)
+		return ""
 	}
 
-	id, ok := verifyJWT(r.Header.Get("Cf-Access-Jwt-Assertion"))
-	if ok {
-		user = id
+	for _, p := range app.cfg.AuthProviders {
+		user := ""
+		switch p {
+		case providerTobab:
+			user = r.Header.Get("X-Tobab-User")
+		case providerTailscale:
+			user = r.Header.Get("Tailscale-User-Login")
+		case providerOIDC:
+			var err error
+			user, err = app.oidc.user(r)
+			if err != nil {
+				slog.Warn("invalid identity token", "err", err, "path", r.URL.Path)
+			}
+		}
+		if user != "" {
+			return user
+		}
 	}
-	return user
+	return ""
+}
+
+func (app *booksingApp) isAdmin(user string) bool {
+	return app.hasRole(user, roleAdmin)
 }
 
 var IPHeaders = []string{
@@ -0,0 +1,182 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Mobi represents a mobipocket type book, this includes azw3 files from kindle
+type Mobi struct {
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	Publisher   string    `json:"publisher"`
+	Language    string    `json:"language"`
+	ISBN        string    `json:"isbn"`
+	Description string    `json:"description"`
+	PublishDate time.Time `json:"publish_date"`
+}
+
+// EXTH record types that are used
+const (
+	exthAuthor      = 100
+	exthPublisher   = 101
+	exthDescription = 103
+	exthISBN        = 104
+	exthPublishDate = 106
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+var ErrNotMobi = errors.New("not a mobi file")
+
+// IsMobi reports whether the header of a file looks like a mobipocket PalmDB
+func IsMobi(header []byte) bool {
+	return len(header) >= 68 && string(header[60:68]) == "BOOKMOBI"
+}
+
+// ParseFile takes a filepath and returns a Mobi and the raw cover image if possible
+func ParseFile(bookpath string) (bk *Mobi, cover []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bk = nil
+			err = fmt.Errorf("Unknown error parsing book. Skipping. Error: %s", r)
+		}
+	}()
+
+	data, err := os.ReadFile(bookpath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !IsMobi(data) || len(data) < 78 {
+		return nil, nil, ErrNotMobi
+	}
+
+	// PalmDB header, followed by the record offsets
+	numRecords := int(binary.BigEndian.Uint16(data[76:78]))
+	offsets := make([]int, numRecords)
+	for i := range offsets {
+		offsets[i] = int(binary.BigEndian.Uint32(data[78+i*8:]))
+	}
+	record := func(i int) []byte {
+		if i < 0 || i >= numRecords {
+			return nil
+		}
+		end := len(data)
+		if i+1 < numRecords {
+			end = offsets[i+1]
+		}
+		// truncated files can list records beyond the end of the data
+		if offsets[i] > end || end > len(data) {
+			return nil
+		}
+		return data[offsets[i]:end]
+	}
+
+	// record 0 is the PalmDOC header followed by the MOBI header
+	rec0 := record(0)
+	if len(rec0) < 132 || string(rec0[16:20]) != "MOBI" {
+		return nil, nil, ErrNotMobi
+	}
+	headerLen := int(binary.BigEndian.Uint32(rec0[20:24]))
+	utf8Text := binary.BigEndian.Uint32(rec0[28:32]) == 65001
+	decode := func(b []byte) string {
+		if utf8Text || utf8.Valid(b) {
+			return strings.TrimSpace(string(b))
+		}
+		s, err := charmap.Windows1252.NewDecoder().Bytes(b)
+		if err != nil {
+			return strings.TrimSpace(string(b))
+		}
+		return strings.TrimSpace(string(s))
+	}
+
+	book := new(Mobi)
+	book.Title = strings.TrimSuffix(filepath.Base(bookpath), filepath.Ext(bookpath))
+
+	nameOffset := int(binary.BigEndian.Uint32(rec0[84:88]))
+	nameLen := int(binary.BigEndian.Uint32(rec0[88:92]))
+	if nameOffset+nameLen <= len(rec0) && nameLen > 0 {
+		book.Title = decode(rec0[nameOffset : nameOffset+nameLen])
+	}
+	firstImage := int(binary.BigEndian.Uint32(rec0[108:112]))
+
+	coverOffset := -1
+	if binary.BigEndian.Uint32(rec0[128:132])&0x40 != 0 && 16+headerLen+12 <= len(rec0) {
+		exth := rec0[16+headerLen:]
+		if string(exth[0:4]) == "EXTH" {
+			count := int(binary.BigEndian.Uint32(exth[8:12]))
+			pos := 12
+			for i := 0; i < count && pos+8 <= len(exth); i++ {
+				typ := binary.BigEndian.Uint32(exth[pos : pos+4])
+				l := int(binary.BigEndian.Uint32(exth[pos+4 : pos+8]))
+				if l < 8 || pos+l > len(exth) {
+					break
+				}
+				val := exth[pos+8 : pos+l]
+				pos += l
+
+				switch typ {
+				case exthAuthor:
+					if book.Author == "" {
+						book.Author = decode(val)
+					}
+				case exthPublisher:
+					book.Publisher = decode(val)
+				case exthDescription:
+					book.Description = decode(val)
+				case exthISBN:
+					book.ISBN = strings.ReplaceAll(decode(val), "-", "")
+				case exthPublishDate:
+					book.PublishDate = parseDate(decode(val))
+				case exthTitle:
+					book.Title = decode(val)
+				case exthLanguage:
+					book.Language = decode(val)
+				case exthCoverOffset:
+					if len(val) == 4 {
+						coverOffset = int(binary.BigEndian.Uint32(val))
+					}
+				}
+			}
+		}
+	}
+
+	if coverOffset >= 0 && firstImage > 0 {
+		img := record(firstImage + coverOffset)
+		if isImage(img) {
+			cover = bytes.Clone(img)
+		}
+	}
+
+	return book, cover, nil
+}
+
+func isImage(b []byte) bool {
+	return bytes.HasPrefix(b, []byte{0xFF, 0xD8}) ||
+		bytes.HasPrefix(b, []byte("\x89PNG")) ||
+		bytes.HasPrefix(b, []byte("GIF8"))
+}
+
+func parseDate(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t
+	}
+	for _, layout := range []string{"2006-01-02", "2006"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,136 @@
+package mobi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var jpeg = []byte{0xFF, 0xD8, 0xFF, 0xE0, 'c', 'o', 'v', 'e', 'r'}
+
+// buildMobi creates a PalmDB with a MOBI header, EXTH metadata and an image record as the cover
+func buildMobi(exth map[uint32]string) []byte {
+	var ex bytes.Buffer
+	for _, typ := range []uint32{exthAuthor, exthPublisher, exthDescription, exthISBN, exthPublishDate, exthTitle, exthLanguage} {
+		val, ok := exth[typ]
+		if !ok {
+			continue
+		}
+		binary.Write(&ex, binary.BigEndian, typ)
+		binary.Write(&ex, binary.BigEndian, uint32(8+len(val)))
+		ex.WriteString(val)
+	}
+	count := len(exth)
+	// the cover is the first image record
+	binary.Write(&ex, binary.BigEndian, uint32(exthCoverOffset))
+	binary.Write(&ex, binary.BigEndian, uint32(12))
+	binary.Write(&ex, binary.BigEndian, uint32(0))
+	count++
+	exthBlock := append([]byte("EXTH"), make([]byte, 8)...)
+	binary.BigEndian.PutUint32(exthBlock[4:], uint32(12+ex.Len()))
+	binary.BigEndian.PutUint32(exthBlock[8:], uint32(count))
+	exthBlock = append(exthBlock, ex.Bytes()...)
+
+	const headerLen = 232
+	name := "Full Name Title"
+	rec0 := make([]byte, 16+headerLen)
+	copy(rec0[16:], "MOBI")
+	binary.BigEndian.PutUint32(rec0[20:], headerLen)
+	binary.BigEndian.PutUint32(rec0[28:], 65001)
+	binary.BigEndian.PutUint32(rec0[84:], uint32(len(rec0)+len(exthBlock)))
+	binary.BigEndian.PutUint32(rec0[88:], uint32(len(name)))
+	binary.BigEndian.PutUint32(rec0[108:], 1)
+	binary.BigEndian.PutUint32(rec0[128:], 0x40)
+	rec0 = append(rec0, exthBlock...)
+	rec0 = append(rec0, name...)
+
+	records := [][]byte{rec0, jpeg}
+	header := make([]byte, 78)
+	copy(header, "test")
+	copy(header[60:], "BOOKMOBI")
+	binary.BigEndian.PutUint16(header[76:], uint16(len(records)))
+	offset := len(header) + 8*len(records) + 2
+	var list []byte
+	for _, r := range records {
+		list = binary.BigEndian.AppendUint32(list, uint32(offset))
+		list = append(list, 0, 0, 0, 0)
+		offset += len(r)
+	}
+
+	out := append(header, list...)
+	out = append(out, 0, 0)
+	for _, r := range records {
+		out = append(out, r...)
+	}
+	return out
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseFile(t *testing.T) {
+	data := buildMobi(map[uint32]string{
+		exthAuthor:      "Bram Stoker",
+		exthPublisher:   "Constable",
+		exthDescription: "A vampire novel",
+		exthISBN:        "978-0-14-143984-6",
+		exthPublishDate: "1897-05-26",
+		exthTitle:       "Dracula",
+		exthLanguage:    "en",
+	})
+	if !IsMobi(data) {
+		t.Fatal("expected the fixture to be detected as mobi")
+	}
+
+	book, cover, err := ParseFile(writeFile(t, "dracula.azw3", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Mobi{
+		Title:       "Dracula",
+		Author:      "Bram Stoker",
+		Publisher:   "Constable",
+		Language:    "en",
+		ISBN:        "9780141439846",
+		Description: "A vampire novel",
+		PublishDate: time.Date(1897, 5, 26, 0, 0, 0, 0, time.UTC),
+	}
+	if *book != want {
+		t.Errorf("expected %+v, got %+v", want, *book)
+	}
+	if !bytes.Equal(cover, jpeg) {
+		t.Errorf("expected the first image as cover, got %q", cover)
+	}
+
+	// without an EXTH title the full name from the MOBI header is used
+	book, _, err = ParseFile(writeFile(t, "name.mobi", buildMobi(nil)))
+	if err != nil || book.Title != "Full Name Title" {
+		t.Errorf("expected the full name as title, got %+v (%v)", book, err)
+	}
+}
+
+func TestParseFileInvalid(t *testing.T) {
+	data := buildMobi(map[uint32]string{exthTitle: "Dracula"})
+	for name, content := range map[string][]byte{
+		"empty":             {},
+		"not a mobi":        []byte("%PDF-1.4"),
+		"truncated header":  data[:70],
+		"truncated records": data[:100],
+		"truncated mobi":    data[:200],
+		"truncated cover":   data[:len(data)-len(jpeg)-40],
+	} {
+		t.Run(name, func(t *testing.T) {
+			if book, _, err := ParseFile(writeFile(t, "book.mobi", content)); err == nil {
+				t.Errorf("expected an error, got %+v", book)
+			}
+		})
+	}
+}
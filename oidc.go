@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+)
+
+// oidcVerifier checks the identity tokens that a proxy like cloudflare access or oauth2-proxy adds to every
+// request. The key set is created once, it caches the keys and only fetches them again for unknown key ids.
+type oidcVerifier struct {
+	verifier *oidc.IDTokenVerifier
+	header   string
+	claims   []string
+}
+
+// newOIDCVerifier uses the configured JWKS url, or discovers it from the issuer when it is empty
+func newOIDCVerifier(ctx context.Context, cfg configuration) (*oidcVerifier, error) {
+	if cfg.OIDCIssuer == "" {
+		return nil, errors.New("BOOKSING_OIDCISSUER is required for the oidc provider")
+	}
+	// without an audience every token the issuer signed for any application is a valid login
+	if cfg.OIDCAudience == "" && !cfg.OIDCSkipAudience {
+		return nil, errors.New("BOOKSING_OIDCAUDIENCE is required for the oidc provider, set BOOKSING_OIDCSKIPAUDIENCE to accept tokens for any audience")
+	}
+	config := &oidc.Config{
+		ClientID:          cfg.OIDCAudience,
+		SkipClientIDCheck: cfg.OIDCSkipAudience,
+	}
+
+	v := &oidcVerifier{
+		header: cfg.OIDCHeader,
+	}
+	for _, c := range cfg.OIDCClaims {
+		if c = strings.TrimSpace(c); c != "" {
+			v.claims = append(v.claims, c)
+		}
+	}
+	if len(v.claims) == 0 {
+		return nil, errors.New("at least one claim is needed to identify users")
+	}
+
+	if cfg.OIDCJWKSURL != "" {
+		v.verifier = oidc.NewVerifier(cfg.OIDCIssuer, oidc.NewRemoteKeySet(ctx, cfg.OIDCJWKSURL), config)
+		return v, nil
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.OIDCIssuer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to discover oidc provider: %w", err)
+	}
+	v.verifier = provider.Verifier(config)
+	return v, nil
+}
+
+// user returns the first configured claim of the verified token that is set, an email only counts when the
+// provider did not mark it as unverified
+func (v *oidcVerifier) user(r *http.Request) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	raw := r.Header.Get(v.header)
+	if strings.EqualFold(v.header, "Authorization") {
+		raw, _ = strings.CutPrefix(raw, "Bearer ")
+	}
+	if raw == "" {
+		return "", nil
+	}
+
+	t, err := v.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return "", err
+	}
+	var claims map[string]interface{}
+	err = t.Claims(&claims)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range v.claims {
+		if c == "email" && !emailVerified(claims) {
+			continue
+		}
+		if s, ok := claims[c].(string); ok && s != "" {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("token has none of the claims %v", v.claims)
+}
+
+// emailVerified is false when the token has an email_verified claim that is not true, providers like cloudflare
+// access only issue tokens for verified addresses and leave the claim out
+func emailVerified(claims map[string]interface{}) bool {
+	switch v := claims["email_verified"].(type) {
+	case nil:
+		return true
+	case bool:
+		return v
+	case string:
+		// some providers send the claim as a string
+		return v == "true"
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// jwksStandIn serves a key set and discovery document like an identity provider, it counts key set requests
+func jwksStandIn(t *testing.T, key *rsa.PrivateKey) (*httptest.Server, *atomic.Int32) {
+	var fetches atomic.Int32
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       key.Public(),
+			KeyID:     "test",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	})
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   srv.URL,
+			"jwks_uri": srv.URL + "/certs",
+		})
+	})
+	return srv, &fetches
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, fetches := jwksStandIn(t, key)
+
+	cfg := configuration{
+		OIDCIssuer:   srv.URL,
+		OIDCJWKSURL:  srv.URL + "/certs",
+		OIDCAudience: "booksing",
+		OIDCClaims:   []string{"email", "common_name"},
+		OIDCHeader:   "Cf-Access-Jwt-Assertion",
+	}
+	v, err := newOIDCVerifier(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": srv.URL,
+			"aud": "booksing",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+	verify := func(v *oidcVerifier, header, token string) (string, error) {
+		r := httptest.NewRequest(http.MethodGet, "/api/search", nil)
+		r.Header.Set(header, token)
+		return v.user(r)
+	}
+
+	user, err := verify(v, cfg.OIDCHeader, signToken(t, key, claims(map[string]interface{}{"email": "reader@example.com"})))
+	if err != nil || user != "reader@example.com" {
+		t.Errorf("expected the email claim, got %q (%v)", user, err)
+	}
+	user, err = verify(v, cfg.OIDCHeader, signToken(t, key, claims(map[string]interface{}{"common_name": "service"})))
+	if err != nil || user != "service" {
+		t.Errorf("expected the next claim for tokens without email, got %q (%v)", user, err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected the key set to be fetched once, got %d", n)
+	}
+
+	for name, c := range map[string]map[string]interface{}{
+		"wrong audience": claims(map[string]interface{}{"email": "x@example.com", "aud": "other"}),
+		"wrong issuer":   claims(map[string]interface{}{"email": "x@example.com", "iss": "https://example.com"}),
+		"expired":        claims(map[string]interface{}{"email": "x@example.com", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"no claim":       claims(nil),
+		"unverified":     claims(map[string]interface{}{"email": "x@example.com", "email_verified": false}),
+	} {
+		if user, err := verify(v, cfg.OIDCHeader, signToken(t, key, c)); err == nil {
+			t.Errorf("%s: expected token to be refused, got %q", name, user)
+		}
+	}
+	user, err = verify(v, cfg.OIDCHeader, signToken(t, key, claims(map[string]interface{}{"email": "x@example.com", "email_verified": true})))
+	if err != nil || user != "x@example.com" {
+		t.Errorf("expected verified emails to be accepted, got %q (%v)", user, err)
+	}
+	user, err = verify(v, cfg.OIDCHeader, signToken(t, key, claims(map[string]interface{}{
+		"email": "x@example.com", "email_verified": "false", "common_name": "service"})))
+	if err != nil || user != "service" {
+		t.Errorf("expected an unverified email to be skipped, got %q (%v)", user, err)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if user, err := verify(v, cfg.OIDCHeader, signToken(t, other, claims(map[string]interface{}{"email": "x@example.com"}))); err == nil {
+		t.Errorf("expected tokens from another key to be refused, got %q", user)
+	}
+
+	// without an audience any token of the issuer would be a login, that has to be asked for explicitly
+	noAudience := cfg
+	noAudience.OIDCAudience = ""
+	if _, err := newOIDCVerifier(context.Background(), noAudience); err == nil {
+		t.Errorf("expected a missing audience to be refused")
+	}
+	noAudience.OIDCSkipAudience = true
+	skipped, err := newOIDCVerifier(context.Background(), noAudience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = verify(skipped, cfg.OIDCHeader, signToken(t, key, claims(map[string]interface{}{"email": "x@example.com", "aud": "other"})))
+	if err != nil || user != "x@example.com" {
+		t.Errorf("expected any audience to be accepted when skipped, got %q (%v)", user, err)
+	}
+
+	// generic providers are discovered from the issuer and can use the authorization header
+	cfg.OIDCJWKSURL = ""
+	cfg.OIDCHeader = "Authorization"
+	discovered, err := newOIDCVerifier(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, key, claims(map[string]interface{}{"email": "reader@example.com"}))
+	user, err = verify(discovered, "Authorization", "Bearer "+token)
+	if err != nil || user != "reader@example.com" {
+		t.Errorf("expected discovery to work, got %q (%v)", user, err)
+	}
+
+	app := newTestApp(t)
+	app.cfg.AuthProviders = []string{providerOIDC}
+	app.oidc = discovered
+	handler := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(getUserFromRequest(r)))
+	}))
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/search", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "reader@example.com" {
+		t.Errorf("expected the oidc provider to identify the user, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	openSearchType      = "application/opensearchdescription+xml"
+	opdsPageSize        = 25
+)
+
+type opdsFeed struct {
+	XMLName      xml.Name    `xml:"feed"`
+	Xmlns        string      `xml:"xmlns,attr"`
+	XmlnsDC      string      `xml:"xmlns:dc,attr"`
+	XmlnsOPDS    string      `xml:"xmlns:opds,attr"`
+	XmlnsOS      string      `xml:"xmlns:opensearch,attr"`
+	ID           string      `xml:"id"`
+	Title        string      `xml:"title"`
+	Updated      string      `xml:"updated"`
+	Author       *opdsAuthor `xml:"author,omitempty"`
+	TotalResults int64       `xml:"opensearch:totalResults,omitempty"`
+	ItemsPerPage int64       `xml:"opensearch:itemsPerPage,omitempty"`
+	StartIndex   int64       `xml:"opensearch:startIndex,omitempty"`
+	Links        []opdsLink  `xml:"link"`
+	Entries      []opdsEntry `xml:"entry"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type opdsLink struct {
+	Rel   string `xml:"rel,attr,omitempty"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+}
+
+type opdsContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type opdsEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Authors   []opdsAuthor `xml:"author,omitempty"`
+	Language  string       `xml:"dc:language,omitempty"`
+	Publisher string       `xml:"dc:publisher,omitempty"`
+	Issued    string       `xml:"dc:issued,omitempty"`
+	ISBN      string       `xml:"dc:identifier,omitempty"`
+	Summary   string       `xml:"summary,omitempty"`
+	Content   *opdsContent `xml:"content,omitempty"`
+	Links     []opdsLink   `xml:"link"`
+}
+
+type openSearchDescription struct {
+	XMLName        xml.Name      `xml:"OpenSearchDescription"`
+	Xmlns          string        `xml:"xmlns,attr"`
+	ShortName      string        `xml:"ShortName"`
+	Description    string        `xml:"Description"`
+	InputEncoding  string        `xml:"InputEncoding"`
+	OutputEncoding string        `xml:"OutputEncoding"`
+	URL            openSearchURL `xml:"Url"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Template string `xml:"template,attr"`
+}
+
+func newOPDSFeed(id, title, self, kind string) *opdsFeed {
+	return &opdsFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsDC:   "http://purl.org/dc/terms/",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		XmlnsOS:   "http://a9.com/-/spec/opensearch/1.1/",
+		ID:        "urn:booksing:" + id,
+		Title:     title,
+		Updated:   time.Now().UTC().Format(time.RFC3339),
+		Author:    &opdsAuthor{Name: "booksing", URI: "https://github.com/gnur/booksing"},
+		Links: []opdsLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+			{Rel: "search", Href: "/opds/opensearch.xml", Type: openSearchType},
+		},
+	}
+}
+
+// opdsRoot serves the root navigation feed that links to all other feeds
+func (app *booksingApp) opdsRoot(w http.ResponseWriter, r *http.Request) {
+	feed := newOPDSFeed("root", "booksing", "/opds", opdsNavigationType)
+
+	for _, nav := range []struct {
+		id, title, href, kind, summary string
+	}{
+		{"new", "Recently added", "/opds/new", opdsAcquisitionType, "The most recently added books"},
+		{"authors", "By author", "/opds/authors", opdsNavigationType, "Browse books by author"},
+		{"series", "By series", "/opds/series", opdsNavigationType, "Browse books by series"},
+		{"languages", "By language", "/opds/languages", opdsNavigationType, "Browse books by language"},
+		{"shelves", "Shelves", "/opds/shelves", opdsNavigationType, "Your reading lists"},
+	} {
+		feed.Entries = append(feed.Entries, navigationEntry(nav.id, nav.title, nav.href, nav.kind, nav.summary))
+	}
+
+	writeXML(w, feed, opdsNavigationType)
+}
+
+// opdsNew serves the books ordered by the time they were added
+func (app *booksingApp) opdsNew(w http.ResponseWriter, r *http.Request) {
+	limit, offset := opdsPaging(r)
+
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Limit:  limit,
+		Offset: offset,
+		Sort:   []SortOrder{{Field: "Added", Descending: true}},
+	})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	feed := newOPDSFeed("new", "Recently added", r.URL.String(), opdsAcquisitionType)
+	app.addBookEntries(feed, r, res.Items, res.Total, limit, offset, "")
+	writeXML(w, feed, opdsAcquisitionType)
+}
+
+// opdsSearch serves the results of a free text search
+func (app *booksingApp) opdsSearch(w http.ResponseWriter, r *http.Request) {
+	limit, offset := opdsPaging(r)
+	q := r.URL.Query().Get("q")
+
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Query:  q,
+		Limit:  limit,
+		Offset: offset,
+	})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	feed := newOPDSFeed("search", fmt.Sprintf("Search results for %q", q), r.URL.String(), opdsAcquisitionType)
+	app.addBookEntries(feed, r, res.Items, res.Total, limit, offset, "")
+	writeXML(w, feed, opdsAcquisitionType)
+}
+
+// opdsOpenSearch describes how e-readers can use the search feed
+func (app *booksingApp) opdsOpenSearch(w http.ResponseWriter, r *http.Request) {
+	desc := openSearchDescription{
+		Xmlns:          "http://a9.com/-/spec/opensearch/1.1/",
+		ShortName:      "booksing",
+		Description:    "Search books by title or author",
+		InputEncoding:  "UTF-8",
+		OutputEncoding: "UTF-8",
+		URL: openSearchURL{
+			Type:     opdsAcquisitionType,
+			Template: "/opds/search?q={searchTerms}",
+		},
+	}
+	writeXML(w, desc, openSearchType)
+}
+
+// opdsAuthors lists all authors, or the books of a single author if a name is given
+func (app *booksingApp) opdsAuthors(w http.ResponseWriter, r *http.Request) {
+	app.opdsGrouped(w, r, "authors", "Authors", "Author", func(f *SearchFilter, name string) { f.Author = name })
+}
+
+// opdsSeries lists all series, or the books in a single series if a name is given
+func (app *booksingApp) opdsSeries(w http.ResponseWriter, r *http.Request) {
+	app.opdsGrouped(w, r, "series", "Series", "Series", func(f *SearchFilter, name string) { f.Series = name })
+}
+
+// opdsLanguages lists all languages, or the books in a single language if a name is given
+func (app *booksingApp) opdsLanguages(w http.ResponseWriter, r *http.Request) {
+	app.opdsGrouped(w, r, "languages", "Languages", "Language", func(f *SearchFilter, name string) { f.Language = name })
+}
+
+// opdsShelves lists the shelves of the current user
+func (app *booksingApp) opdsShelves(w http.ResponseWriter, r *http.Request) {
+	limit, offset := opdsPaging(r)
+	shelves, err := app.userShelves(getUserFromRequest(r))
+	if err != nil {
+		slog.Error("failed to list shelves", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	feed := newOPDSFeed("shelves", "Shelves", r.URL.String(), opdsNavigationType)
+	for _, s := range page(shelves, limit, offset) {
+		href := "/opds/shelves/" + url.PathEscape(s.ID)
+		summary := fmt.Sprintf("%d books", len(s.Books))
+		feed.Entries = append(feed.Entries, navigationEntry("shelf:"+s.ID, s.Name, href, opdsAcquisitionType, summary))
+	}
+	addPagingLinks(feed, r, int64(len(shelves)), limit, offset, opdsNavigationType)
+	writeXML(w, feed, opdsNavigationType)
+}
+
+// opdsShelf serves the books on a shelf of the current user
+func (app *booksingApp) opdsShelf(w http.ResponseWriter, r *http.Request) {
+	s, err := app.getShelf(getUserFromRequest(r), r.PathValue("id"))
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	app.opdsShelfBooks(w, r, "shelf:"+s.ID, s, "")
+}
+
+// opdsSharedShelf serves the books on a shared shelf to anyone with the link
+func (app *booksingApp) opdsSharedShelf(w http.ResponseWriter, r *http.Request) {
+	s, err := app.sharedShelf(r.PathValue("token"))
+	if err != nil {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	app.opdsShelfBooks(w, r, "shared:"+s.Share, s, s.Share)
+}
+
+// opdsShelfBooks serves the books on a shelf, with a share token the books link to the downloads of the shared shelf
+func (app *booksingApp) opdsShelfBooks(w http.ResponseWriter, r *http.Request, id string, s *shelf, share string) {
+	limit, offset := opdsPaging(r)
+	books := app.shelfBooks(s)
+	feed := newOPDSFeed(id, s.Name, r.URL.String(), opdsAcquisitionType)
+	app.addBookEntries(feed, r, page(books, limit, offset), int64(len(books)), limit, offset, share)
+	writeXML(w, feed, opdsAcquisitionType)
+}
+
+// opdsGrouped serves a navigation feed with all values of the facet, or an acquisition feed
+// with the books that have the value given in the name parameter
+func (app *booksingApp) opdsGrouped(w http.ResponseWriter, r *http.Request, id, title, facet string, setFilter func(*SearchFilter, string)) {
+	limit, offset := opdsPaging(r)
+	name := r.URL.Query().Get("name")
+
+	if name != "" {
+		q := SearchQuery{
+			Limit:  limit,
+			Offset: offset,
+			Sort: []SortOrder{
+				{Field: "Series"},
+				{Field: "SeriesIndex"},
+				{Field: "Title"},
+			},
+		}
+		setFilter(&q.Filter, name)
+		res, err := app.searchDB.GetBooks(q)
+		if err != nil {
+			slog.Error("failed to search DB", "err", err)
+			renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+			return
+		}
+		feed := newOPDSFeed(id+":"+name, name, r.URL.String(), opdsAcquisitionType)
+		app.addBookEntries(feed, r, res.Items, res.Total, limit, offset, "")
+		writeXML(w, feed, opdsAcquisitionType)
+		return
+	}
+
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Facets: []string{facet},
+	})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+	counts := res.Facets[facet]
+	var names []string
+	for k := range counts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	feed := newOPDSFeed(id, title, r.URL.String(), opdsNavigationType)
+	for _, n := range page(names, limit, offset) {
+		href := fmt.Sprintf("/opds/%s?name=%s", id, url.QueryEscape(n))
+		summary := fmt.Sprintf("%d books", counts[n])
+		feed.Entries = append(feed.Entries, navigationEntry(id+":"+n, n, href, opdsAcquisitionType, summary))
+	}
+	addPagingLinks(feed, r, int64(len(names)), limit, offset, opdsNavigationType)
+	writeXML(w, feed, opdsNavigationType)
+}
+
+func (app *booksingApp) addBookEntries(feed *opdsFeed, r *http.Request, books []Book, total, limit, offset int64, share string) {
+	for _, b := range books {
+		feed.Entries = append(feed.Entries, app.bookEntry(b, share))
+	}
+	addPagingLinks(feed, r, total, limit, offset, opdsAcquisitionType)
+}
+
+// bookEntry describes a book with links to its files and cover, books on a shared shelf link through the share token
+// because people with the link do not have an account
+func (app *booksingApp) bookEntry(b Book, share string) opdsEntry {
+	download := "/api/download?hash=" + url.QueryEscape(b.Hash)
+	cover := "/api/cover?file=" + url.QueryEscape(strings.TrimPrefix(b.CoverPath, app.bookDir))
+	if share != "" {
+		download = "/api/shared/" + share + "/download?hash=" + url.QueryEscape(b.Hash)
+		cover = "/api/shared/" + share + "/cover?hash=" + url.QueryEscape(b.Hash)
+	}
+	e := opdsEntry{
+		ID:        "urn:booksing:book:" + b.Hash,
+		Title:     b.Title,
+		Updated:   b.Added.UTC().Format(time.RFC3339),
+		Authors:   []opdsAuthor{{Name: b.Author}},
+		Language:  b.Language,
+		Publisher: b.Publisher,
+		Summary:   b.Description,
+	}
+	for _, f := range b.files() {
+		e.Links = append(e.Links, opdsLink{
+			Rel:  "http://opds-spec.org/acquisition",
+			Href: download + "&format=" + url.QueryEscape(f.Format),
+			Type: formatByName(f.Format).ContentType,
+		})
+	}
+	if !b.PublishDate.IsZero() && b.PublishDate.Unix() != 0 {
+		e.Issued = b.PublishDate.Format("2006-01-02")
+	}
+	if b.ISBN != "" {
+		e.ISBN = "urn:isbn:" + b.ISBN
+	}
+	if b.Series != "" {
+		e.Content = &opdsContent{
+			Type: "text",
+			Text: fmt.Sprintf("%s #%s", b.Series, strconv.FormatFloat(b.SeriesIndex, 'f', -1, 64)),
+		}
+	}
+	if b.HasCover {
+		e.Links = append(e.Links,
+			opdsLink{Rel: "http://opds-spec.org/image", Href: cover, Type: "image/jpeg"},
+			opdsLink{Rel: "http://opds-spec.org/image/thumbnail", Href: cover, Type: "image/jpeg"},
+		)
+	}
+	return e
+}
+
+func navigationEntry(id, title, href, kind, summary string) opdsEntry {
+	return opdsEntry{
+		ID:      "urn:booksing:" + id,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Content: &opdsContent{Type: "text", Text: summary},
+		Links: []opdsLink{
+			{Rel: "subsection", Href: href, Type: kind},
+		},
+	}
+}
+
+func addPagingLinks(feed *opdsFeed, r *http.Request, total, limit, offset int64, kind string) {
+	feed.TotalResults = total
+	feed.ItemsPerPage = limit
+	feed.StartIndex = offset + 1
+
+	pageURL := func(o int64) string {
+		u := *r.URL
+		q := u.Query()
+		q.Set("o", strconv.FormatInt(o, 10))
+		q.Set("l", strconv.FormatInt(limit, 10))
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+
+	feed.Links = append(feed.Links, opdsLink{Rel: "first", Href: pageURL(0), Type: kind})
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		feed.Links = append(feed.Links, opdsLink{Rel: "previous", Href: pageURL(prev), Type: kind})
+	}
+	if offset+limit < total {
+		feed.Links = append(feed.Links, opdsLink{Rel: "next", Href: pageURL(offset + limit), Type: kind})
+	}
+}
+
+// opdsPaging reads the same limit and offset parameters as the search api
+func opdsPaging(r *http.Request) (int64, int64) {
+	var limit int64 = opdsPageSize
+	var offset int64
+	if off := r.URL.Query().Get("o"); off != "" {
+		if o, err := strconv.ParseInt(off, 10, 64); err == nil && o > 0 {
+			offset = o
+		}
+	}
+	if lim := r.URL.Query().Get("l"); lim != "" {
+		if l, err := strconv.ParseInt(lim, 10, 64); err == nil && l > 0 {
+			limit = l
+		}
+	}
+	return limit, offset
+}
+
+func page[T any](items []T, limit, offset int64) []T {
+	total := int64(len(items))
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return items[offset:end]
+}
+
+func writeXML(w http.ResponseWriter, v interface{}, contentType string) {
+	out, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		slog.Error("failed to marshal xml", "err", err)
+		renderError(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType+";charset=utf-8")
+	_, err = w.Write([]byte(xml.Header))
+	if err == nil {
+		_, err = w.Write(out)
+	}
+	if err != nil {
+		slog.Warn("failed to write xml", "err", err)
+	}
+}
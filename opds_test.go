@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// parsedFeed reads a feed the way an e-reader does, by local names, because encoding/xml resolves the
+// opensearch prefix to its namespace while opdsFeed writes it literally
+type parsedFeed struct {
+	Title        string `xml:"title"`
+	TotalResults int64  `xml:"totalResults"`
+	ItemsPerPage int64  `xml:"itemsPerPage"`
+	StartIndex   int64  `xml:"startIndex"`
+	Links        []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"link"`
+	Entries []struct {
+		ID     string `xml:"id"`
+		Title  string `xml:"title"`
+		Author string `xml:"author>name"`
+		Links  []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func (f parsedFeed) link(rel string) (url.Values, bool) {
+	for _, l := range f.Links {
+		if l.Rel == rel {
+			u, err := url.Parse(l.Href)
+			if err != nil {
+				return nil, false
+			}
+			return u.Query(), true
+		}
+	}
+	return nil, false
+}
+
+func TestOPDSFeed(t *testing.T) {
+	app := newTestApp(t)
+	var books []Book
+	for i := range opdsPageSize + 5 {
+		b := testBook(fmt.Sprintf("book%02d", i), fmt.Sprintf("Book %02d", i), "Author")
+		b.Added = b.Added.Add(time.Duration(i) * time.Hour)
+		b.Files = []BookFile{{Format: formatEPUB, Path: "/books/" + b.Hash + ".epub"}}
+		books = append(books, b)
+	}
+	if err := app.searchDB.AddBooks(books); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target string) parsedFeed {
+		rec := httptest.NewRecorder()
+		app.opdsNew(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected %s to be served, got %d", target, rec.Code)
+		}
+		var feed parsedFeed
+		if err := xml.NewDecoder(rec.Body).Decode(&feed); err != nil {
+			t.Fatalf("unable to parse %s: %v", target, err)
+		}
+		return feed
+	}
+
+	first := get("/opds/new")
+	if len(first.Entries) != opdsPageSize || first.TotalResults != int64(len(books)) || first.StartIndex != 1 {
+		t.Fatalf("expected a full first page of %d books, got %d entries of %d from %d",
+			len(books), len(first.Entries), first.TotalResults, first.StartIndex)
+	}
+	e := first.Entries[0]
+	if e.ID != "urn:booksing:book:book29" || e.Title != "Book 29" || e.Author != "Author" {
+		t.Errorf("expected the newest book first, got %+v", e)
+	}
+	if len(e.Links) != 1 || e.Links[0].Rel != "http://opds-spec.org/acquisition" ||
+		e.Links[0].Href != "/api/download?hash=book29&format=epub" || e.Links[0].Type != "application/epub+zip" {
+		t.Errorf("expected an acquisition link for the epub, got %+v", e.Links)
+	}
+	if q, ok := first.link("first"); !ok || q.Get("o") != "0" {
+		t.Errorf("expected a first link, got %v", q)
+	}
+	if _, ok := first.link("previous"); ok {
+		t.Errorf("expected no previous link on the first page")
+	}
+	next, ok := first.link("next")
+	if !ok || next.Get("o") != "25" || next.Get("l") != "25" {
+		t.Fatalf("expected a next link to offset 25, got %v", next)
+	}
+
+	last := get("/opds/new?" + next.Encode())
+	if len(last.Entries) != 5 || last.StartIndex != 26 || last.Entries[4].Title != "Book 00" {
+		t.Errorf("expected the 5 oldest books on the last page, got %d from %d", len(last.Entries), last.StartIndex)
+	}
+	if prev, ok := last.link("previous"); !ok || prev.Get("o") != "0" {
+		t.Errorf("expected a previous link to offset 0, got %v", prev)
+	}
+	if _, ok := last.link("next"); ok {
+		t.Errorf("expected no next link on the last page")
+	}
+
+	// a custom page size is kept in the links
+	small := get("/opds/new?l=10&o=10")
+	if len(small.Entries) != 10 || small.ItemsPerPage != 10 {
+		t.Errorf("expected pages of 10, got %d", len(small.Entries))
+	}
+	if prev, ok := small.link("previous"); !ok || prev.Get("o") != "0" || prev.Get("l") != "10" {
+		t.Errorf("expected a previous link to offset 0 with limit 10, got %v", prev)
+	}
+	if next, ok := small.link("next"); !ok || next.Get("o") != "20" {
+		t.Errorf("expected a next link to offset 20, got %v", next)
+	}
+}
+
+func TestOPDSPaging(t *testing.T) {
+	for target, want := range map[string][2]int64{
+		"/opds/new":            {opdsPageSize, 0},
+		"/opds/new?o=50&l=10":  {10, 50},
+		"/opds/new?o=-5&l=0":   {opdsPageSize, 0},
+		"/opds/new?o=abc&l=xy": {opdsPageSize, 0},
+	} {
+		limit, offset := opdsPaging(httptest.NewRequest(http.MethodGet, target, nil))
+		if limit != want[0] || offset != want[1] {
+			t.Errorf("%s: expected limit %d and offset %d, got %d and %d", target, want[0], want[1], limit, offset)
+		}
+	}
+}
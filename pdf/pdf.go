@@ -0,0 +1,164 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// PDF represents a pdf type book. Only the document information dictionary and
+// XMP metadata are read, covers are not extracted since that would require rendering a page.
+type PDF struct {
+	Title       string    `json:"title"`
+	Author      string    `json:"author"`
+	Language    string    `json:"language"`
+	Description string    `json:"description"`
+	PublishDate time.Time `json:"publish_date"`
+}
+
+// IsPDF reports whether the header of a file looks like a pdf
+func IsPDF(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("%PDF-"))
+}
+
+var (
+	infoKey  = regexp.MustCompile(`/(Title|Author|Subject|Lang|CreationDate)\s*(\((?:\\.|[^\\)])*\)|<[0-9A-Fa-f\s]*>)`)
+	xmpTitle = regexp.MustCompile(`(?s)<dc:title>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+)
+
+// ParseFile takes a filepath and returns a PDF if possible
+func ParseFile(bookpath string) (bk *PDF, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			bk = nil
+			err = fmt.Errorf("Unknown error parsing book. Skipping. Error: %s", r)
+		}
+	}()
+
+	data, err := os.ReadFile(bookpath)
+	if err != nil {
+		return nil, err
+	}
+	if !IsPDF(data) {
+		return nil, fmt.Errorf("%s is not a pdf", bookpath)
+	}
+
+	book := new(PDF)
+	book.Title = strings.TrimSuffix(filepath.Base(bookpath), filepath.Ext(bookpath))
+
+	// incremental updates append a new info dict, so the last value wins
+	for _, m := range infoKey.FindAllSubmatch(data, -1) {
+		val := decodeString(m[2])
+		if val == "" {
+			continue
+		}
+		switch string(m[1]) {
+		case "Title":
+			book.Title = val
+		case "Author":
+			book.Author = val
+		case "Subject":
+			book.Description = val
+		case "Lang":
+			book.Language = val
+		case "CreationDate":
+			book.PublishDate = parseDate(val)
+		}
+	}
+
+	if m := xmpTitle.FindSubmatch(data); m != nil {
+		if t := strings.TrimSpace(string(m[1])); t != "" {
+			book.Title = t
+		}
+	}
+
+	return book, nil
+}
+
+// decodeString decodes a pdf literal (string) or hex <string>, both can be UTF-16BE with a BOM
+func decodeString(raw []byte) string {
+	var b []byte
+	if raw[0] == '<' {
+		hex := strings.Join(strings.Fields(string(raw[1:len(raw)-1])), "")
+		if len(hex)%2 == 1 {
+			hex += "0"
+		}
+		for i := 0; i+1 < len(hex); i += 2 {
+			v, _ := strconv.ParseUint(hex[i:i+2], 16, 8)
+			b = append(b, byte(v))
+		}
+	} else {
+		b = unescape(raw[1 : len(raw)-1])
+	}
+
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return strings.TrimSpace(string(utf16.Decode(u)))
+	}
+	// PDFDocEncoding matches latin-1 for all printable characters that matter here
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return strings.TrimSpace(string(r))
+}
+
+func unescape(s []byte) []byte {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case '\r', '\n':
+			// line continuation
+		default:
+			if s[i] >= '0' && s[i] <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				v, _ := strconv.ParseUint(string(s[i:j]), 8, 8)
+				out = append(out, byte(v))
+				i = j - 1
+				continue
+			}
+			out = append(out, s[i])
+		}
+	}
+	return out
+}
+
+// parseDate parses the D:YYYYMMDDHHmmSS format, only the date part is used
+func parseDate(s string) time.Time {
+	s = strings.TrimPrefix(s, "D:")
+	for _, layout := range []string{"20060102", "2006"} {
+		if len(s) >= len(layout) {
+			if t, err := time.Parse(layout, s[:len(layout)]); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
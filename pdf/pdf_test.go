@@ -0,0 +1,83 @@
+package pdf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fixture = `%PDF-1.4
+1 0 obj
+<< /Title (Frankenstein\051 or the \(Modern\) Prometheus) /Author <FEFF004D0061007200790020005300680065006C006C00650079>
+   /Subject (A novel\nin letters) /Lang (en-GB) /CreationDate (D:18180101000000Z) >>
+endobj
+trailer << /Info 1 0 R >>
+%%EOF
+`
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestParseFile(t *testing.T) {
+	for name, tc := range map[string]struct {
+		content string
+		want    PDF
+	}{
+		"info dictionary": {fixture, PDF{
+			Title:       "Frankenstein) or the (Modern) Prometheus",
+			Author:      "Mary Shelley",
+			Language:    "en-GB",
+			Description: "A novel\nin letters",
+			PublishDate: time.Date(1818, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		"incremental update": {fixture + "2 0 obj << /Title (Frankenstein) >> endobj\n%%EOF\n", PDF{
+			Title:       "Frankenstein",
+			Author:      "Mary Shelley",
+			Language:    "en-GB",
+			Description: "A novel\nin letters",
+			PublishDate: time.Date(1818, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		"xmp title": {"%PDF-1.7\n<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">Dracula</rdf:li></rdf:Alt></dc:title>\n/Title (ignored)", PDF{
+			Title: "Dracula",
+		}},
+		"no metadata": {"%PDF-1.4\n%%EOF\n", PDF{
+			Title: "book",
+		}},
+		"truncated string": {fixture[:30], PDF{
+			Title: "book",
+		}},
+		"truncated hex string": {fixture[:110], PDF{
+			Title: "Frankenstein) or the (Modern) Prometheus",
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			book, err := ParseFile(writeFile(t, "book.pdf", []byte(tc.content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *book != tc.want {
+				t.Errorf("expected %+v, got %+v", tc.want, *book)
+			}
+		})
+	}
+}
+
+func TestParseFileInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"empty":         "",
+		"not a pdf":     "BOOKMOBI",
+		"truncated tag": "%PD",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if book, err := ParseFile(writeFile(t, "book.pdf", []byte(content))); err == nil {
+				t.Errorf("expected an error, got %+v", book)
+			}
+		})
+	}
+}
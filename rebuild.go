@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// rebuildBatchSize is the number of books that are added to the new index at once
+const rebuildBatchSize = 100
+
+// searchSchemaVersion is raised whenever books are indexed differently, indexes of an older version are
+// reindexed at startup. Version 2 added the unix dates in meili and the exact fields in the local index.
+const (
+	searchSchemaBucket  = "search_schema"
+	searchSchemaVersion = 2
+)
+
+var errEmptyRebuild = errors.New("no books found in the bookdir, refusing to empty the index")
+
+// libraryLock keeps edits, deletes, author merges and duplicate resolutions out of a rebuild, the new index is
+// built from the index as it was when the rebuild started. Those changes share the read lock.
+var libraryLock sync.RWMutex
+
+// rebuild re-parses every book in the bookdir where it is and replaces the index with the result.
+// Books that are still in the index keep their metadata and added date, so edits that were never
+// written back to the file survive a rebuild.
+func (app *booksingApp) rebuild(user string) (int, error) {
+	// imports move files into the bookdir while we walk it
+	importLock.Lock()
+	defer importLock.Unlock()
+	libraryLock.Lock()
+	defer libraryLock.Unlock()
+
+	known := map[string]Book{}
+	all, err := app.allBooks(SearchFilter{})
+	if err != nil {
+		// losing the index is one of the reasons to rebuild
+		slog.Warn("unable to read the current index, metadata is read from the files", "err", err)
+	}
+	for _, b := range all {
+		for _, f := range b.files() {
+			known[filepath.Clean(f.Path)] = b
+		}
+	}
+
+	var paths []string
+	err = filepath.WalkDir(app.bookDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if formatForFile(p) != nil {
+			paths = append(paths, filepath.Clean(p))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	books := map[string]*Book{}
+	var order []string
+	for _, p := range paths {
+		book, cover, err := ParseBookFile(p)
+		if err != nil {
+			slog.Warn("unable to parse book, skipping it", "path", p, "err", err)
+			continue
+		}
+		file, _ := book.file("")
+		if prev, ok := known[p]; ok {
+			prev.Path = book.Path
+			prev.Size = book.Size
+			prev.Format = book.Format
+			prev.Files = book.Files
+			prev.HasCover = book.HasCover
+			book = &prev
+		}
+
+		if existing, ok := books[book.Hash]; ok {
+			if _, ok := existing.file(file.Format); ok {
+				slog.Warn("book already has a file in this format, skipping it", "path", p, "hash", book.Hash, "format", file.Format)
+				continue
+			}
+			existing.Files = append(existing.files(), file)
+			continue
+		}
+
+		book.CoverPath = ""
+		if _, err := os.Stat(coverPath(p)); err == nil {
+			book.HasCover = true
+			book.CoverPath = coverPath(p)
+		} else if book.HasCover {
+			err = os.WriteFile(coverPath(p), cover, 0644)
+			if err != nil {
+				slog.Warn("unable to write cover", "path", p, "err", err)
+				book.HasCover = false
+			} else {
+				book.CoverPath = coverPath(p)
+			}
+		}
+		books[book.Hash] = book
+		order = append(order, book.Hash)
+	}
+
+	// a bookdir that is not mounted should not wipe the index
+	if len(order) == 0 && len(all) > 0 {
+		return 0, errEmptyRebuild
+	}
+
+	rebuilt := make([]Book, 0, len(order))
+	for _, hash := range order {
+		rebuilt = append(rebuilt, *books[hash])
+	}
+	err = app.replaceIndex(rebuilt)
+	if err != nil {
+		return 0, fmt.Errorf("unable to rebuild index: %w", err)
+	}
+
+	slog.Info("audit: index rebuilt", "user", user, "books", len(order), "files", len(paths))
+	return len(order), nil
+}
+
+// replaceIndex replaces the search index with books and records that the index matches the current schema
+func (app *booksingApp) replaceIndex(books []Book) error {
+	err := app.searchDB.Rebuild(func(add func([]Book) error) error {
+		for batch := range slices.Chunk(books, rebuildBatchSize) {
+			if err := add(batch); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return app.store.put(searchSchemaBucket, app.searchSchemaKey(), searchSchemaVersion)
+}
+
+// searchSchemaKey identifies the index of the configured backend, meili can hold indexes of several instances
+func (app *booksingApp) searchSchemaKey() string {
+	if app.cfg.SearchBackend == "meili" {
+		return app.cfg.SearchBackend + "/" + app.cfg.MeiliIndex
+	}
+	return app.cfg.SearchBackend
+}
+
+// migrateSearchIndex reindexes the books of an index that was created by an older version of booksing.
+// Fields that were added to the index, like the unix dates in meili and the exact fields in the local index,
+// are only filled when a book is added, so without a reindex filters and sorting skip the existing books.
+func (app *booksingApp) migrateSearchIndex() error {
+	var version int
+	err := app.store.get(searchSchemaBucket, app.searchSchemaKey(), &version)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if version >= searchSchemaVersion {
+		return nil
+	}
+
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	count := app.searchDB.GetBookCount()
+	if count == 0 {
+		return app.store.put(searchSchemaBucket, app.searchSchemaKey(), searchSchemaVersion)
+	}
+	slog.Info("search index was created by an older version of booksing, reindexing", "books", count, "version", version, "current", searchSchemaVersion)
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil {
+		return err
+	}
+	// never shrink the index because the old one could not be read completely
+	if len(books) < count {
+		return fmt.Errorf("only %d of %d books could be read from the index, run booksing rebuild", len(books), count)
+	}
+	err = app.replaceIndex(books)
+	if err != nil {
+		return fmt.Errorf("unable to reindex: %w", err)
+	}
+	slog.Info("search index is up to date", "books", len(books))
+	return nil
+}
+
+// rebuildAPI rebuilds the index of the running server, search keeps using the old index until it is done
+func (app *booksingApp) rebuildAPI(w http.ResponseWriter, r *http.Request) {
+	n, err := app.rebuild(getUserFromRequest(r))
+	if errors.Is(err, errEmptyRebuild) {
+		renderError(w, "EMPTY_BOOKDIR", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("rebuild failed", "err", err)
+		renderError(w, "REBUILD_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"books": n})
+}
+
+// runRebuild is the rebuild command, it needs the server to be stopped because the server holds the database.
+// POST /api/rebuild rebuilds while the server keeps running.
+func (app *booksingApp) runRebuild() error {
+	if app.cfg.SearchBackend == "memory" {
+		return errors.New("the memory index only lives in the running server, use POST /api/rebuild instead")
+	}
+	n, err := app.rebuild(cliUser())
+	if err != nil {
+		return err
+	}
+	fmt.Println("indexed", n, "books")
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+const rolesBucket = "roles"
+
+// every role can do everything the roles before it can
+const (
+	roleReader    = "reader"
+	roleUploader  = "uploader"
+	roleLibrarian = "librarian"
+	roleAdmin     = "admin"
+)
+
+var roles = []string{roleReader, roleUploader, roleLibrarian, roleAdmin}
+
+var errUnknownRole = errors.New("unknown role")
+
+type roleAssignment struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+// roleOf returns the role of a user. Configured admins are always admin so they can not lock themselves out,
+// then roles assigned by an admin, the configured librarians and uploaders and finally the default role.
+func (app *booksingApp) roleOf(user string) string {
+	if contains(app.cfg.Admins, user) {
+		return roleAdmin
+	}
+	if user == anonymousUser {
+		return roleReader
+	}
+	var role string
+	if err := app.store.get(rolesBucket, user, &role); err == nil && slices.Contains(roles, role) {
+		return role
+	}
+	if contains(app.cfg.Librarians, user) {
+		return roleLibrarian
+	}
+	if contains(app.cfg.Uploaders, user) {
+		return roleUploader
+	}
+	if slices.Contains(roles, app.cfg.DefaultRole) {
+		return app.cfg.DefaultRole
+	}
+	return roleReader
+}
+
+// hasRole reports whether user has role or a role that includes it
+func (app *booksingApp) hasRole(user, role string) bool {
+	return slices.Index(roles, app.roleOf(user)) >= slices.Index(roles, role)
+}
+
+// requireRole only allows users that have at least role
+func (app *booksingApp) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := getUserFromRequest(r)
+		if !app.hasRole(user, role) {
+			slog.Warn("denied request", "user", user, "role", app.roleOf(user), "required", role, "path", r.URL.Path)
+			renderError(w, "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireUser refuses anonymous requests to things that are saved per user, otherwise everyone without credentials
+// would share them
+func requireUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getUserFromRequest(r) == anonymousUser {
+			renderError(w, "FORBIDDEN", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// listRoles returns the roles assigned by admins
+func (app *booksingApp) listRoles(w http.ResponseWriter, r *http.Request) {
+	assignments := []roleAssignment{}
+	err := app.store.each(rolesBucket, func(key string, val []byte) error {
+		var role string
+		err := json.Unmarshal(val, &role)
+		if err != nil {
+			return err
+		}
+		assignments = append(assignments, roleAssignment{User: key, Role: role})
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to list roles", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, assignments)
+}
+
+// setRoleAPI assigns a role to a user, an empty role removes the assignment
+func (app *booksingApp) setRoleAPI(w http.ResponseWriter, r *http.Request) {
+	var req roleAssignment
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("name")
+	err = app.setRole(name, req.Role)
+	if errors.Is(err, errUnknownRole) {
+		renderError(w, "INVALID_ROLE", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("failed to set role", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("audit: role set", "user", getUserFromRequest(r), "name", name, "role", req.Role)
+	writeJSON(w, roleAssignment{User: name, Role: app.roleOf(name)})
+}
+
+func (app *booksingApp) setRole(user, role string) error {
+	if role == "" {
+		return app.store.delete(rolesBucket, user)
+	}
+	if !slices.Contains(roles, role) {
+		return errUnknownRole
+	}
+	return app.store.put(rolesBucket, user, role)
+}
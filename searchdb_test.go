@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// testSearchDB is the conformance suite every searchDB implementation has to pass.
+// newDB must return an empty database for every call.
+func testSearchDB(t *testing.T, newDB func(t *testing.T) searchDB) {
+	t.Run("AddBooksUpserts", func(t *testing.T) {
+		db := newDB(t)
+		book := testBook("pratchett", "The Colour of Magic", "Terry Pratchett")
+		if err := db.AddBooks([]Book{book}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		book.Title = "The Light Fantastic"
+		if err := db.AddBooks([]Book{book}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		if c := db.GetBookCount(); c != 1 {
+			t.Errorf("expected 1 book after upsert, got %d", c)
+		}
+		got, err := db.GetBook(book.Hash)
+		if err != nil {
+			t.Fatalf("GetBook failed: %v", err)
+		}
+		if got.Title != book.Title {
+			t.Errorf("expected title %q after upsert, got %q", book.Title, got.Title)
+		}
+	})
+
+	t.Run("GetBookRoundTrips", func(t *testing.T) {
+		db := newDB(t)
+		book := testBook("stoker", "Dracula", "Bram Stoker")
+		book.Series = "Classics"
+		book.SeriesIndex = 2.5
+		book.Language = "en"
+		if err := db.AddBooks([]Book{book}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		got, err := db.GetBook(book.Hash)
+		if err != nil {
+			t.Fatalf("GetBook failed: %v", err)
+		}
+		if got.Title != book.Title || got.Author != book.Author || got.Series != book.Series ||
+			got.SeriesIndex != book.SeriesIndex || got.Language != book.Language || !got.Added.Equal(book.Added) {
+			t.Errorf("book did not round trip, expected %+v, got %+v", book, *got)
+		}
+	})
+
+	t.Run("GetBookNotFound", func(t *testing.T) {
+		db := newDB(t)
+		_, err := db.GetBook("doesnotexist")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("HasHash", func(t *testing.T) {
+		db := newDB(t)
+		book := testBook("shelley", "Frankenstein", "Mary Shelley")
+		if err := db.AddBooks([]Book{book}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		ok, err := db.HasHash(book.Hash)
+		if err != nil || !ok {
+			t.Errorf("expected HasHash to be true, got %v (err: %v)", ok, err)
+		}
+		ok, err = db.HasHash("doesnotexist")
+		if err != nil || ok {
+			t.Errorf("expected HasHash to be false, got %v (err: %v)", ok, err)
+		}
+	})
+
+	t.Run("DeleteBook", func(t *testing.T) {
+		db := newDB(t)
+		keep := testBook("austen", "Emma", "Jane Austen")
+		remove := testBook("melville", "Moby Dick", "Herman Melville")
+		if err := db.AddBooks([]Book{keep, remove}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		if err := db.DeleteBook(remove.Hash); err != nil {
+			t.Fatalf("DeleteBook failed: %v", err)
+		}
+
+		if c := db.GetBookCount(); c != 1 {
+			t.Errorf("expected 1 book after delete, got %d", c)
+		}
+		if ok, _ := db.HasHash(remove.Hash); ok {
+			t.Errorf("expected deleted book to be gone")
+		}
+		if _, err := db.GetBook(remove.Hash); !errors.Is(err, ErrNotFound) {
+			t.Errorf("expected ErrNotFound for deleted book, got %v", err)
+		}
+		if ok, _ := db.HasHash(keep.Hash); !ok {
+			t.Errorf("expected other book to be kept")
+		}
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		db := newDB(t)
+		old := testBook("austen", "Emma", "Jane Austen")
+		kept := testBook("melville", "Moby Dick", "Herman Melville")
+		if err := db.AddBooks([]Book{old, kept}); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		added := testBook("stoker", "Dracula", "Bram Stoker")
+		err := db.Rebuild(func(add func([]Book) error) error {
+			if c := db.GetBookCount(); c != 2 {
+				t.Errorf("expected the old books to be searchable during the rebuild, got %d", c)
+			}
+			return add([]Book{kept, added})
+		})
+		if err != nil {
+			t.Fatalf("Rebuild failed: %v", err)
+		}
+
+		if c := db.GetBookCount(); c != 2 {
+			t.Errorf("expected 2 books after rebuild, got %d", c)
+		}
+		if ok, _ := db.HasHash(old.Hash); ok {
+			t.Errorf("expected book that was not rebuilt to be gone")
+		}
+		res, err := db.GetBooks(SearchQuery{Query: "dracula", Limit: 10})
+		if err != nil {
+			t.Fatalf("GetBooks failed: %v", err)
+		}
+		if len(res.Items) != 1 || res.Items[0].Hash != added.Hash {
+			t.Errorf("expected the rebuilt book to be searchable, got %v", res.Items)
+		}
+	})
+
+	t.Run("GetBooksPaginates", func(t *testing.T) {
+		db := newDB(t)
+		var books []Book
+		for i := 0; i < 25; i++ {
+			books = append(books, testBook(fmt.Sprintf("volume%02d", i), fmt.Sprintf("Chronicles Volume %02d", i), "Anne Author"))
+		}
+		if err := db.AddBooks(books); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		seen := make(map[string]bool)
+		for _, page := range []struct {
+			offset   int64
+			expected int
+		}{
+			{0, 10},
+			{10, 10},
+			{20, 5},
+			{30, 0},
+		} {
+			res, err := db.GetBooks(SearchQuery{Query: "chronicles", Limit: 10, Offset: page.offset})
+			if err != nil {
+				t.Fatalf("GetBooks failed: %v", err)
+			}
+			if res.Total != 25 {
+				t.Errorf("expected total of 25 at offset %d, got %d", page.offset, res.Total)
+			}
+			if len(res.Items) != page.expected {
+				t.Errorf("expected %d items at offset %d, got %d", page.expected, page.offset, len(res.Items))
+			}
+			for _, b := range res.Items {
+				if seen[b.Hash] {
+					t.Errorf("book %s returned on more than one page", b.Hash)
+				}
+				seen[b.Hash] = true
+			}
+		}
+		if len(seen) != 25 {
+			t.Errorf("expected to see all 25 books, saw %d", len(seen))
+		}
+	})
+
+	t.Run("GetBooksFilters", func(t *testing.T) {
+		db := newDB(t)
+		if err := db.AddBooks(testFilterBooks()); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		for name, tc := range map[string]struct {
+			query    string
+			filter   SearchFilter
+			expected int64
+		}{
+			"language":        {"", SearchFilter{Language: "nl"}, 1},
+			"author":          {"", SearchFilter{Author: "Terry Pratchett"}, 3},
+			"series":          {"", SearchFilter{Series: "Discworld"}, 2},
+			"combined":        {"", SearchFilter{Author: "Terry Pratchett", Language: "en"}, 2},
+			"with query":      {"light", SearchFilter{Series: "Discworld"}, 1},
+			"isbn":            {"", SearchFilter{ISBN: "9780141439846"}, 1},
+			"published after": {"", SearchFilter{PublishedAfter: time.Date(1985, 1, 1, 0, 0, 0, 0, time.UTC)}, 2},
+			"published range": {"", SearchFilter{
+				PublishedAfter:  time.Date(1800, 1, 1, 0, 0, 0, 0, time.UTC),
+				PublishedBefore: time.Date(1984, 1, 1, 0, 0, 0, 0, time.UTC),
+			}, 2},
+		} {
+			res, err := db.GetBooks(SearchQuery{Query: tc.query, Limit: 10, Filter: tc.filter})
+			if err != nil {
+				t.Fatalf("%s: GetBooks failed: %v", name, err)
+			}
+			if res.Total != tc.expected || int64(len(res.Items)) != tc.expected {
+				t.Errorf("%s: expected %d results, got %d (total %d)", name, tc.expected, len(res.Items), res.Total)
+			}
+		}
+	})
+
+	t.Run("GetBooksFacets", func(t *testing.T) {
+		db := newDB(t)
+		if err := db.AddBooks(testFilterBooks()); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		res, err := db.GetBooks(SearchQuery{Limit: 10, Facets: []string{"Language", "Series"}})
+		if err != nil {
+			t.Fatalf("GetBooks failed: %v", err)
+		}
+		if c := res.Facets["Language"]["en"]; c != 3 {
+			t.Errorf("expected 3 english books, got %d", c)
+		}
+		if c := res.Facets["Series"]["Discworld"]; c != 2 {
+			t.Errorf("expected 2 Discworld books, got %d", c)
+		}
+		if _, ok := res.Facets["Series"][""]; ok {
+			t.Errorf("books without series should not be counted as a facet value")
+		}
+
+		res, err = db.GetBooks(SearchQuery{Limit: 10, Filter: SearchFilter{Language: "nl"}, Facets: []string{"Author"}})
+		if err != nil {
+			t.Fatalf("GetBooks failed: %v", err)
+		}
+		if c := res.Facets["Author"]["Terry Pratchett"]; c != 1 || len(res.Facets["Author"]) != 1 {
+			t.Errorf("expected facets to only count filtered books, got %v", res.Facets["Author"])
+		}
+	})
+
+	t.Run("GetBooksSorts", func(t *testing.T) {
+		db := newDB(t)
+		books := testFilterBooks()
+		for i := range books {
+			books[i].Added = time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC)
+		}
+		if err := db.AddBooks(books); err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		for name, tc := range map[string]struct {
+			filter   SearchFilter
+			sort     []SortOrder
+			expected []string
+		}{
+			"newest first": {SearchFilter{}, []SortOrder{{Field: "Added", Descending: true}},
+				[]string{"stokerdracula", "pratchettkleur", "pratchettlight", "pratchettcolour"}},
+			"title": {SearchFilter{}, []SortOrder{{Field: "Title"}},
+				[]string{"pratchettkleur", "stokerdracula", "pratchettcolour", "pratchettlight"}},
+			"series order": {SearchFilter{Series: "Discworld"}, []SortOrder{{Field: "SeriesIndex", Descending: true}},
+				[]string{"pratchettlight", "pratchettcolour"}},
+			"oldest publication": {SearchFilter{}, []SortOrder{{Field: "PublishDate"}},
+				[]string{"stokerdracula", "pratchettcolour", "pratchettlight", "pratchettkleur"}},
+		} {
+			res, err := db.GetBooks(SearchQuery{Limit: 10, Filter: tc.filter, Sort: tc.sort})
+			if err != nil {
+				t.Fatalf("%s: GetBooks failed: %v", name, err)
+			}
+			var got []string
+			for _, b := range res.Items {
+				got = append(got, b.Hash)
+			}
+			if !slices.Equal(got, tc.expected) {
+				t.Errorf("%s: expected order %v, got %v", name, tc.expected, got)
+			}
+		}
+	})
+
+	t.Run("GetBooksMatches", func(t *testing.T) {
+		db := newDB(t)
+		err := db.AddBooks([]Book{
+			testBook("pratchett", "The Colour of Magic", "Terry Pratchett"),
+			testBook("stoker", "Dracula", "Bram Stoker"),
+		})
+		if err != nil {
+			t.Fatalf("AddBooks failed: %v", err)
+		}
+
+		for q, expected := range map[string]int{
+			"":          2,
+			"dracula":   1,
+			"pratchett": 1,
+			"magic":     1,
+			"tolkien":   0,
+		} {
+			res, err := db.GetBooks(SearchQuery{Query: q, Limit: 10})
+			if err != nil {
+				t.Fatalf("GetBooks(%q) failed: %v", q, err)
+			}
+			if res.Total != int64(expected) || len(res.Items) != expected {
+				t.Errorf("expected %d results for %q, got %d (total %d)", expected, q, len(res.Items), res.Total)
+			}
+		}
+	})
+}
+
+func testFilterBooks() []Book {
+	colour := testBook("pratchettcolour", "The Colour of Magic", "Terry Pratchett")
+	colour.Series, colour.SeriesIndex, colour.Language = "Discworld", 1, "en"
+	colour.PublishDate = time.Date(1983, 11, 24, 0, 0, 0, 0, time.UTC)
+	light := testBook("pratchettlight", "The Light Fantastic", "Terry Pratchett")
+	light.Series, light.SeriesIndex, light.Language = "Discworld", 2, "en"
+	light.PublishDate = time.Date(1986, 6, 2, 0, 0, 0, 0, time.UTC)
+	kleur := testBook("pratchettkleur", "De Kleur van Toverij", "Terry Pratchett")
+	kleur.Series, kleur.SeriesIndex, kleur.Language = "Schijfwereld", 1, "nl"
+	kleur.PublishDate = time.Date(1995, 1, 1, 0, 0, 0, 0, time.UTC)
+	dracula := testBook("stokerdracula", "Dracula", "Bram Stoker")
+	dracula.Language = "en"
+	dracula.ISBN = "9780141439846"
+	dracula.PublishDate = time.Date(1897, 5, 26, 0, 0, 0, 0, time.UTC)
+	return []Book{colour, light, kleur, dracula}
+}
+
+func testBook(hash, title, author string) Book {
+	return Book{
+		Hash:   hash,
+		Title:  title,
+		Author: author,
+		Added:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestMemoryDB(t *testing.T) {
+	testSearchDB(t, func(t *testing.T) searchDB {
+		return NewMemorySearch()
+	})
+}
+
+func TestBleveDB(t *testing.T) {
+	testSearchDB(t, func(t *testing.T) searchDB {
+		db, err := NewBleveSearch(t.TempDir())
+		if err != nil {
+			t.Fatalf("unable to create bleve index: %v", err)
+		}
+		t.Cleanup(func() {
+			db.index.Close()
+		})
+		return db
+	})
+}
+
+func TestMigrateBleveIndex(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.SearchBackend = "local"
+
+	// an index from before the exact fields only analyzed the text
+	dir := t.TempDir()
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = bleve.NewDocumentStaticMapping()
+	m.DefaultMapping.AddFieldMappingsAt("Title", bleve.NewTextFieldMapping())
+	old, err := bleve.New(filepath.Join(dir, bleveIndexName), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &bleveDB{index: old, path: filepath.Join(dir, bleveIndexName)}
+	t.Cleanup(func() {
+		db.index.Close()
+	})
+	if err := db.AddBooks(testFilterBooks()); err != nil {
+		t.Fatal(err)
+	}
+	app.searchDB = db
+
+	filter := SearchQuery{Limit: 10, Filter: SearchFilter{Author: "Terry Pratchett"}}
+	if res, err := db.GetBooks(filter); err != nil || res.Total != 0 {
+		t.Fatalf("expected the old index to miss the exact fields, got %v (%v)", res, err)
+	}
+
+	if err := app.migrateSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.GetBooks(filter)
+	if err != nil || res.Total != 3 {
+		t.Errorf("expected 3 books by author after the migration, got %v (%v)", res, err)
+	}
+
+	var version int
+	if err := app.store.get(searchSchemaBucket, "local", &version); err != nil || version != searchSchemaVersion {
+		t.Errorf("expected version %d to be stored, got %d (%v)", searchSchemaVersion, version, err)
+	}
+}
+
+// TestMeiliDB only runs when a meilisearch instance is available, each test gets a fresh index
+func TestMeiliDB(t *testing.T) {
+	addr := os.Getenv("BOOKSING_TEST_MEILIADDRESS")
+	if addr == "" {
+		t.Skip("BOOKSING_TEST_MEILIADDRESS not set")
+	}
+	testSearchDB(t, func(t *testing.T) searchDB {
+		name := fmt.Sprintf("booksing-test-%d", time.Now().UnixNano())
+		db, err := NewMeiliSearch(addr, os.Getenv("BOOKSING_TEST_MEILISECRET"), name)
+		if err != nil {
+			t.Fatalf("unable to create meili index: %v", err)
+		}
+		t.Cleanup(func() {
+			_, _ = db.db.DeleteIndex(name)
+		})
+		return db
+	})
+}
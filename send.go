@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const devicesBucket = "devices"
+
+// device is an e-reader that accepts books by email, like a kindle
+type device struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+var (
+	errSendDisabled  = errors.New("no smtp server configured")
+	errUnknownDevice = errors.New("unknown device")
+	errSendTooBig    = errors.New("book is larger than the send limit")
+)
+
+// listDevices returns the saved devices of the current user
+func (app *booksingApp) listDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := app.userDevices(getUserFromRequest(r))
+	if err != nil {
+		slog.Error("failed to list devices", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, devices)
+}
+
+// saveDevices replaces the saved devices of the current user
+func (app *booksingApp) saveDevices(w http.ResponseWriter, r *http.Request) {
+	var devices []device
+	err := json.NewDecoder(r.Body).Decode(&devices)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	for i, d := range devices {
+		addr, err := mail.ParseAddress(d.Email)
+		if err != nil {
+			renderError(w, "INVALID_EMAIL", http.StatusBadRequest)
+			return
+		}
+		devices[i].Email = addr.Address
+		devices[i].Name = strings.TrimSpace(d.Name)
+		if devices[i].Name == "" {
+			devices[i].Name = addr.Address
+		}
+	}
+
+	err = app.store.put(devicesBucket, getUserFromRequest(r), devices)
+	if err != nil {
+		slog.Error("failed to save devices", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, devices)
+}
+
+func (app *booksingApp) userDevices(user string) ([]device, error) {
+	devices := []device{}
+	err := app.store.get(devicesBucket, user, &devices)
+	if errors.Is(err, ErrNotFound) {
+		return devices, nil
+	}
+	return devices, err
+}
+
+// sendBookAPI emails a book to one of the saved devices of the user, to is the name or address of the device
+func (app *booksingApp) sendBookAPI(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	to := r.URL.Query().Get("to")
+	if hash == "" || to == "" {
+		renderError(w, "MISSING_PARAMETER", http.StatusBadRequest)
+		return
+	}
+	user := getUserFromRequest(r)
+
+	book, err := app.searchDB.GetBook(hash)
+	if errors.Is(err, ErrNotFound) {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not find book", "err", err, "hash", hash)
+		renderError(w, "SEND_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	// without a format the primary file is sent, which is not always an epub
+	file, ok := book.file(r.URL.Query().Get("format"))
+	if !ok {
+		renderError(w, "FORMAT_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+
+	addr, err := app.sendBook(user, to, book, file)
+	switch {
+	case errors.Is(err, errSendDisabled):
+		renderError(w, "SEND_DISABLED", http.StatusNotImplemented)
+		return
+	case errors.Is(err, errUnknownDevice):
+		renderError(w, "UNKNOWN_DEVICE", http.StatusBadRequest)
+		return
+	case errors.Is(err, errSendTooBig):
+		renderError(w, "FILE_TOO_BIG", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		slog.Error("failed to send book", "err", err, "hash", hash)
+		renderError(w, "SEND_FAILED", http.StatusBadGateway)
+		return
+	}
+
+	app.trackDownload(webHookData{
+		IPs:    getIPFromRequest(r),
+		User:   user,
+		Hash:   hash,
+		Action: webHookSend,
+		Format: file.Format,
+		To:     addr,
+	}, book, r.UserAgent())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendBook mails the file to the device of user, it returns the address the book was sent to
+func (app *booksingApp) sendBook(user, to string, book *Book, file BookFile) (string, error) {
+	if app.cfg.SMTPAddress == "" {
+		return "", errSendDisabled
+	}
+	devices, err := app.userDevices(user)
+	if err != nil {
+		return "", err
+	}
+	addr := ""
+	for _, d := range devices {
+		if d.Name == to || strings.EqualFold(d.Email, to) {
+			addr = d.Email
+			break
+		}
+	}
+	if addr == "" {
+		return "", fmt.Errorf("%w: %s", errUnknownDevice, to)
+	}
+
+	fi, err := os.Stat(file.Path)
+	if err != nil {
+		return "", err
+	}
+	// mail servers limit the size of the message, the attachment is base64 encoded which makes it a third larger
+	encoded := int64(base64.StdEncoding.EncodedLen(int(fi.Size())))
+	if app.cfg.SendMaxSize > 0 && encoded > app.cfg.SendMaxSize {
+		return "", fmt.Errorf("%w: %d bytes encoded", errSendTooBig, encoded)
+	}
+	content, err := os.ReadFile(file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := app.bookMail(addr, book, filepath.Base(file.Path), formatByName(file.Format).ContentType, content)
+	if err != nil {
+		return "", err
+	}
+
+	var auth smtp.Auth
+	if app.cfg.SMTPUser != "" {
+		host, _, _ := strings.Cut(app.cfg.SMTPAddress, ":")
+		auth = smtp.PlainAuth("", app.cfg.SMTPUser, app.cfg.SMTPPassword, host)
+	}
+	err = smtp.SendMail(app.cfg.SMTPAddress, auth, app.cfg.SMTPFrom, []string{addr}, msg)
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("book sent", "user", user, "hash", book.Hash, "to", addr, "size", fi.Size())
+	return addr, nil
+}
+
+// bookMail builds a multipart message with the book as attachment
+func (app *booksingApp) bookMail(to string, book *Book, fileName, contentType string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", app.cfg.SMTPFrom)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", book.Title))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "%s by %s, sent from booksing.\r\n", book.Title, book.Author)
+
+	att, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(contentType, map[string]string{"name": fileName})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": fileName})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// base64 lines can not be longer than 76 characters in a mail
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		fmt.Fprintf(att, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(att, "%s\r\n", encoded)
+
+	err = mw.Close()
+	return buf.Bytes(), err
+}
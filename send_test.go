@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+)
+
+// smtpStandIn accepts mail on a local port and hands every message to the returned channel
+func smtpStandIn(t *testing.T) (string, <-chan []byte) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	msgs := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, msgs)
+		}
+	}()
+	return l.Addr().String(), msgs
+}
+
+func serveSMTP(conn net.Conn, msgs chan<- []byte) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	reply := func(s string) {
+		rw.WriteString(s + "\r\n")
+		rw.Flush()
+	}
+
+	reply("220 localhost ready")
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var msg bytes.Buffer
+			for {
+				l, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				msg.WriteString(strings.TrimPrefix(l, "."))
+			}
+			msgs <- msg.Bytes()
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSendBook(t *testing.T) {
+	addr, msgs := smtpStandIn(t)
+	app := newTestApp(t)
+	app.cfg.SMTPAddress = addr
+	app.cfg.SMTPFrom = "booksing@example.com"
+	app.cfg.SendMaxSize = 50 * 1024 * 1024
+	importTestBooks(t, app, "pg84.epub")
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil || len(books) != 1 {
+		t.Fatalf("expected 1 book, got %d (%v)", len(books), err)
+	}
+	book := books[0]
+
+	// without authentication there is nobody to save devices for
+	rec := httptest.NewRecorder()
+	requireUser(app.saveDevices)(rec, httptest.NewRequest(http.MethodPut, "/api/devices",
+		strings.NewReader(`[{"name":"kindle","email":"reader@kindle.com"}]`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected anonymous requests to be refused, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.saveDevices(rec, httptest.NewRequest(http.MethodPut, "/api/devices",
+		strings.NewReader(`[{"name":"kindle","email":"reader@kindle.com"}]`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unable to save device: %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.sendBookAPI(rec, httptest.NewRequest(http.MethodPost, "/api/send?hash="+book.Hash+"&to=nobody@example.com", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected unknown devices to be refused, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.sendBookAPI(rec, httptest.NewRequest(http.MethodPost, "/api/send?hash="+book.Hash+"&to=kindle", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected send to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(<-msgs))
+	if err != nil {
+		t.Fatalf("unable to parse mail: %v", err)
+	}
+	if to := msg.Header.Get("To"); to != "reader@kindle.com" {
+		t.Errorf("unexpected recipient %q", to)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var attachment []byte
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if p.FileName() != "" {
+			attachment, _ = io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+		}
+	}
+	original, _ := os.ReadFile(book.Path)
+	if !bytes.Equal(attachment, original) {
+		t.Errorf("expected the epub as attachment, got %d bytes", len(attachment))
+	}
+
+	// the limit applies to the encoded attachment, not the file
+	app.cfg.SendMaxSize = int64(len(original)) + 1
+	rec = httptest.NewRecorder()
+	app.sendBookAPI(rec, httptest.NewRequest(http.MethodPost, "/api/send?hash="+book.Hash+"&to=kindle", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the size limit to be enforced, got %d", rec.Code)
+	}
+}
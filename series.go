@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+)
+
+type seriesSummary struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+type seriesDetail struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Books []Book `json:"books"`
+	// Missing lists the whole volume numbers that are not in the library, up to the highest known volume
+	Missing []int `json:"missing"`
+}
+
+// listSeries returns all series with the number of books per series
+func (app *booksingApp) listSeries(w http.ResponseWriter, r *http.Request) {
+	res, err := app.searchDB.GetBooks(SearchQuery{
+		Facets: []string{"Series"},
+	})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+
+	series := []seriesSummary{}
+	for name, count := range res.Facets["Series"] {
+		series = append(series, seriesSummary{Name: name, Count: count})
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+
+	writeJSON(w, series)
+}
+
+// getSeries returns all books in a series in reading order
+func (app *booksingApp) getSeries(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	books, err := app.allBooks(SearchFilter{Series: name})
+	if err != nil {
+		slog.Error("failed to search DB", "err", err)
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
+	}
+	if len(books) == 0 {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		if books[i].SeriesIndex != books[j].SeriesIndex {
+			return books[i].SeriesIndex < books[j].SeriesIndex
+		}
+		return books[i].Title < books[j].Title
+	})
+
+	writeJSON(w, seriesDetail{
+		Name:    name,
+		Count:   len(books),
+		Books:   app.trimCoverPaths(books),
+		Missing: missingVolumes(books),
+	})
+}
+
+// missingVolumes returns the volumes between 1 and the highest volume that are not present,
+// books without an index or with a partial index (like 2.5 for a novella) do not count
+func missingVolumes(books []Book) []int {
+	have := make(map[int]bool)
+	highest := 0
+	for _, b := range books {
+		if b.SeriesIndex < 1 || b.SeriesIndex != math.Trunc(b.SeriesIndex) {
+			continue
+		}
+		i := int(b.SeriesIndex)
+		have[i] = true
+		if i > highest {
+			highest = i
+		}
+	}
+
+	missing := []int{}
+	for i := 1; i < highest; i++ {
+		if !have[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
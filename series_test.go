@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func seriesBooks(series string, indexes ...float64) []Book {
+	var books []Book
+	for i, idx := range indexes {
+		b := testBook(series+string(rune('a'+i)), series+" "+string(rune('A'+i)), "Author")
+		b.Series, b.SeriesIndex = series, idx
+		books = append(books, b)
+	}
+	return books
+}
+
+func TestMissingVolumes(t *testing.T) {
+	for name, tc := range map[string]struct {
+		indexes []float64
+		want    []int
+	}{
+		"complete":         {[]float64{1, 2, 3}, []int{}},
+		"gaps":             {[]float64{1, 4, 6}, []int{2, 3, 5}},
+		"unordered":        {[]float64{5, 1, 3}, []int{2, 4}},
+		"fractional":       {[]float64{1, 2.5, 4}, []int{2, 3}},
+		"only fractional":  {[]float64{0.5, 1.5}, []int{}},
+		"duplicate index":  {[]float64{1, 3, 3}, []int{2}},
+		"no index":         {[]float64{0, 0}, []int{}},
+		"negative index":   {[]float64{-1, 2}, []int{1}},
+		"starts after one": {[]float64{3}, []int{1, 2}},
+		"empty":            {nil, []int{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := missingVolumes(seriesBooks("s", tc.indexes...))
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	app := newTestApp(t)
+	discworld := seriesBooks("Discworld", 3, 1, 2.5, 2, 2, 0)
+	// books with the same index are in title order, books without one go first
+	discworld[3].Title, discworld[4].Title = "The Light Fantastic", "Equal Rites"
+	books := append(discworld, seriesBooks("Wheel of Time", 1, 2)...)
+	if err := app.searchDB.AddBooks(books); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	app.listSeries(rec, httptest.NewRequest(http.MethodGet, "/api/series", nil))
+	var series []seriesSummary
+	if err := json.NewDecoder(rec.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	want := []seriesSummary{{"Discworld", 6}, {"Wheel of Time", 2}}
+	if !slices.Equal(series, want) {
+		t.Errorf("expected %v, got %v", want, series)
+	}
+
+	get := func(name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/series/"+name, nil)
+		req.SetPathValue("name", name)
+		app.getSeries(rec, req)
+		return rec
+	}
+	var detail seriesDetail
+	if err := json.NewDecoder(get("Discworld").Body).Decode(&detail); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, b := range detail.Books {
+		order = append(order, b.Title)
+	}
+	wantOrder := []string{discworld[5].Title, discworld[1].Title, "Equal Rites", "The Light Fantastic", discworld[2].Title, discworld[0].Title}
+	if !slices.Equal(order, wantOrder) {
+		t.Errorf("expected reading order %v, got %v", wantOrder, order)
+	}
+	if detail.Count != 6 || len(detail.Missing) != 0 {
+		t.Errorf("expected 6 books and no missing volumes, got %d and %v", detail.Count, detail.Missing)
+	}
+
+	if rec := get("Malazan"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown series to return 404, got %d", rec.Code)
+	}
+}
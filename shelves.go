@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shelves are ordered lists of books that belong to a user. Every user has a want to read and a favorites shelf,
+// other shelves are created by the user. A shelf can be shared with a read-only link.
+
+const (
+	shelvesBucket     = "shelves"
+	shelfSharesBucket = "shelf_shares"
+
+	shelfWantToRead = "want-to-read"
+	shelfFavorites  = "favorites"
+)
+
+// builtinShelves always exist, they can not be renamed or deleted
+var builtinShelves = []struct{ id, name string }{
+	{shelfWantToRead, "Want to read"},
+	{shelfFavorites, "Favorites"},
+}
+
+var (
+	errShelfBuiltin  = errors.New("built-in shelves can not be changed")
+	errShelfNotFound = errors.New("book is not on the shelf")
+	errShelfOrder    = errors.New("order must contain every book on the shelf once")
+)
+
+// shelfLock serializes changes to shelves, every change reads and writes the whole shelf
+var shelfLock sync.Mutex
+
+type shelf struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Name    string    `json:"name"`
+	Builtin bool      `json:"builtin"`
+	Books   []string  `json:"books"`
+	Share   string    `json:"share,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// shelfRef is what a share link points to
+type shelfRef struct {
+	User string `json:"user"`
+	ID   string `json:"id"`
+}
+
+type shelfDetail struct {
+	shelf
+	// Items are the books that are still in the library, in the order of the shelf
+	Items []Book `json:"items"`
+}
+
+type shelfRequest struct {
+	Name  string   `json:"name"`
+	Hash  string   `json:"hash"`
+	Books []string `json:"books"`
+}
+
+func shelfKey(user, id string) string {
+	return user + "/" + id
+}
+
+// getShelf returns a shelf of the user, built-in shelves that were never changed are returned empty
+func (app *booksingApp) getShelf(user, id string) (*shelf, error) {
+	var s shelf
+	err := app.store.get(shelvesBucket, shelfKey(user, id), &s)
+	if err == nil {
+		return &s, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	for _, b := range builtinShelves {
+		if b.id == id {
+			return &shelf{ID: id, User: user, Name: b.name, Builtin: true, Books: []string{}}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (app *booksingApp) saveShelf(s *shelf) error {
+	s.Updated = time.Now().In(app.timezone)
+	if s.Created.IsZero() {
+		s.Created = s.Updated
+	}
+	return app.store.put(shelvesBucket, shelfKey(s.User, s.ID), s)
+}
+
+// userShelves returns the built-in shelves followed by the other shelves of the user ordered by name
+func (app *booksingApp) userShelves(user string) ([]shelf, error) {
+	var custom []shelf
+	prefix := shelfKey(user, "")
+	err := app.store.each(shelvesBucket, func(key string, val []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		var s shelf
+		err := json.Unmarshal(val, &s)
+		if err != nil {
+			return err
+		}
+		// user names can contain a slash, the key prefix alone is not enough
+		if s.User == user && !s.Builtin {
+			custom = append(custom, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(custom, func(a, b shelf) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+
+	shelves := []shelf{}
+	for _, b := range builtinShelves {
+		s, err := app.getShelf(user, b.id)
+		if err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, *s)
+	}
+	return append(shelves, custom...), nil
+}
+
+// changeShelf applies fn to a shelf of the user and saves it
+func (app *booksingApp) changeShelf(user, id string, fn func(s *shelf) error) (*shelf, error) {
+	shelfLock.Lock()
+	defer shelfLock.Unlock()
+
+	s, err := app.getShelf(user, id)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(s)
+	if err != nil {
+		return nil, err
+	}
+	return s, app.saveShelf(s)
+}
+
+// shelfBooks returns the books on the shelf in order, books that were deleted from the library are skipped
+func (app *booksingApp) shelfBooks(s *shelf) []Book {
+	books := []Book{}
+	for _, hash := range s.Books {
+		b, err := app.searchDB.GetBook(hash)
+		if err != nil {
+			continue
+		}
+		books = append(books, *b)
+	}
+	return books
+}
+
+// sharedShelf returns the shelf a share link points to
+func (app *booksingApp) sharedShelf(token string) (*shelf, error) {
+	var ref shelfRef
+	err := app.store.get(shelfSharesBucket, token, &ref)
+	if err != nil {
+		return nil, err
+	}
+	s, err := app.getShelf(ref.User, ref.ID)
+	if err != nil {
+		return nil, err
+	}
+	// the link was revoked while a new one was made
+	if s.Share != token {
+		return nil, ErrNotFound
+	}
+	return s, nil
+}
+
+// rehashShelves points the shelf entries of a book to its new hash, editing the title or author of a book changes its hash
+func (app *booksingApp) rehashShelves(oldHash, newHash string) error {
+	shelfLock.Lock()
+	defer shelfLock.Unlock()
+
+	var changed []shelf
+	err := app.store.each(shelvesBucket, func(_ string, val []byte) error {
+		var s shelf
+		err := json.Unmarshal(val, &s)
+		if err != nil {
+			return err
+		}
+		i := slices.Index(s.Books, oldHash)
+		if i < 0 {
+			return nil
+		}
+		if slices.Contains(s.Books, newHash) {
+			s.Books = slices.Delete(s.Books, i, i+1)
+		} else {
+			s.Books[i] = newHash
+		}
+		changed = append(changed, s)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range changed {
+		errs = append(errs, app.saveShelf(&s))
+	}
+	return errors.Join(errs...)
+}
+
+// sharedBook finds a book on a shared shelf, books that are not on the shelf can not be reached with the link
+func (app *booksingApp) sharedBook(token, hash string) (*Book, error) {
+	s, err := app.sharedShelf(token)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(s.Books, hash) {
+		return nil, ErrNotFound
+	}
+	return app.searchDB.GetBook(hash)
+}
+
+// deleteUserShelves removes all shelves and share links of a user
+func (app *booksingApp) deleteUserShelves(user string) error {
+	shelves, err := app.userShelves(user)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range shelves {
+		if s.Share != "" {
+			errs = append(errs, app.store.delete(shelfSharesBucket, s.Share))
+		}
+		errs = append(errs, app.store.delete(shelvesBucket, shelfKey(user, s.ID)))
+	}
+	return errors.Join(errs...)
+}
+
+func renderShelfError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, errShelfNotFound):
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+	case errors.Is(err, errShelfBuiltin):
+		renderError(w, "BUILTIN_SHELF", http.StatusBadRequest)
+	case errors.Is(err, errShelfOrder):
+		renderError(w, "INVALID_ORDER", http.StatusBadRequest)
+	default:
+		slog.Error("failed to update shelf", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+	}
+}
+
+// listShelves returns the shelves of the current user
+func (app *booksingApp) listShelves(w http.ResponseWriter, r *http.Request) {
+	shelves, err := app.userShelves(getUserFromRequest(r))
+	if err != nil {
+		slog.Error("failed to list shelves", "err", err)
+		renderError(w, "LIST_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, shelves)
+}
+
+// addShelf creates a new shelf for the current user
+func (app *booksingApp) addShelf(w http.ResponseWriter, r *http.Request) {
+	var req shelfRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Name) == "" {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	s := &shelf{
+		ID:    randToken(8),
+		User:  getUserFromRequest(r),
+		Name:  strings.TrimSpace(req.Name),
+		Books: []string{},
+	}
+	err = app.saveShelf(s)
+	if err != nil {
+		slog.Error("failed to store shelf", "err", err)
+		renderError(w, "SAVE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// getShelfAPI returns a shelf of the current user with its books
+func (app *booksingApp) getShelfAPI(w http.ResponseWriter, r *http.Request) {
+	s, err := app.getShelf(getUserFromRequest(r), r.PathValue("id"))
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	writeJSON(w, shelfDetail{*s, app.trimCoverPaths(app.shelfBooks(s))})
+}
+
+// renameShelf changes the name of a shelf of the current user
+func (app *booksingApp) renameShelf(w http.ResponseWriter, r *http.Request) {
+	var req shelfRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Name) == "" {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	s, err := app.changeShelf(getUserFromRequest(r), r.PathValue("id"), func(s *shelf) error {
+		if s.Builtin {
+			return errShelfBuiltin
+		}
+		s.Name = strings.TrimSpace(req.Name)
+		return nil
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// deleteShelf removes a shelf of the current user and its share link
+func (app *booksingApp) deleteShelf(w http.ResponseWriter, r *http.Request) {
+	shelfLock.Lock()
+	defer shelfLock.Unlock()
+
+	user := getUserFromRequest(r)
+	s, err := app.getShelf(user, r.PathValue("id"))
+	if err == nil && s.Builtin {
+		err = errShelfBuiltin
+	}
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	if s.Share != "" {
+		err = app.store.delete(shelfSharesBucket, s.Share)
+	}
+	if err == nil {
+		err = app.store.delete(shelvesBucket, shelfKey(user, s.ID))
+	}
+	if err != nil {
+		slog.Error("failed to delete shelf", "err", err)
+		renderError(w, "DELETE_FAILED", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addToShelf puts a book at the end of a shelf, books that are already on it stay where they are
+func (app *booksingApp) addToShelf(w http.ResponseWriter, r *http.Request) {
+	var req shelfRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Hash == "" {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	if _, err := app.searchDB.GetBook(req.Hash); err != nil {
+		renderError(w, "BOOK_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	s, err := app.changeShelf(getUserFromRequest(r), r.PathValue("id"), func(s *shelf) error {
+		if !slices.Contains(s.Books, req.Hash) {
+			s.Books = append(s.Books, req.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// removeFromShelf takes a book off a shelf
+func (app *booksingApp) removeFromShelf(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	s, err := app.changeShelf(getUserFromRequest(r), r.PathValue("id"), func(s *shelf) error {
+		i := slices.Index(s.Books, hash)
+		if i < 0 {
+			return errShelfNotFound
+		}
+		s.Books = slices.Delete(s.Books, i, i+1)
+		return nil
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// reorderShelf puts the books of a shelf in the given order, it has to contain every book on the shelf
+func (app *booksingApp) reorderShelf(w http.ResponseWriter, r *http.Request) {
+	var req shelfRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		renderError(w, "INVALID_REQUEST", http.StatusBadRequest)
+		return
+	}
+	s, err := app.changeShelf(getUserFromRequest(r), r.PathValue("id"), func(s *shelf) error {
+		current := slices.Clone(s.Books)
+		order := slices.Clone(req.Books)
+		slices.Sort(current)
+		slices.Sort(order)
+		if !slices.Equal(current, order) {
+			return errShelfOrder
+		}
+		s.Books = req.Books
+		return nil
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	writeJSON(w, s)
+}
+
+// shareShelf creates a read-only link to a shelf of the current user, an existing link is kept
+func (app *booksingApp) shareShelf(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	s, err := app.changeShelf(user, r.PathValue("id"), func(s *shelf) error {
+		if s.Share != "" {
+			return nil
+		}
+		s.Share = randToken(16)
+		return app.store.put(shelfSharesBucket, s.Share, shelfRef{User: s.User, ID: s.ID})
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	slog.Info("audit: shelf shared", "user", user, "shelf", s.Name)
+	writeJSON(w, map[string]string{
+		"share": s.Share,
+		"url":   baseURL(r) + "/api/shared/" + s.Share,
+		"opds":  baseURL(r) + "/opds/shared/" + s.Share,
+	})
+}
+
+// unshareShelf revokes the share link of a shelf of the current user
+func (app *booksingApp) unshareShelf(w http.ResponseWriter, r *http.Request) {
+	user := getUserFromRequest(r)
+	s, err := app.changeShelf(user, r.PathValue("id"), func(s *shelf) error {
+		if s.Share == "" {
+			return nil
+		}
+		err := app.store.delete(shelfSharesBucket, s.Share)
+		s.Share = ""
+		return err
+	})
+	if err != nil {
+		renderShelfError(w, err)
+		return
+	}
+	slog.Info("audit: shelf unshared", "user", user, "shelf", s.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSharedShelf shows a shared shelf to anyone with the link, without the owner, share token and the
+// locations of the files. Books and covers are downloaded through the link.
+func (app *booksingApp) getSharedShelf(w http.ResponseWriter, r *http.Request) {
+	s, err := app.sharedShelf(r.PathValue("token"))
+	if err != nil {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	books := app.shelfBooks(s)
+	for i, b := range books {
+		b.Path = ""
+		b.CoverPath = ""
+		b.Files = slices.Clone(b.Files)
+		for j := range b.Files {
+			b.Files[j].Path = ""
+		}
+		books[i] = b
+	}
+	writeJSON(w, map[string]interface{}{
+		"name":    s.Name,
+		"updated": s.Updated,
+		"items":   books,
+	})
+}
+
+// sharedDownload serves a book on a shared shelf
+func (app *booksingApp) sharedDownload(w http.ResponseWriter, r *http.Request) {
+	book, err := app.sharedBook(r.PathValue("token"), r.URL.Query().Get("hash"))
+	if err != nil {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	app.serveBook(w, r, book)
+}
+
+// sharedCover serves the cover of a book on a shared shelf
+func (app *booksingApp) sharedCover(w http.ResponseWriter, r *http.Request) {
+	book, err := app.sharedBook(r.PathValue("token"), r.URL.Query().Get("hash"))
+	if err != nil || !book.HasCover {
+		renderError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
+	http.ServeFile(w, r, book.CoverPath)
+}
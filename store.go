@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// store keeps everything booksing needs to remember that is not part of the search index.
+// Values are stored as json in a bucket per type.
+type store struct {
+	db *bolt.DB
+}
+
+const storeFileName = "booksing.db"
+
+// newStore opens the database in dir, creating it if it does not exist yet
+func newStore(dir string) (*store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create database dir: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, storeFileName), 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("database is in use, is booksing still running? %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+func (s *store) Close() error {
+	return s.db.Close()
+}
+
+func (s *store) put(bucket, key string, v interface{}) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), js)
+	})
+}
+
+// get decodes the value of key into v, it returns ErrNotFound if the key does not exist
+func (s *store) get(bucket, key string, v interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		val := b.Get([]byte(key))
+		if val == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(val, v)
+	})
+}
+
+func (s *store) delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// deleteBefore removes every key in the bucket that sorts before key
+func (s *store) deleteBefore(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < key; k, _ = c.First() {
+			err := c.Delete()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// each calls fn for every value in the bucket in key order, until fn returns an error
+func (s *store) each(bucket string, fn func(key string, val []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// listAll decodes all values in a bucket
+func listAll[T any](s *store, bucket string) ([]T, error) {
+	items := []T{}
+	err := s.each(bucket, func(_ string, val []byte) error {
+		var item T
+		err := json.Unmarshal(val, &item)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
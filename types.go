@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
@@ -10,20 +11,64 @@ var ErrNotFound = errors.New("query no results")
 var ErrDuplicate = errors.New("duplicate key")
 
 type SearchResult struct {
-	Items []Book
-	Total int64
+	Items  []Book
+	Total  int64
+	Facets map[string]map[string]int64 `json:",omitempty"`
 }
 
+// SearchQuery describes a search, an empty Query matches all books
+type SearchQuery struct {
+	Query  string
+	Limit  int64
+	Offset int64
+	Filter SearchFilter
+	// Facets lists the fields for which the number of books per value should be returned
+	Facets []string
+	// Sort orders the results, without it the results are ordered by relevance
+	Sort []SortOrder
+}
+
+// SortOrder sorts the results on a single field
+type SortOrder struct {
+	Field      string
+	Descending bool
+}
+
+// SearchFilter restricts a search to exact field values, empty fields are ignored
+type SearchFilter struct {
+	Language        string
+	Author          string
+	Series          string
+	Publisher       string
+	ISBN            string
+	PublishedAfter  time.Time
+	PublishedBefore time.Time
+}
+
+// facetFields are the book fields that can be used as a facet
+var facetFields = []string{"Language", "Author", "Series", "Publisher"}
+
+// sortFields are the book fields that results can be sorted on
+var sortFields = []string{"Added", "Title", "Author", "Series", "SeriesIndex", "PublishDate"}
+
+// maxFacetValues is the maximum number of distinct values returned per facet
+const maxFacetValues = 10000
+
 // booksingApp holds all relevant global stuff for the booksing server
 type booksingApp struct {
 	searchDB       searchDB
+	store          *store
 	bookDir        string
 	importDir      string
 	timezone       *time.Location
 	cfg            configuration
-	state          string
+	oidc           *oidcVerifier
 	webHookEnabled bool
-	refreshChan    chan bool
+	// watching holds the files the import dir watcher waits on to stop changing
+	watching sync.Map
+	// basicAuth and logins keep bcrypt off the hot path and slow down password guessing
+	basicAuth basicAuthCache
+	logins    loginBackoff
 }
 
 type searchDB interface {
@@ -31,6 +76,8 @@ type searchDB interface {
 	GetBookCount() int
 	HasHash(string) (bool, error)
 	DeleteBook(string) error
-	GetBooks(string, int64, int64) (*SearchResult, error)
+	GetBooks(SearchQuery) (*SearchResult, error)
 	GetBook(string) (*Book, error)
+	// Rebuild replaces all books with the books fill adds, searches keep using the old books until it is done
+	Rebuild(fill func(add func([]Book) error) error) error
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// pendingFile is a file in the import dir that is still being written
+type pendingFile struct {
+	changed time.Time
+	size    int64
+}
+
+// watchImportDir imports new files in the import dir as soon as they stop changing. Files are only imported
+// when no events were seen for WatchDelay and their size did not change since the previous check, so books
+// that are still being copied are not moved to the faildir. The returned func stops the watcher.
+func (app *booksingApp) watchImportDir() (func(), error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watchRecursive(w, app.importDir)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	slog.Info("watching import dir", "importDir", app.importDir, "delay", app.cfg.WatchDelay)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		app.watchLoop(w, stop)
+	}()
+	return sync.OnceFunc(func() {
+		close(stop)
+		<-done
+	}), nil
+}
+
+// isWatched reports whether the watcher is waiting for the file to stop changing, scans skip those files
+func (app *booksingApp) isWatched(p string) bool {
+	_, ok := app.watching.Load(filepath.Clean(p))
+	return ok
+}
+
+func watchRecursive(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+}
+
+func (app *booksingApp) watchLoop(w *fsnotify.Watcher, stop <-chan struct{}) {
+	defer w.Close()
+
+	delay := app.cfg.WatchDelay
+	if delay <= 0 {
+		delay = 2 * time.Second
+	}
+	ticker := time.NewTicker(delay / 2)
+	defer ticker.Stop()
+
+	pending := map[string]*pendingFile{}
+	touch := func(p string) {
+		if f, ok := pending[p]; ok {
+			f.changed = time.Now()
+			return
+		}
+		pending[p] = &pendingFile{changed: time.Now(), size: -1}
+		app.watching.Store(filepath.Clean(p), true)
+	}
+	done := func(p string) {
+		delete(pending, p)
+		app.watching.Delete(filepath.Clean(p))
+	}
+	defer func() {
+		for p := range pending {
+			done(p)
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				done(ev.Name)
+				continue
+			}
+			fi, err := os.Stat(ev.Name)
+			if err != nil {
+				continue
+			}
+			if fi.IsDir() {
+				// directories that are moved in already contain files, those do not get their own events
+				if ev.Has(fsnotify.Create) {
+					err = watchRecursive(w, ev.Name)
+					if err != nil {
+						slog.Warn("unable to watch dir", "err", err, "dir", ev.Name)
+					}
+					filepath.WalkDir(ev.Name, func(p string, d fs.DirEntry, err error) error {
+						if err == nil && !d.IsDir() {
+							touch(p)
+						}
+						return nil
+					})
+				}
+				continue
+			}
+			touch(ev.Name)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("import dir watcher failed", "err", err)
+
+		case <-ticker.C:
+			var ready []string
+			for p, f := range pending {
+				fi, err := os.Stat(p)
+				if err != nil {
+					done(p)
+					continue
+				}
+				if fi.Size() != f.size {
+					f.size = fi.Size()
+					f.changed = time.Now()
+					continue
+				}
+				if time.Since(f.changed) < delay {
+					continue
+				}
+				done(p)
+				if formatForFile(p) != nil {
+					ready = append(ready, p)
+				}
+			}
+			if len(ready) > 0 {
+				go app.importWatched(ready)
+			}
+		}
+	}
+}
+
+// importWatched imports files found by the watcher, it waits for a running import to finish
+func (app *booksingApp) importWatched(files []string) {
+	importLock.Lock()
+	defer importLock.Unlock()
+
+	// a full scan might have imported the files already
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+	if len(existing) == 0 {
+		return
+	}
+	slog.Info("importing new files from watcher", "total", len(existing))
+	app.importFiles(newImportJob(importSourceWatch, "", existing))
+}
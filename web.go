@@ -1,6 +1,7 @@
 package main
 
 import (
+	"cmp"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -98,27 +100,107 @@ func (app *booksingApp) searchAPI(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	filter, err := parseSearchFilter(r)
+	if err != nil {
+		renderError(w, "INVALID_FILTER", http.StatusBadRequest)
+		return
+	}
+
+	var facets []string
+	if f := r.URL.Query().Get("facets"); f != "" {
+		facets = strings.Split(f, ",")
+		for _, facet := range facets {
+			if !slices.Contains(facetFields, facet) {
+				renderError(w, "INVALID_FACET", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	order, err := parseSortOrder(r.URL.Query().Get("sort"))
+	if err != nil {
+		renderError(w, "INVALID_SORT", http.StatusBadRequest)
+		return
+	}
+
 	var books *SearchResult
 
-	books, err = app.searchDB.GetBooks(q, limit, offset)
+	books, err = app.searchDB.GetBooks(SearchQuery{
+		Query:  q,
+		Limit:  limit,
+		Offset: offset,
+		Filter: filter,
+		Facets: facets,
+		Sort:   order,
+	})
 	if err != nil {
 		slog.Warn("failed to search DB", "err", err)
-		//TODO: add error handling
+		renderError(w, "SEARCH_FAILED", http.StatusInternalServerError)
+		return
 	}
 
-	for i, b := range books.Items {
+	books.Items = app.trimCoverPaths(books.Items)
+
+	writeJSON(w, books)
+}
+
+// trimCoverPaths makes the cover paths relative to the bookdir, so they can be used with getCover
+func (app *booksingApp) trimCoverPaths(books []Book) []Book {
+	for i, b := range books {
 		b.CoverPath = strings.TrimPrefix(b.CoverPath, app.bookDir)
-		books.Items[i] = b
+		books[i] = b
 	}
+	return books
+}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	js, _ := json.Marshal(books)
-	_, err = w.Write(js)
-	if err != nil {
-		slog.Warn("failed to write search result", "err", err)
+// parseSortOrder parses a comma separated list of fields with an optional direction, like "Series,SeriesIndex:asc,Added:desc"
+func parseSortOrder(s string) ([]SortOrder, error) {
+	var order []SortOrder
+	if s == "" {
+		return order, nil
 	}
+	for _, part := range strings.Split(s, ",") {
+		field, dir, _ := strings.Cut(part, ":")
+		if !slices.Contains(sortFields, field) {
+			return nil, fmt.Errorf("%s can not be used to sort", field)
+		}
+		switch dir {
+		case "", "asc":
+			order = append(order, SortOrder{Field: field})
+		case "desc":
+			order = append(order, SortOrder{Field: field, Descending: true})
+		default:
+			return nil, fmt.Errorf("unknown sort direction %s", dir)
+		}
+	}
+	return order, nil
+}
 
+// parseSearchFilter reads the exact filters from the query string, dates can be in any format ParseTime understands
+func parseSearchFilter(r *http.Request) (SearchFilter, error) {
+	v := r.URL.Query()
+	filter := SearchFilter{
+		Language:  v.Get("language"),
+		Author:    v.Get("author"),
+		Series:    v.Get("series"),
+		Publisher: v.Get("publisher"),
+		ISBN:      v.Get("isbn"),
+	}
+	if after := v.Get("after"); after != "" {
+		t, err := ParseTime(after)
+		if err != nil {
+			return filter, err
+		}
+		filter.PublishedAfter = t
+	}
+	if before := v.Get("before"); before != "" {
+		t, err := ParseTime(before)
+		if err != nil {
+			return filter, err
+		}
+		filter.PublishedBefore = t
+	}
+	return filter, nil
 }
 
 func (app *booksingApp) downloadBook(w http.ResponseWriter, r *http.Request) {
@@ -130,29 +212,59 @@ func (app *booksingApp) downloadBook(w http.ResponseWriter, r *http.Request) {
 		slog.Error("could not find book", "err", err, "hash", hash)
 		return
 	}
+	app.serveBook(w, r, book)
+}
+
+// serveBook sends the file in the format of the format parameter, kobo devices get a kepub by default
+func (app *booksingApp) serveBook(w http.ResponseWriter, r *http.Request, book *Book) {
+	format := r.URL.Query().Get("format")
+	if format == "" && isKobo(r) {
+		if _, ok := book.file(formatEPUB); ok {
+			format = formatKEPUB
+		}
+	}
+	// kepubs are generated from the epub, without a format the file that was imported first is served
+	source := format
+	if format == formatKEPUB {
+		source = formatEPUB
+	}
+	file, ok := book.file(source)
+	if !ok {
+		renderError(w, "FORMAT_NOT_FOUND", http.StatusNotFound)
+		return
+	}
+
+	app.trackDownload(webHookData{
+		IPs:    getIPFromRequest(r),
+		User:   getUserFromRequest(r),
+		Hash:   book.Hash,
+		Action: webHookDownload,
+		Format: cmp.Or(format, file.Format),
+	}, book, r.UserAgent())
 
-	if app.webHookEnabled {
-		//do this async so the user does not have to wait for the webhook to finish
-		go app.fireWebHook(webHookData{
-			IPs:  getIPFromRequest(r),
-			User: getUserFromRequest(r),
-			Hash: hash,
-		})
+	if format == formatKEPUB {
+		app.serveKepub(w, r, book, file)
+		return
 	}
 
-	fName := path.Base(book.Path)
-	w.Header().Set("Content-Type", "application/epub+zip")
+	fName := path.Base(file.Path)
+	w.Header().Set("Content-Type", formatByName(file.Format).ContentType)
 	w.Header().Set("Content-Disposition",
 		fmt.Sprintf("attachment; filename=\"%s\"", fName))
-	http.ServeFile(w, r, book.Path)
+	http.ServeFile(w, r, file.Path)
 }
 
 const maxUploadSize = 20 * 1024 * 1024 // 2 mb
 
+// uploadDir holds uploads until their import job has run, resumeUploads picks them up after a restart
+func (app *booksingApp) uploadDir() string {
+	return filepath.Join(app.cfg.CacheDir, "uploads")
+}
+
 func (app *booksingApp) addBook(w http.ResponseWriter, r *http.Request) {
 
 	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		fmt.Printf("Could not parse multipart form: %v\n", err)
+		slog.Error("could not parse multipart form", "err", err)
 		renderError(w, "CANT_PARSE_FORM", http.StatusInternalServerError)
 		return
 	}
@@ -164,9 +276,8 @@ func (app *booksingApp) addBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer file.Close()
-	// Get and print out file size
 	fileSize := fileHeader.Size
-	fmt.Printf("File size (bytes): %v\n", fileSize)
+	slog.Debug("received upload", "name", fileHeader.Filename, "size", fileSize)
 	// validate file size
 	if fileSize > maxUploadSize {
 		renderError(w, "FILE_TOO_BIG", http.StatusBadRequest)
@@ -178,21 +289,33 @@ func (app *booksingApp) addBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check file type, detectContentType only needs the first 512 bytes
-	detectedFileType := http.DetectContentType(fileBytes)
-	slog.Info("File type detected as ", "filetype", detectedFileType)
-	switch detectedFileType {
-	case "application/zip":
-		break
-	default:
+	// check file type, the extension of the upload is used when the content matches it
+	ext := strings.ToLower(filepath.Ext(fileHeader.Filename))
+	format := formatForExt(ext)
+	if format == nil || !format.Magic(fileBytes) {
+		format = formatForHeader(fileBytes)
+	}
+	if format == nil {
 		renderError(w, "INVALID_FILE_TYPE", http.StatusBadRequest)
 		return
 	}
+	detectedFileType := format.ContentType
+	slog.Info("File type detected as ", "filetype", detectedFileType)
 	fileName := randToken(12)
 
-	newFileName := fileName + ".epub"
-	newPath := filepath.Join(app.importDir, newFileName)
-	fmt.Printf("FileType: %s, File: %s\n", detectedFileType, newPath)
+	if formatForExt(ext) != format {
+		ext = format.Extensions[0]
+	}
+	newFileName := fileName + ext
+	// uploads are imported by their own job, so they are kept out of the import dir
+	uploadDir := app.uploadDir()
+	err = os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		renderError(w, "CANT_WRITE_FILE", http.StatusInternalServerError)
+		return
+	}
+	newPath := filepath.Join(uploadDir, newFileName)
+	slog.Debug("storing upload", "filetype", detectedFileType, "file", newPath)
 	// write file
 	newFile, err := os.Create(newPath)
 	if err != nil {
@@ -204,9 +327,35 @@ func (app *booksingApp) addBook(w http.ResponseWriter, r *http.Request) {
 		renderError(w, "CANT_WRITE_FILE", http.StatusInternalServerError)
 		return
 	}
-	app.refreshChan <- true
-	w.Write([]byte("SUCCESS"))
+
+	job := newImportJob(importSourceUpload, getUserFromRequest(r), []string{newPath})
+	job.Files[0].Name = fileHeader.Filename
+	app.saveImportJob(job, true)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, job)
+
+	go func() {
+		importLock.Lock()
+		defer importLock.Unlock()
+		app.importFiles(job)
+	}()
 }
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		slog.Warn("failed to marshal json", "err", err)
+		renderError(w, "INTERNAL_ERROR", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(js)
+	if err != nil {
+		slog.Warn("failed to write json", "err", err)
+	}
+}
+
 func renderError(w http.ResponseWriter, message string, statusCode int) {
 	w.WriteHeader(statusCode)
 	w.Write([]byte(message))
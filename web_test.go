@@ -0,0 +1,1105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gnur/booksing/epub"
+)
+
+func newTestApp(t *testing.T) *booksingApp {
+	dir := t.TempDir()
+	cfg := configuration{
+		BookDir:       filepath.Join(dir, "books"),
+		ImportDir:     filepath.Join(dir, "import"),
+		FailDir:       filepath.Join(dir, "failed"),
+		DuplicateDir:  filepath.Join(dir, "duplicates"),
+		CacheDir:      filepath.Join(dir, "cache"),
+		SearchBackend: "memory",
+	}
+	for _, d := range []string{cfg.BookDir, cfg.ImportDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := newStore(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return &booksingApp{
+		searchDB:  NewMemorySearch(),
+		store:     db,
+		bookDir:   cfg.BookDir,
+		importDir: cfg.ImportDir,
+		timezone:  time.UTC,
+		cfg:       cfg,
+	}
+}
+
+func importTestBooks(t *testing.T, app *booksingApp, names ...string) {
+	for _, name := range names {
+		in, err := os.ReadFile(filepath.Join("testdata/import/gutenberg", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(app.importDir, name), in, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.refresh()
+}
+
+func TestRefreshSearchDownload(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub", "pg345.epub")
+
+	if c := app.searchDB.GetBookCount(); c != 2 {
+		t.Fatalf("expected 2 books to be imported, got %d", c)
+	}
+	if left, _ := filepath.Glob(filepath.Join(app.importDir, "*.epub")); len(left) != 0 {
+		t.Errorf("expected import dir to be empty, found %v", left)
+	}
+
+	rec := httptest.NewRecorder()
+	app.searchAPI(rec, httptest.NewRequest(http.MethodGet, "/api/search?q=dracula", nil))
+	var res SearchResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("unable to decode search result: %v", err)
+	}
+	if res.Total != 1 || len(res.Items) != 1 {
+		t.Fatalf("expected 1 search result, got %d", res.Total)
+	}
+	book := res.Items[0]
+
+	rec = httptest.NewRecorder()
+	app.downloadBook(rec, httptest.NewRequest(http.MethodGet, "/api/download?hash="+book.Hash, nil))
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected download to succeed, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/epub+zip" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if int64(len(body)) != book.Size {
+		t.Errorf("expected %d bytes, got %d", book.Size, len(body))
+	}
+}
+
+func TestDownloadHistory(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub", "pg345.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 10})
+	if err != nil || len(res.Items) != 2 {
+		t.Fatalf("expected 2 books, got %v (%v)", res, err)
+	}
+	books := res.Items
+
+	download := func(user, hash string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/download?hash="+hash, nil)
+		req.Header.Set("User-Agent", "test-reader")
+		rec := httptest.NewRecorder()
+		app.downloadBook(rec, req.WithContext(withUser(req.Context(), user)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected download to succeed, got %d", rec.Code)
+		}
+	}
+	download("alice", books[0].Hash)
+	download("alice", books[1].Hash)
+	download("bob", books[0].Hash)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/me/downloads?limit=1", nil)
+	rec := httptest.NewRecorder()
+	app.myDownloads(rec, req.WithContext(withUser(req.Context(), "alice")))
+	var mine struct {
+		Total int             `json:"total"`
+		Items []downloadEvent `json:"items"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&mine); err != nil {
+		t.Fatal(err)
+	}
+	if mine.Total != 2 || len(mine.Items) != 1 {
+		t.Fatalf("expected 1 of 2 downloads, got %d of %d", len(mine.Items), mine.Total)
+	}
+	if ev := mine.Items[0]; ev.Hash != books[1].Hash || ev.Title != books[1].Title || ev.Client != "test-reader" || ev.Format != "epub" {
+		t.Errorf("expected the latest download first, got %+v", ev)
+	}
+
+	for target, want := range map[string]int{
+		"/api/me/downloads?limit=9223372036854775807&offset=1": http.StatusOK,
+		"/api/me/downloads?offset=9223372036854775807":         http.StatusOK,
+		"/api/me/downloads?limit=-1":                           http.StatusBadRequest,
+		"/api/me/downloads?offset=-1":                          http.StatusBadRequest,
+		"/api/me/downloads?limit=many":                         http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+		app.myDownloads(rec, req.WithContext(withUser(req.Context(), "alice")))
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", target, want, rec.Code)
+		}
+	}
+
+	stats, err := app.downloadStats(30, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 3 || stats.Users != 2 || stats.Formats["epub"] != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(stats.Top) != 1 || stats.Top[0].Hash != books[0].Hash || stats.Top[0].Downloads != 2 {
+		t.Errorf("expected the most downloaded book on top, got %+v", stats.Top)
+	}
+
+	// without authentication everyone shares the anonymous user, so nobody gets a history
+	download(anonymousUser, books[0].Hash)
+	req = httptest.NewRequest(http.MethodGet, "/api/me/downloads", nil)
+	rec = httptest.NewRecorder()
+	app.myDownloads(rec, req.WithContext(withUser(req.Context(), anonymousUser)))
+	if err := json.NewDecoder(rec.Body).Decode(&mine); err != nil {
+		t.Fatal(err)
+	}
+	if mine.Total != 0 || len(mine.Items) != 0 {
+		t.Errorf("expected no downloads for the anonymous user, got %+v", mine.Items)
+	}
+
+	// downloads older than the retention are removed when a new download is stored
+	old := time.Now().AddDate(-2, 0, 0)
+	if err := app.store.put(downloadsBucket, fmt.Sprintf("%020d-old", old.UnixNano()), downloadEvent{Time: old, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	app.cfg.DownloadRetention = 24 * time.Hour
+	download("alice", books[0].Hash)
+	count := 0
+	app.eachDownload(func(ev downloadEvent) {
+		count++
+		if ev.Time.Before(time.Now().Add(-time.Hour)) {
+			t.Errorf("expected old downloads to be removed, found %+v", ev)
+		}
+	})
+	if count != 5 {
+		t.Errorf("expected 5 recent downloads, got %d", count)
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.TrashDir = filepath.Join(t.TempDir(), "trash")
+	importTestBooks(t, app, "pg345.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 1})
+	if err != nil || len(res.Items) != 1 {
+		t.Fatalf("expected 1 book, got %v (%v)", res, err)
+	}
+	book := res.Items[0]
+	rel, _ := filepath.Rel(app.bookDir, book.Path)
+
+	// the trash keeps the layout of the bookdir and does not overwrite a book that was trashed before
+	for _, want := range []string{rel, strings.TrimSuffix(rel, ".epub") + ".1.epub"} {
+		if err := app.deleteBook(book.Hash, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := app.searchDB.HasHash(book.Hash); ok {
+			t.Errorf("expected the book to be removed from the index")
+		}
+		if _, err := os.Stat(filepath.Join(app.cfg.TrashDir, want)); err != nil {
+			t.Errorf("expected the book in the trash at %s: %v", want, err)
+		}
+		if _, err := os.Stat(book.Path); !os.IsNotExist(err) {
+			t.Errorf("expected the book to be moved out of the bookdir")
+		}
+		importTestBooks(t, app, "pg345.epub")
+	}
+	if trashed, _ := filepath.Glob(filepath.Join(app.cfg.TrashDir, filepath.Dir(rel), "*")); len(trashed) != 4 {
+		t.Errorf("expected two books and two covers in the trash, got %v", trashed)
+	}
+
+	// when the files can not be moved the book stays in the index
+	app.cfg.TrashDir = filepath.Join(app.cfg.TrashDir, filepath.Dir(rel), filepath.Base(book.CoverPath))
+	if err := app.deleteBook(book.Hash, "test"); err == nil {
+		t.Fatal("expected the delete to fail when the trash dir is a file")
+	}
+	if ok, _ := app.searchDB.HasHash(book.Hash); !ok {
+		t.Errorf("expected the book to stay in the index")
+	}
+	for _, f := range []string{book.Path, book.CoverPath} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s to stay: %v", f, err)
+		}
+	}
+}
+
+func TestDuplicateImport(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg174.epub", "pg174 copy.epub")
+
+	if c := app.searchDB.GetBookCount(); c != 1 {
+		t.Fatalf("expected 1 book to be imported, got %d", c)
+	}
+	dups, err := listAll[duplicate](app.store, duplicatesBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dups) != 1 {
+		t.Fatalf("expected 1 duplicate to be queued, got %d", len(dups))
+	}
+	if dups[0].Reason != duplicateHash {
+		t.Errorf("expected duplicate by hash, got %s", dups[0].Reason)
+	}
+
+	_, err = app.resolveDuplicate(dups[0].ID, resolveKeepBoth, "test")
+	if err != nil {
+		t.Fatalf("unable to resolve duplicate: %v", err)
+	}
+	if c := app.searchDB.GetBookCount(); c != 2 {
+		t.Errorf("expected both books to be kept, got %d", c)
+	}
+	if _, err := os.Stat(dups[0].Candidate.Path); !os.IsNotExist(err) {
+		t.Errorf("expected candidate to be moved out of the duplicate dir")
+	}
+
+	// the kept book is a variant of the existing one, which survives edits
+	variant, err := app.searchDB.GetBook(dups[0].ExistingHash + "-" + dups[0].ID)
+	if err != nil {
+		t.Fatalf("expected the kept book to be a variant: %v", err)
+	}
+	if variant.Variant != dups[0].ID {
+		t.Errorf("expected variant %q, got %q", dups[0].ID, variant.Variant)
+	}
+	description := "The other copy"
+	edited, err := app.updateBook(variant.Hash, bookUpdate{Description: &description}, "test")
+	if err != nil {
+		t.Fatalf("expected the variant to be edited: %v", err)
+	}
+	if edited.Hash != variant.Hash {
+		t.Errorf("expected the variant to keep its hash, got %s", edited.Hash)
+	}
+	if dups, _ = listAll[duplicate](app.store, duplicatesBucket); len(dups) != 0 {
+		t.Errorf("expected review queue to be empty, got %d", len(dups))
+	}
+}
+
+func TestReplaceFormat(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg174.epub", "pg174 copy.epub")
+	dups, err := listAll[duplicate](app.store, duplicatesBucket)
+	if err != nil || len(dups) != 1 {
+		t.Fatalf("expected 1 duplicate, got %v (%v)", dups, err)
+	}
+	existing, err := app.searchDB.GetBook(dups[0].ExistingHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := app.cachedKepub(existing.Hash, existing.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	book, err := app.resolveDuplicate(dups[0].ID, resolveReplace, "test")
+	if err != nil {
+		t.Fatalf("unable to resolve duplicate: %v", err)
+	}
+	if book.Hash != existing.Hash || app.searchDB.GetBookCount() != 1 {
+		t.Errorf("expected the file of the existing book to be replaced, got %s", book.Hash)
+	}
+	// the new epub is older than the conversion of the old one, so it would be served otherwise
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("expected the kepub of the replaced epub to be removed")
+	}
+}
+
+func TestReplaceFormatFailure(t *testing.T) {
+	for name, tc := range map[string]struct {
+		// breakReplace makes the replace fail and returns whether the duplicate file should stay
+		breakReplace func(app *booksingApp, existing *Book, d duplicate) bool
+	}{
+		"new file missing": {func(app *booksingApp, existing *Book, d duplicate) bool {
+			if err := os.Remove(d.Candidate.Path); err != nil {
+				t.Fatal(err)
+			}
+			return false
+		}},
+		"old file can not be trashed": {func(app *booksingApp, existing *Book, d duplicate) bool {
+			app.cfg.TrashDir = existing.Path
+			return true
+		}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			app := newTestApp(t)
+			importTestBooks(t, app, "pg174.epub", "pg174 copy.epub")
+			dups, err := listAll[duplicate](app.store, duplicatesBucket)
+			if err != nil || len(dups) != 1 {
+				t.Fatalf("expected 1 duplicate, got %v (%v)", dups, err)
+			}
+			existing, err := app.searchDB.GetBook(dups[0].ExistingHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, _ := fileChecksum(existing.Path)
+
+			keepsCandidate := tc.breakReplace(app, existing, dups[0])
+			if _, err := app.resolveDuplicate(dups[0].ID, resolveReplace, "test"); err == nil {
+				t.Fatal("expected the replace to fail")
+			}
+			if after, _ := fileChecksum(existing.Path); after != before {
+				t.Errorf("expected the existing epub to be kept")
+			}
+			if _, err := os.Stat(dups[0].Candidate.Path); keepsCandidate && err != nil {
+				t.Errorf("expected the duplicate to be moved back: %v", err)
+			}
+			if staged, _ := filepath.Glob(filepath.Join(filepath.Dir(existing.Path), "*.new")); len(staged) != 0 {
+				t.Errorf("expected no staged files, got %v", staged)
+			}
+		})
+	}
+}
+
+func TestResolveDuplicateOfFile(t *testing.T) {
+	// the existing book is only a file at the target of the candidate, so it is replaced as a whole
+	setup := func(t *testing.T) (*booksingApp, duplicate, string) {
+		app := newTestApp(t)
+		importTestBooks(t, app, "pg174.epub", "pg174 copy.epub")
+		dups, err := listAll[duplicate](app.store, duplicatesBucket)
+		if err != nil || len(dups) != 1 {
+			t.Fatalf("expected 1 duplicate, got %v (%v)", dups, err)
+		}
+		existing, err := app.searchDB.GetBook(dups[0].ExistingHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := app.searchDB.DeleteBook(existing.Hash); err != nil {
+			t.Fatal(err)
+		}
+		d := dups[0]
+		d.Reason, d.ExistingHash, d.ExistingPath = duplicatePath, "", existing.Path
+		if err := app.store.put(duplicatesBucket, d.ID, d); err != nil {
+			t.Fatal(err)
+		}
+		return app, d, existing.Path
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		app, d, existingPath := setup(t)
+		book, err := app.resolveDuplicate(d.ID, resolveReplace, "test")
+		if err != nil {
+			t.Fatalf("unable to resolve duplicate: %v", err)
+		}
+		if book.Path != existingPath {
+			t.Errorf("expected the candidate to take the place of the existing file, got %s", book.Path)
+		}
+		if _, err := os.Stat(d.Candidate.Path); !os.IsNotExist(err) {
+			t.Errorf("expected the candidate to be moved out of the duplicate dir")
+		}
+	})
+
+	for name, breakReplace := range map[string]func(app *booksingApp, d duplicate, existingPath string){
+		"candidate can not be stored": func(app *booksingApp, d duplicate, existingPath string) {
+			if err := os.Remove(d.Candidate.Path); err != nil {
+				t.Fatal(err)
+			}
+		},
+		"existing file can not be trashed": func(app *booksingApp, d duplicate, existingPath string) {
+			app.cfg.TrashDir = existingPath
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			app, d, existingPath := setup(t)
+			breakReplace(app, d, existingPath)
+			if _, err := app.resolveDuplicate(d.ID, resolveReplace, "test"); err == nil {
+				t.Fatal("expected the replace to fail")
+			}
+			if _, err := os.Stat(existingPath); err != nil {
+				t.Errorf("expected the existing file to be kept: %v", err)
+			}
+			if n := app.searchDB.GetBookCount(); n != 0 {
+				t.Errorf("expected the candidate not to be indexed, got %d books", n)
+			}
+			stored, _ := filepath.Glob(filepath.Join(filepath.Dir(existingPath), "*-"+d.ID+"*"))
+			if len(stored) != 0 {
+				t.Errorf("expected the stored candidate to be removed, got %v", stored)
+			}
+		})
+	}
+
+	t.Run("candidate is moved back", func(t *testing.T) {
+		app, d, existingPath := setup(t)
+		app.cfg.TrashDir = existingPath
+		if _, err := app.resolveDuplicate(d.ID, resolveReplace, "test"); err == nil {
+			t.Fatal("expected the replace to fail")
+		}
+		if _, err := os.Stat(d.Candidate.Path); err != nil {
+			t.Errorf("expected the candidate to be in the duplicate dir: %v", err)
+		}
+	})
+
+	t.Run("keep both", func(t *testing.T) {
+		app, d, _ := setup(t)
+		book, err := app.resolveDuplicate(d.ID, resolveKeepBoth, "test")
+		if err != nil {
+			t.Fatalf("unable to resolve duplicate: %v", err)
+		}
+		if book.Variant != d.ID || !strings.HasSuffix(book.Hash, "-"+d.ID) {
+			t.Errorf("expected the kept book to be a variant, got %q with hash %s", book.Variant, book.Hash)
+		}
+	})
+}
+
+func TestImportJobs(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg174.epub", "pg174 copy.epub")
+
+	rec := httptest.NewRecorder()
+	app.listImports(rec, httptest.NewRequest(http.MethodGet, "/api/imports", nil))
+	var jobs []importJob
+	if err := json.NewDecoder(rec.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	// scans are only visible to admins
+	if len(jobs) != 0 {
+		t.Errorf("expected no visible jobs, got %d", len(jobs))
+	}
+
+	in, err := os.ReadFile("testdata/import/gutenberg/pg84.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("uploadFile", "frankenstein.epub")
+	fw.Write(in)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/add", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	app.addBook(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected upload to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job importJob
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status != importJobDone && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/api/imports/"+job.ID, nil)
+		req.SetPathValue("id", job.ID)
+		app.getImport(rec, req)
+		job = importJob{}
+		json.NewDecoder(rec.Body).Decode(&job)
+	}
+	if job.Status != importJobDone {
+		t.Fatalf("expected upload job to finish, got %q", job.Status)
+	}
+	if len(job.Files) != 1 || job.Files[0].Status != importIndexed || job.Files[0].Name != "frankenstein.epub" {
+		t.Errorf("expected the upload to be indexed, got %+v", job.Files)
+	}
+	if job.Counts[importIndexed] != 1 || job.Started == nil || job.Finished == nil {
+		t.Errorf("expected counts and timings, got %+v %v %v", job.Counts, job.Started, job.Finished)
+	}
+
+	app.cfg.Admins = []string{"unknown"}
+	rec = httptest.NewRecorder()
+	app.listImports(rec, httptest.NewRequest(http.MethodGet, "/api/imports", nil))
+	jobs = nil
+	if err := json.NewDecoder(rec.Body).Decode(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != job.ID {
+		t.Fatalf("expected both jobs newest first, got %d", len(jobs))
+	}
+	scan := &jobs[1]
+	if scan.Source != importSourceScan || scan.Counts[importIndexed] != 1 || scan.Counts[importDuplicate] != 1 {
+		t.Errorf("expected one indexed and one duplicate file in the scan, got %+v", scan.Counts)
+	}
+}
+
+// failingIndex is a searchDB that can not add books
+type failingIndex struct {
+	searchDB
+}
+
+func (failingIndex) AddBooks([]Book) error {
+	return errors.New("index unavailable")
+}
+
+func TestResumeUploads(t *testing.T) {
+	app := newTestApp(t)
+	if err := os.MkdirAll(app.uploadDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, name := range []string{"pg84.epub", "pg345.epub"} {
+		in, err := os.ReadFile(filepath.Join("testdata/import/gutenberg", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(app.uploadDir(), randToken(12)+".epub")
+		if err := os.WriteFile(p, in, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	// booksing stopped before the job of the first upload ran, the job of the second was never saved
+	job := newImportJob(importSourceUpload, "alice", paths[:1])
+	job.Files[0].Name = "frankenstein.epub"
+	app.saveImportJob(job, true)
+
+	if err := app.resumeUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if c := app.searchDB.GetBookCount(); c != 2 {
+		t.Errorf("expected both uploads to be imported, got %d books", c)
+	}
+	if left, _ := os.ReadDir(app.uploadDir()); len(left) != 0 {
+		t.Errorf("expected no uploads to be left, got %d", len(left))
+	}
+	var resumed importJob
+	if err := app.store.get(importsBucket, job.ID, &resumed); err != nil {
+		t.Fatal(err)
+	}
+	if resumed.Status != importJobDone || resumed.User != "alice" || resumed.Counts[importIndexed] != 1 ||
+		resumed.Files[0].Name != "frankenstein.epub" {
+		t.Errorf("expected the job of alice to be finished, got %+v", &resumed)
+	}
+	jobs, _ := listAll[*importJob](app.store, importsBucket)
+	if len(jobs) != 2 {
+		t.Errorf("expected a new job for the upload without one, got %d jobs", len(jobs))
+	}
+}
+
+func TestImportIndexFailure(t *testing.T) {
+	app := newTestApp(t)
+	app.searchDB = failingIndex{app.searchDB}
+	importTestBooks(t, app, "pg84.epub", "pg345.epub")
+
+	jobs, err := listAll[*importJob](app.store, importsBucket)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d (%v)", len(jobs), err)
+	}
+	if jobs[0].Counts[importFailed] != 2 || jobs[0].Counts[importIndexed] != 0 {
+		t.Errorf("expected both files to fail, got %+v", jobs[0].Counts)
+	}
+	for _, f := range jobs[0].Files {
+		if !strings.Contains(f.Error, "index unavailable") {
+			t.Errorf("expected the index error for %s, got %q", f.Name, f.Error)
+		}
+	}
+}
+
+func TestFailedImports(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.AcceptedLanguages = []string{"nl"}
+	if err := os.WriteFile(filepath.Join(app.importDir, "broken.epub"), []byte("not a zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	importTestBooks(t, app, "pg84.epub")
+
+	rec := httptest.NewRecorder()
+	app.listFailed(rec, httptest.NewRequest(http.MethodGet, "/api/failed", nil))
+	var failed []failedImport
+	if err := json.NewDecoder(rec.Body).Decode(&failed); err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]string{}
+	for _, f := range failed {
+		reasons[f.Name] = f.Reason
+	}
+	if len(failed) != 2 || reasons["broken.epub"] != failedParse || reasons["pg84.epub"] != failedLanguage {
+		t.Fatalf("expected a parse and a language failure, got %v", reasons)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/failed/pg84.epub/retry", strings.NewReader(`{"metadata": {"language": "nl"}}`))
+	req.SetPathValue("name", "pg84.epub")
+	rec = httptest.NewRecorder()
+	app.retryFailedAPI(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected retry to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if c := app.searchDB.GetBookCount(); c != 1 {
+		t.Errorf("expected the retried book to be indexed, got %d books", c)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/failed/broken.epub", nil)
+	req.SetPathValue("name", "broken.epub")
+	rec = httptest.NewRecorder()
+	app.deleteFailedAPI(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected delete to succeed, got %d", rec.Code)
+	}
+
+	failed, err := app.failedImports()
+	if err != nil || len(failed) != 0 {
+		t.Errorf("expected the faildir to be empty, got %v (%v)", failed, err)
+	}
+	if left, _ := listAll[failedImport](app.store, failedBucket); len(left) != 0 {
+		t.Errorf("expected no failure records, got %d", len(left))
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub", "pg174.epub")
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil || len(books) != 2 {
+		t.Fatalf("expected 2 books, got %d (%v)", len(books), err)
+	}
+	edited := books[0]
+	edited.Title = "Edited without write back"
+	if err := app.searchDB.AddBooks([]Book{edited}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := app.rebuild("test")
+	if err != nil {
+		t.Fatalf("rebuild failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 books to be rebuilt, got %d", n)
+	}
+	got, err := app.searchDB.GetBook(edited.Hash)
+	if err != nil {
+		t.Fatalf("expected book to keep its hash: %v", err)
+	}
+	if got.Title != edited.Title || got.HasCover != edited.HasCover {
+		t.Errorf("expected metadata to be kept, got %q (cover %v)", got.Title, got.HasCover)
+	}
+	if _, err := os.Stat(got.Path); err != nil {
+		t.Errorf("expected the book to stay where it was: %v", err)
+	}
+
+	// a lost index is rebuilt from the files alone
+	app.searchDB = NewMemorySearch()
+	n, err = app.rebuild("test")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 books from an empty index, got %d (%v)", n, err)
+	}
+	if c := app.searchDB.GetBookCount(); c != 2 {
+		t.Errorf("expected 2 books in the index, got %d", c)
+	}
+
+	// the running server rebuilds through the api
+	rec := httptest.NewRecorder()
+	app.rebuildAPI(rec, httptest.NewRequest(http.MethodPost, "/api/rebuild", nil))
+	var res struct {
+		Books int `json:"books"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Books != 2 {
+		t.Errorf("expected the api to rebuild 2 books, got %d (%v)", res.Books, err)
+	}
+	app.bookDir = t.TempDir()
+	rec = httptest.NewRecorder()
+	app.rebuildAPI(rec, httptest.NewRequest(http.MethodPost, "/api/rebuild", nil))
+	if rec.Code != http.StatusConflict || app.searchDB.GetBookCount() != 2 {
+		t.Errorf("expected an empty bookdir to keep the index, got %d", rec.Code)
+	}
+}
+
+func TestEditDuringRebuild(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub")
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil || len(books) != 1 {
+		t.Fatalf("expected 1 book, got %d (%v)", len(books), err)
+	}
+
+	// the delete waits for the rebuild, which would otherwise put the book back in the index
+	libraryLock.Lock()
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		app.deleteBookAPI(rec, httptest.NewRequest(http.MethodDelete, "/api/book?hash="+books[0].Hash, nil))
+		done <- rec.Code
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the delete to wait for the rebuild")
+	case <-time.After(50 * time.Millisecond):
+	}
+	libraryLock.Unlock()
+	if code := <-done; code != http.StatusNoContent {
+		t.Errorf("expected the delete to succeed after the rebuild, got %d", code)
+	}
+}
+
+func TestImportAddsFormat(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg84.epub")
+	books, err := app.allBooks(SearchFilter{})
+	if err != nil || len(books) != 1 {
+		t.Fatalf("expected 1 book, got %d (%v)", len(books), err)
+	}
+	book := books[0]
+
+	fb := `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook><description><title-info>
+<author><nickname>` + book.Author + `</nickname></author><book-title>` + book.Title + `</book-title>
+</title-info></description></FictionBook>`
+	err = os.WriteFile(filepath.Join(app.importDir, "frankenstein.fb2"), []byte(fb), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.refresh()
+
+	if c := app.searchDB.GetBookCount(); c != 1 {
+		t.Fatalf("expected the fb2 to be added to the existing book, got %d books", c)
+	}
+	got, err := app.searchDB.GetBook(book.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Files) != 2 {
+		t.Fatalf("expected 2 files, got %+v", got.Files)
+	}
+
+	rec := httptest.NewRecorder()
+	app.downloadBook(rec, httptest.NewRequest(http.MethodGet, "/api/download?hash="+book.Hash+"&format=fb2", nil))
+	if ct := rec.Result().Header.Get("Content-Type"); ct != "application/x-fictionbook+xml" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if body, _ := io.ReadAll(rec.Result().Body); string(body) != fb {
+		t.Errorf("expected the fb2 file to be served")
+	}
+
+	rec = httptest.NewRecorder()
+	app.downloadBook(rec, httptest.NewRequest(http.MethodGet, "/api/download?hash="+book.Hash+"&format=pdf", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected a missing format to return 404, got %d", rec.Code)
+	}
+
+	// a move that fails halfway puts the files that were moved already back
+	fb2, _ := got.file("fb2")
+	if err := os.Remove(fb2.Path); err != nil {
+		t.Fatal(err)
+	}
+	moved := *got
+	moved.Files = slices.Clone(got.Files)
+	moved.Title = "Frankenstein Revisited"
+	if err := app.moveBook(&moved); err == nil {
+		t.Fatal("expected the move to fail without the fb2 file")
+	}
+	if _, err := os.Stat(got.Path); err != nil {
+		t.Errorf("expected the epub to be moved back: %v", err)
+	}
+	if moved.Path != got.Path {
+		t.Errorf("expected the path to stay %s, got %s", got.Path, moved.Path)
+	}
+}
+
+func TestWatchImportDir(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.WatchDelay = 100 * time.Millisecond
+	stop, err := app.watchImportDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+
+	in, err := os.ReadFile("testdata/import/gutenberg/pg84.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write the book in two steps, like a slow copy
+	target := filepath.Join(app.importDir, "pg84.epub")
+	if err := os.WriteFile(target, in[:len(in)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20 && !app.isWatched(target); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a full scan leaves the half written book to the watcher
+	app.refresh()
+	if c := app.searchDB.GetBookCount(); c != 0 {
+		t.Errorf("expected the scan to skip the book that is still written, got %d books", c)
+	}
+	if err := os.WriteFile(target, in, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for app.searchDB.GetBookCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c := app.searchDB.GetBookCount(); c != 1 {
+		t.Fatalf("expected the watcher to import 1 book, got %d", c)
+	}
+	if failed, _ := filepath.Glob(filepath.Join(app.cfg.FailDir, "*")); len(failed) != 0 {
+		t.Errorf("expected no failed imports, got %v", failed)
+	}
+}
+
+func TestShelves(t *testing.T) {
+	app := newTestApp(t)
+	app.cfg.AuthProviders = []string{providerTailscale}
+	importTestBooks(t, app, "pg84.epub", "pg345.epub", "pg174.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 10})
+	if err != nil || len(res.Items) != 3 {
+		t.Fatalf("expected 3 books, got %v (%v)", res, err)
+	}
+	a, b, c := res.Items[0].Hash, res.Items[1].Hash, res.Items[2].Hash
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/shelves", app.listShelves)
+	mux.HandleFunc("POST /api/shelves", app.addShelf)
+	mux.HandleFunc("GET /api/shelves/{id}", app.getShelfAPI)
+	mux.HandleFunc("DELETE /api/shelves/{id}", app.deleteShelf)
+	mux.HandleFunc("POST /api/shelves/{id}/books", app.addToShelf)
+	mux.HandleFunc("PUT /api/shelves/{id}/books", app.reorderShelf)
+	mux.HandleFunc("DELETE /api/shelves/{id}/books/{hash}", app.removeFromShelf)
+	mux.HandleFunc("POST /api/shelves/{id}/share", app.shareShelf)
+	mux.HandleFunc("DELETE /api/shelves/{id}/share", app.unshareShelf)
+	mux.HandleFunc("GET /api/shared/{token}", app.getSharedShelf)
+	mux.HandleFunc("GET /api/shared/{token}/download", app.sharedDownload)
+	mux.HandleFunc("GET /api/shared/{token}/cover", app.sharedCover)
+	mux.HandleFunc("/opds/shared/{token}", app.opdsSharedShelf)
+	handler := app.authenticate(mux)
+
+	do := func(user, method, path, body string, v interface{}) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.Header.Set("Tailscale-User-Login", user)
+		}
+		handler.ServeHTTP(rec, req)
+		if v != nil && rec.Code == http.StatusOK {
+			if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+		return rec.Code
+	}
+
+	var shelves []shelf
+	do("alice", http.MethodGet, "/api/shelves", "", &shelves)
+	if len(shelves) != 2 || shelves[0].ID != shelfWantToRead || shelves[1].ID != shelfFavorites {
+		t.Fatalf("expected the built-in shelves, got %+v", shelves)
+	}
+
+	var s shelf
+	if code := do("alice", http.MethodPost, "/api/shelves", `{"name":"Gothic"}`, &s); code != http.StatusOK {
+		t.Fatalf("expected shelf to be created, got %d", code)
+	}
+	books := "/api/shelves/" + s.ID + "/books"
+	for _, hash := range []string{a, b, c, a} {
+		do("alice", http.MethodPost, books, `{"hash":"`+hash+`"}`, &s)
+	}
+	if !slices.Equal(s.Books, []string{a, b, c}) {
+		t.Errorf("expected books to be added once in order, got %v", s.Books)
+	}
+	if code := do("alice", http.MethodPost, books, `{"hash":"nope"}`, nil); code != http.StatusNotFound {
+		t.Errorf("expected unknown books to be refused, got %d", code)
+	}
+	if code := do("alice", http.MethodPut, books, `{"books":["`+c+`","`+a+`"]}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected an incomplete order to be refused, got %d", code)
+	}
+	do("alice", http.MethodPut, books, `{"books":["`+c+`","`+a+`","`+b+`"]}`, &s)
+	do("alice", http.MethodDelete, books+"/"+a, "", &s)
+	if !slices.Equal(s.Books, []string{c, b}) {
+		t.Errorf("expected reordered shelf without the removed book, got %v", s.Books)
+	}
+	if code := do("bob", http.MethodGet, "/api/shelves/"+s.ID, "", nil); code != http.StatusNotFound {
+		t.Errorf("expected shelves of other users to be hidden, got %d", code)
+	}
+	if code := do("alice", http.MethodDelete, "/api/shelves/"+shelfFavorites, "", nil); code != http.StatusBadRequest {
+		t.Errorf("expected built-in shelves not to be deleted, got %d", code)
+	}
+
+	var share struct {
+		Share string `json:"share"`
+	}
+	do("alice", http.MethodPost, "/api/shelves/"+s.ID+"/share", "", &share)
+	var shared struct {
+		Name  string `json:"name"`
+		Items []Book `json:"items"`
+	}
+	if code := do("", http.MethodGet, "/api/shared/"+share.Share, "", &shared); code != http.StatusOK {
+		t.Fatalf("expected shared shelf to be public, got %d", code)
+	}
+	if shared.Name != "Gothic" || len(shared.Items) != 2 || shared.Items[0].Hash != c {
+		t.Errorf("unexpected shared shelf %+v", shared)
+	}
+	for _, item := range shared.Items {
+		if item.Path != "" || item.CoverPath != "" || slices.ContainsFunc(item.Files, func(f BookFile) bool { return f.Path != "" }) {
+			t.Errorf("expected the shared shelf not to show file locations, got %+v", item)
+		}
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/opds/shared/"+share.Share, nil))
+	if rec.Code != http.StatusOK || strings.Count(rec.Body.String(), "<entry>") != 2 {
+		t.Errorf("expected an acquisition feed with 2 books, got %d", rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, `"/api/download`) || strings.Contains(body, `"/api/cover`) ||
+		!strings.Contains(body, `"/api/shared/`+share.Share+`/download?hash=`+c) {
+		t.Errorf("expected the feed to link to the downloads of the share, got %s", body)
+	}
+
+	// people with the link can only download the books on the shelf
+	shareURL := "/api/shared/" + share.Share
+	if code := do("", http.MethodGet, shareURL+"/download?hash="+c, "", nil); code != http.StatusOK {
+		t.Errorf("expected a book on the shared shelf to be downloaded, got %d", code)
+	}
+	if code := do("", http.MethodGet, shareURL+"/download?hash="+a, "", nil); code != http.StatusNotFound {
+		t.Errorf("expected a book that is not on the shelf to be refused, got %d", code)
+	}
+	for _, item := range shared.Items {
+		want := http.StatusNotFound
+		if item.HasCover {
+			want = http.StatusOK
+		}
+		if code := do("", http.MethodGet, shareURL+"/cover?hash="+item.Hash, "", nil); code != want {
+			t.Errorf("expected cover of %s to give %d, got %d", item.Title, want, code)
+		}
+	}
+
+	// edits and author merges change the hash of a book, the shelf follows the book
+	title := "Renamed"
+	edited, err := app.updateBook(c, bookUpdate{Title: &title}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, _ := app.searchDB.GetBook(b)
+	if err := app.renameAuthor(*moved, "Someone Else"); err != nil {
+		t.Fatal(err)
+	}
+	merged := HashBook("Someone Else", moved.Title)
+	do("alice", http.MethodGet, "/api/shelves/"+s.ID, "", &s)
+	if !slices.Equal(s.Books, []string{edited.Hash, merged}) {
+		t.Errorf("expected the shelf to contain the new hashes %v, got %v", []string{edited.Hash, merged}, s.Books)
+	}
+	if code := do("", http.MethodGet, shareURL+"/download?hash="+edited.Hash, "", nil); code != http.StatusOK {
+		t.Errorf("expected the edited book to be downloaded through the share, got %d", code)
+	}
+
+	do("alice", http.MethodDelete, "/api/shelves/"+s.ID+"/share", "", nil)
+	if code := do("", http.MethodGet, "/api/shared/"+share.Share, "", nil); code != http.StatusNotFound {
+		t.Errorf("expected revoked link to stop working, got %d", code)
+	}
+}
+
+func TestUpdateBook(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg345.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 1})
+	if err != nil || len(res.Items) != 1 {
+		t.Fatalf("expected 1 book, got %v (%v)", res, err)
+	}
+	book := res.Items[0]
+
+	// writing back moves the book to the location of the new title and updates the epub there
+	title := "Dracula's Guest"
+	edited, err := app.updateBook(book.Hash, bookUpdate{Title: &title, WriteBack: true}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited.Path == book.Path {
+		t.Errorf("expected the book to be moved, got %s", edited.Path)
+	}
+	if _, err := os.Stat(book.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the old file to be gone")
+	}
+	parsed, _, err := epub.ParseFile(edited.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Title != title {
+		t.Errorf("expected the epub to be titled %q, got %q", title, parsed.Title)
+	}
+	sum, _ := fileChecksum(edited.Path)
+	if f, _ := edited.file(formatEPUB); f.Checksum != sum {
+		t.Errorf("expected checksum %s to be stored, got %s", sum, f.Checksum)
+	}
+
+	// when the new location is taken, neither the epub nor the index change
+	taken := filepath.Join(app.bookDir, GetBookPath("Dracula", edited.Author)) + ".epub"
+	if err := os.WriteFile(taken, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	title = "Dracula"
+	_, err = app.updateBook(edited.Hash, bookUpdate{Title: &title, WriteBack: true}, "test")
+	if !errors.Is(err, ErrFileAlreadyExists) {
+		t.Fatalf("expected the location to be taken, got %v", err)
+	}
+	if after, _ := fileChecksum(edited.Path); after != sum {
+		t.Errorf("expected the epub to be left untouched")
+	}
+	indexed, err := app.searchDB.GetBook(edited.Hash)
+	if err != nil {
+		t.Fatalf("expected the book to stay in the index: %v", err)
+	}
+	if indexed.Title != edited.Title || indexed.Path != edited.Path {
+		t.Errorf("expected the index to be unchanged, got %s at %s", indexed.Title, indexed.Path)
+	}
+
+	// when the index can not be updated the files go back to where the index expects them
+	app.searchDB = failingIndex{app.searchDB}
+	title = "Carmilla"
+	if _, err := app.updateBook(edited.Hash, bookUpdate{Title: &title}, "test"); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if _, err := os.Stat(edited.Path); err != nil {
+		t.Errorf("expected the book to be moved back: %v", err)
+	}
+}
+
+func TestRenameAuthorFailure(t *testing.T) {
+	app := newTestApp(t)
+	importTestBooks(t, app, "pg345.epub")
+	res, err := app.searchDB.GetBooks(SearchQuery{Limit: 1})
+	if err != nil || len(res.Items) != 1 {
+		t.Fatalf("expected 1 book, got %v (%v)", res, err)
+	}
+	book := res.Items[0]
+
+	// when the index can not be updated the files go back to where the index expects them
+	app.searchDB = failingIndex{app.searchDB}
+	if err := app.renameAuthor(book, "Someone Else"); err == nil {
+		t.Fatal("expected the rename to fail")
+	}
+	for _, f := range []string{book.Path, book.CoverPath} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s to be moved back: %v", f, err)
+		}
+	}
+}
+
+func TestImportPendingFormatFailure(t *testing.T) {
+	app := newTestApp(t)
+	fb := `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook><description><title-info>
+<author><nickname>Mary Shelley</nickname></author><book-title>Frankenstein</book-title>
+</title-info></description></FictionBook>`
+	f := filepath.Join(app.importDir, "frankenstein.fb2")
+	if err := os.WriteFile(f, []byte(fb), 0644); err != nil {
+		t.Fatal(err)
+	}
+	book, cover, err := ParseBookFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the book of the same batch is in a dir that does not exist, so the format can not be added to it
+	existing := &Book{Hash: book.Hash, Format: formatEPUB, Path: filepath.Join(t.TempDir(), "gone", "frankenstein.epub")}
+	_, status, err := app.importBook(book, cover, map[string]*Book{book.Hash: existing})
+	if status != importFailed || err == nil {
+		t.Errorf("expected the import to fail, got %q (%v)", status, err)
+	}
+	if _, err := os.Stat(filepath.Join(app.cfg.FailDir, "frankenstein.fb2")); err != nil {
+		t.Errorf("expected the file to be moved to the faildir: %v", err)
+	}
+}